@@ -3,17 +3,19 @@ package main
 import (
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"runtime"
 
 	"github.com/mkabilov/logical_backup/pkg/config"
 	"github.com/mkabilov/logical_backup/pkg/logicalbackup"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
 )
 
 var (
-	configFile = flag.String("config", "config.yaml", "path to the config file")
-	version    = flag.Bool("version", false, "Print version information")
+	configFile  = flag.String("config", "config.yaml", "path to the config file, empty to configure with LBT_* variables only")
+	version     = flag.Bool("version", false, "Print version information")
+	checkConfig = flag.Bool("check-config", false, "Validate the config, check the database and the archive, print the effective config and exit")
 
 	Version  = "devel"
 	Revision = "devel"
@@ -25,6 +27,25 @@ func buildInfo() string {
 	return fmt.Sprintf("logical backup version %s git revision %s go version %s", Version, Revision, GoVersion)
 }
 
+// check prints the effective config and the outcome of the checks, returns the exit code
+func check(cfg *config.Config) int {
+	cfg.PrintEffective(os.Stdout)
+	fmt.Println()
+
+	code := 0
+	for _, c := range cfg.CheckEnvironment() {
+		if c.Err != nil {
+			fmt.Printf("FAIL %s: %v\n", c.Name, c.Err)
+			code = 1
+			continue
+		}
+
+		fmt.Printf("ok   %s\n", c.Name)
+	}
+
+	return code
+}
+
 func main() {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s\n", buildInfo())
@@ -38,7 +59,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	if _, err := os.Stat(*configFile); os.IsNotExist(err) {
+	if _, err := os.Stat(*configFile); *configFile != "" && os.IsNotExist(err) {
 		fmt.Fprintf(os.Stderr, "Config file %s does not exist", *configFile)
 		os.Exit(1)
 	}
@@ -49,11 +70,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := logger.Setup(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not set up logging: %v", err)
+		os.Exit(1)
+	}
+
+	if *checkConfig {
+		os.Exit(check(cfg))
+	}
+
 	cfg.Print()
 
 	lb, err := logicalbackup.New(cfg)
 	if err != nil {
-		log.Fatalf("could not create backup instance: %v", err)
+		slog.Error("could not create backup instance", "error", err)
+		os.Exit(1)
 	}
 
 	if err := lb.Run(); err != nil {
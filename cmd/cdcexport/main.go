@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/mkabilov/logical_backup/pkg/cdc"
+	"github.com/mkabilov/logical_backup/pkg/logicalbackup"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
+	"github.com/mkabilov/logical_backup/pkg/utils/namehistory"
+)
+
+var (
+	backupDir  *string
+	tableName  *string
+	fromLSN    *string
+	outputFile *string
+
+	encryptionKeys encryption.KeyFlags
+
+	s3Endpoint  *string
+	s3Region    *string
+	s3PathStyle *bool
+
+	Version  = "devel"
+	Revision = "devel"
+
+	GoVersion = runtime.Version()
+)
+
+func buildInfo() string {
+	return fmt.Sprintf("logical backup cdc export tool %s git revision %s go version %s", Version, Revision, GoVersion)
+}
+
+func init() {
+	backupDir = flag.String("backup-dir", "", "Backups dir or s3://bucket/prefix url")
+	tableName = flag.String("table", "", "Export only the table with the name, i.e. public.foo")
+	fromLSN = flag.String("from-lsn", "", "Export only the transactions with the final lsn greater than the given one")
+	outputFile = flag.String("output", "", "File to write the events to, stdout if not set")
+	flag.Var(&encryptionKeys, "encryption-key",
+		"Key to decrypt the backup with, as id:/path/to/file or id:$ENV_VARIABLE (can be repeated)")
+
+	s3Endpoint = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3-compatible storage endpoint")
+	s3Region = flag.String("s3-region", "", "S3 region")
+	s3PathStyle = flag.Bool("s3-path-style", false, "Address the S3 bucket as the path, i.e. for MinIO")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n", buildInfo())
+		fmt.Fprintf(os.Stderr, "\nUsage:\n\t%s [options]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *backupDir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+func fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
+
+func main() {
+	lsn := dbutils.InvalidLSN
+	if *fromLSN != "" {
+		if err := lsn.Parse(*fromLSN); err != nil {
+			fail("could not parse from lsn: %v", err)
+		}
+	}
+
+	keyring, err := encryptionKeys.Keyring()
+	if err != nil {
+		fail("could not load encryption keys: %v", err)
+	}
+
+	// credentials are taken from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+	archive, err := storage.NewFromLocation(*backupDir, storage.S3Config{
+		Endpoint:  *s3Endpoint,
+		Region:    *s3Region,
+		PathStyle: *s3PathStyle,
+	})
+	if err != nil {
+		fail("could not init backup storage: %v", err)
+	}
+
+	names := namehistory.New(archive, logicalbackup.OidNameMapFile, keyring)
+	if err := names.Load(); err != nil {
+		fail("could not load table names: %v", err)
+	}
+
+	oids := make([]dbutils.OID, 0)
+	if *tableName != "" {
+		tbl := message.NamespacedName{Namespace: "public", Name: *tableName}
+		if parts := strings.SplitN(*tableName, ".", 2); len(parts) == 2 {
+			tbl = message.NamespacedName{Namespace: parts[0], Name: parts[1]}
+		}
+
+		oid, _ := names.GetOID(tbl, dbutils.InvalidLSN)
+		if oid == dbutils.InvalidOID {
+			fail("could not find table %s", tbl)
+		}
+		oids = append(oids, oid)
+	} else {
+		for oid := range names.Entries() {
+			oids = append(oids, oid)
+		}
+		sort.Slice(oids, func(i, j int) bool { return oids[i] < oids[j] })
+	}
+
+	out := os.Stdout
+	if *outputFile != "" {
+		out, err = os.Create(*outputFile)
+		if err != nil {
+			fail("could not create output file: %v", err)
+		}
+	}
+
+	w := bufio.NewWriter(out)
+	exporter := cdc.New(w)
+	for _, oid := range oids {
+		if err := cdc.ExportTable(archive, keyring, oid, lsn, exporter); err != nil {
+			fail("could not export table with oid %d: %v", oid, err)
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		fail("could not write events: %v", err)
+	}
+
+	if err := out.Close(); err != nil {
+		fail("could not close output file: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+// transaction is the context of the messages following the begin message
+type transaction struct {
+	lsn  dbutils.LSN // final lsn
+	xid  int32
+	time time.Time // commit timestamp
+}
+
+// filter selects the messages to print, unset fields match any message
+type filter struct {
+	types       map[message.MType]struct{}
+	relationOID dbutils.OID
+	xid         int32
+	fromLSN     dbutils.LSN
+	toLSN       dbutils.LSN
+	fromTime    time.Time
+	toTime      time.Time
+}
+
+func parseTypes(str string) (map[message.MType]struct{}, error) {
+	types := make(map[message.MType]struct{})
+	if str == "" {
+		return types, nil
+	}
+
+	for _, name := range strings.Split(str, ",") {
+		found := false
+		for t := message.MsgInsert; t <= message.MsgTruncate; t++ {
+			if t.String() == strings.TrimSpace(name) {
+				types[t] = struct{}{}
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unknown message type %q", name)
+		}
+	}
+
+	return types, nil
+}
+
+func parseLSN(str string) (dbutils.LSN, error) {
+	lsn := dbutils.InvalidLSN
+	if str == "" {
+		return lsn, nil
+	}
+
+	err := lsn.Parse(str)
+
+	return lsn, err
+}
+
+func parseTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, str)
+}
+
+// relationOIDs returns oids of the relations the message refers to
+func relationOIDs(msg message.Message) []dbutils.OID {
+	switch v := msg.(type) {
+	case message.Insert:
+		return []dbutils.OID{v.RelationOID}
+	case message.Update:
+		return []dbutils.OID{v.RelationOID}
+	case message.Delete:
+		return []dbutils.OID{v.RelationOID}
+	case message.Relation:
+		return []dbutils.OID{v.OID}
+	case message.Truncate:
+		return v.RelationOIDs
+	}
+
+	return nil
+}
+
+func (f filter) match(msg message.Message, tx transaction) bool {
+	if len(f.types) > 0 {
+		if _, ok := f.types[msg.MsgType()]; !ok {
+			return false
+		}
+	}
+
+	if f.relationOID != dbutils.InvalidOID {
+		found := false
+		for _, oid := range relationOIDs(msg) {
+			if oid == f.relationOID {
+				found = true
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if f.xid != 0 && tx.xid != f.xid {
+		return false
+	}
+
+	if f.fromLSN.IsValid() && tx.lsn < f.fromLSN {
+		return false
+	}
+
+	if f.toLSN.IsValid() && tx.lsn > f.toLSN {
+		return false
+	}
+
+	if !f.fromTime.IsZero() && tx.time.Before(f.fromTime) {
+		return false
+	}
+
+	if !f.toTime.IsZero() && tx.time.After(f.toTime) {
+		return false
+	}
+
+	return true
+}
@@ -1,18 +1,32 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
 
 	"github.com/mkabilov/logical_backup/pkg/deltas"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
 )
 
 const columnWidth = 10
 
 var (
-	filePaths []string
+	filePaths      []string
+	encryptionKeys encryption.KeyFlags
+	keyring        *encryption.Keyring
+
+	format       *string
+	showHeader   *bool
+	showStats    *bool
+	showMessages *bool
+	sqlMode      *bool
+	msgFilter    filter
 
 	Version  = "devel"
 	Revision = "devel"
@@ -24,40 +38,143 @@ func buildInfo() string {
 	return fmt.Sprintf("logical backup delta inspector tool %s git revision %s go version %s", Version, Revision, GoVersion)
 }
 
+func fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
+}
+
 func init() {
-	if len(os.Args) < 2 {
+	var err error
+
+	flag.Var(&encryptionKeys, "encryption-key",
+		"Key to decrypt the delta files with, as id:/path/to/file or id:$ENV_VARIABLE (can be repeated)")
+	format = flag.String("format", formatText, "Output format: text or json")
+	showHeader = flag.Bool("header", false, "Print the header of the delta file")
+	showStats = flag.Bool("stats", false, "Print the number of the messages per type and per transaction")
+	showMessages = flag.Bool("messages", true, "Print the messages")
+	sqlMode = flag.Bool("sql", false, "Print the changes as sql statements")
+
+	types := flag.String("type", "", "Print only the messages of the types, comma separated, i.e. insert,update")
+	relationOID := flag.Uint("relation", 0, "Print only the messages of the relation with the oid")
+	xid := flag.Int("xid", 0, "Print only the messages of the transaction")
+	fromLSN := flag.String("from-lsn", "", "Print only the transactions with the final lsn not less than the given one")
+	toLSN := flag.String("to-lsn", "", "Print only the transactions with the final lsn not greater than the given one")
+	fromTime := flag.String("from-time", "", "Print only the transactions committed at or after the time, in RFC3339 format")
+	toTime := flag.String("to-time", "", "Print only the transactions committed at or before the time, in RFC3339 format")
+	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "%s\n", buildInfo())
-		fmt.Fprintf(os.Stderr, "\nUsage:\n\t%s {deltafile}\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nUsage:\n\t%s [options] {deltafile}\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
 		os.Exit(1)
 	}
 
-	filePaths = os.Args[1:]
+	filePaths = flag.Args()
+
+	if *format != formatText && *format != formatJSON {
+		fail("unknown output format %q", *format)
+	}
+
+	msgFilter.relationOID = dbutils.OID(*relationOID)
+	msgFilter.xid = int32(*xid)
+
+	if msgFilter.types, err = parseTypes(*types); err != nil {
+		fail("could not parse message types: %v", err)
+	}
+
+	if msgFilter.fromLSN, err = parseLSN(*fromLSN); err != nil {
+		fail("could not parse from lsn: %v", err)
+	}
+
+	if msgFilter.toLSN, err = parseLSN(*toLSN); err != nil {
+		fail("could not parse to lsn: %v", err)
+	}
+
+	if msgFilter.fromTime, err = parseTime(*fromTime); err != nil {
+		fail("could not parse from time: %v", err)
+	}
+
+	if msgFilter.toTime, err = parseTime(*toTime); err != nil {
+		fail("could not parse to time: %v", err)
+	}
+
+	keyring, err = encryptionKeys.Keyring()
+	if err != nil {
+		fail("could not load encryption keys: %v", err)
+	}
 }
 
-func dumpFile(filepath string) {
-	d := deltas.New("", false)
+// dumpFile prints the messages of the file, tx is the transaction continued from the previous file
+func dumpFile(filepath string, tx *transaction, st *stats, rels *relations) {
+	if err := rels.loadBasebackupInfo(filepath); err != nil {
+		fmt.Fprintf(os.Stderr, "could not load basebackup info: %v\n", err)
+	}
+
+	d := deltas.New("", false, compression.Config{}, keyring)
 	if err := d.Load(filepath); err != nil {
-		fmt.Fprintf(os.Stderr, "could not load file: %v\n", err)
-		os.Exit(1)
+		fail("could not load file: %v", err)
+	}
+	defer func() {
+		if err := d.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "could not close file: %v\n", err)
+		}
+	}()
+
+	if *showHeader {
+		if err := printHeader(os.Stdout, *format, filepath, d.Header()); err != nil {
+			fail("could not print header: %v", err)
+		}
+	}
+
+	if !*showMessages && !*showStats {
+		return
 	}
 
 	for {
 		msg, err := d.GetMessage()
 		if err == io.EOF {
 			break
+		} else if err != nil {
+			fail("could not read message: %v", err)
 		}
 
-		msgType := msg.MsgType().String()
-		fmt.Printf("%-10s %s\n", msgType+":", msg.String())
-	}
+		if begin, ok := msg.(message.Begin); ok {
+			*tx = transaction{lsn: begin.FinalLSN, xid: begin.XID, time: begin.Timestamp}
+		}
+		rels.update(msg)
+
+		if !msgFilter.match(msg, *tx) {
+			continue
+		}
+
+		if *showStats {
+			st.add(msg, *tx)
+		}
 
-	if err := d.Close(); err != nil {
-		fmt.Fprintf(os.Stderr, "could not close file: %v\n", err)
+		if *showMessages {
+			if err := printMessage(os.Stdout, *format, *sqlMode, filepath, msg, *tx, rels); err != nil {
+				fail("could not print message: %v", err)
+			}
+		}
 	}
 }
 
 func main() {
+	tx := &transaction{}
+	st := newStats()
+	rels := newRelations()
+
 	for _, filePath := range filePaths {
-		dumpFile(filePath)
+		dumpFile(filePath, tx, st, rels)
+	}
+
+	if *showStats {
+		if err := printStats(os.Stdout, *format, st); err != nil {
+			fail("could not print stats: %v", err)
+		}
 	}
 }
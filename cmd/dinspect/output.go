@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/deltas"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// record is the json representation of the message
+type record struct {
+	File        string        `json:"file"`
+	Type        string        `json:"type"`
+	LSN         dbutils.LSN   `json:"lsn,omitempty"` // final lsn of the transaction
+	XID         int32         `json:"xid,omitempty"`
+	Time        *time.Time    `json:"time,omitempty"` // commit timestamp of the transaction
+	RelationOID []dbutils.OID `json:"relationOID,omitempty"`
+	Table       string        `json:"table,omitempty"`
+	NewValues   columns       `json:"newValues,omitempty"`
+	OldValues   columns       `json:"oldValues,omitempty"`
+	Key         columns       `json:"key,omitempty"`
+	Message     string        `json:"message"`
+	SQL         string        `json:"sql,omitempty"`
+}
+
+// columns are the values of the tuple by the column names
+type columns map[string]interface{}
+
+// headerRecord is the json representation of the delta file header
+type headerRecord struct {
+	File         string      `json:"file"`
+	Version      uint8       `json:"version"`
+	Compression  string      `json:"compression"`
+	Encrypted    bool        `json:"encrypted"`
+	Checksum     string      `json:"checksum"`
+	MinLSN       dbutils.LSN `json:"minLSN"`
+	MaxLSN       dbutils.LSN `json:"maxLSN"`
+	MinTime      time.Time   `json:"minTime"`
+	MaxTime      time.Time   `json:"maxTime"`
+	MessageCount uint32      `json:"messageCount"`
+}
+
+// txStats is the number of the messages of the transaction
+type txStats struct {
+	LSN      dbutils.LSN `json:"lsn"`
+	XID      int32       `json:"xid"`
+	Messages int         `json:"messages"`
+}
+
+// stats summarizes the printed messages
+type stats struct {
+	Messages     int            `json:"messages"`
+	Types        map[string]int `json:"types"`
+	Transactions []*txStats     `json:"transactions"`
+
+	byLSN map[dbutils.LSN]*txStats
+}
+
+func newStats() *stats {
+	return &stats{
+		Types:        make(map[string]int),
+		Transactions: make([]*txStats, 0),
+		byLSN:        make(map[dbutils.LSN]*txStats),
+	}
+}
+
+func (s *stats) add(msg message.Message, tx transaction) {
+	s.Messages++
+	s.Types[msg.MsgType().String()]++
+
+	// transactions split between the files share the final lsn
+	t, ok := s.byLSN[tx.lsn]
+	if !ok {
+		t = &txStats{LSN: tx.lsn, XID: tx.xid}
+		s.byLSN[tx.lsn] = t
+		s.Transactions = append(s.Transactions, t)
+	}
+	t.Messages++
+}
+
+func printHeader(w io.Writer, format string, filename string, h deltas.Header) error {
+	rec := headerRecord{
+		File:         filename,
+		Version:      h.Version,
+		Compression:  string(h.Compression),
+		Encrypted:    h.Encrypted,
+		Checksum:     "none",
+		MinLSN:       h.MinLSN,
+		MaxLSN:       h.MaxLSN,
+		MinTime:      h.MinTime,
+		MaxTime:      h.MaxTime,
+		MessageCount: h.MessageCount,
+	}
+
+	if h.HasChecksum() {
+		rec.Checksum = fmt.Sprintf("%08x", h.Checksum)
+	}
+
+	if format == formatJSON {
+		return json.NewEncoder(w).Encode(map[string]headerRecord{"header": rec})
+	}
+
+	_, err := fmt.Fprintf(w, "%-12s %s\n%-12s %d\n%-12s %s\n%-12s %t\n%-12s %s\n%-12s %s - %s\n%-12s %s - %s\n%-12s %d\n",
+		"file:", rec.File,
+		"version:", rec.Version,
+		"compression:", rec.Compression,
+		"encrypted:", rec.Encrypted,
+		"checksum:", rec.Checksum,
+		"lsn:", rec.MinLSN, rec.MaxLSN,
+		"time:", rec.MinTime.Format(time.RFC3339), rec.MaxTime.Format(time.RFC3339),
+		"messages:", rec.MessageCount)
+
+	return err
+}
+
+func printMessage(w io.Writer, format string, sqlMode bool, filename string, msg message.Message, tx transaction,
+	rels *relations) error {
+	if format == formatText {
+		var err error
+
+		if sqlMode {
+			_, err = fmt.Fprintln(w, rels.sql(msg))
+		} else {
+			_, err = fmt.Fprintf(w, "%-*s %s\n", columnWidth, msg.MsgType().String()+":", rels.describe(msg))
+		}
+
+		return err
+	}
+
+	rec := record{
+		File:        filename,
+		Type:        msg.MsgType().String(),
+		LSN:         tx.lsn,
+		XID:         tx.xid,
+		RelationOID: relationOIDs(msg),
+		Message:     rels.describe(msg),
+	}
+	if !tx.time.IsZero() {
+		rec.Time = &tx.time
+	}
+	if sqlMode {
+		rec.SQL = rels.sql(msg)
+	}
+
+	switch v := msg.(type) {
+	case message.Insert:
+		if rel, ok := rels.get(v.RelationOID, v.NewRow); ok {
+			rec.Table = rel.NamespacedName.String()
+			rec.NewValues = columnMap(rel, v.NewRow, false)
+		}
+	case message.Update:
+		if rel, ok := rels.get(v.RelationOID, v.NewRow, v.Ident); ok {
+			rec.Table = rel.NamespacedName.String()
+			rec.NewValues = columnMap(rel, v.NewRow, false)
+			rec.setIdent(rel, v.Ident, v.IdentIsKey)
+		}
+	case message.Delete:
+		if rel, ok := rels.get(v.RelationOID, v.Ident); ok {
+			rec.Table = rel.NamespacedName.String()
+			rec.setIdent(rel, v.Ident, v.IdentIsKey)
+		}
+	}
+
+	return json.NewEncoder(w).Encode(rec)
+}
+
+func (rec *record) setIdent(rel message.Relation, ident []message.TupleData, identIsKey bool) {
+	if identIsKey {
+		rec.Key = columnMap(rel, ident, true)
+	} else {
+		rec.OldValues = columnMap(rel, ident, false)
+	}
+}
+
+func printStats(w io.Writer, format string, s *stats) error {
+	if format == formatJSON {
+		return json.NewEncoder(w).Encode(map[string]*stats{"stats": s})
+	}
+
+	fmt.Fprintf(w, "messages: %d, transactions: %d\n", s.Messages, len(s.Transactions))
+
+	types := make([]string, 0, len(s.Types))
+	for t := range s.Types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Fprintf(w, "  %-10s %d\n", t+":", s.Types[t])
+	}
+
+	for _, t := range s.Transactions {
+		fmt.Fprintf(w, "  xid:%d lsn:%s messages:%d\n", t.XID, t.LSN, t.Messages)
+	}
+
+	return nil
+}
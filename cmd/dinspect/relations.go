@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mkabilov/logical_backup/pkg/basebackup/generations"
+	"github.com/mkabilov/logical_backup/pkg/deltas"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+// relations keeps the structure of the tables the messages refer to
+type relations struct {
+	byOID     map[dbutils.OID]message.Relation
+	tableDirs map[string]struct{} // table directories the basebackup info was looked up in
+}
+
+func newRelations() *relations {
+	return &relations{
+		byOID:     make(map[dbutils.OID]message.Relation),
+		tableDirs: make(map[string]struct{}),
+	}
+}
+
+// loadBasebackupInfo takes the relation from the basebackup info of the generation the delta file belongs to, if the
+// file is in the deltas directory of the table. The relation messages seen before take precedence.
+func (r *relations) loadBasebackupInfo(deltaFilepath string) error {
+	deltaDir := filepath.Dir(deltaFilepath)
+	if filepath.Base(deltaDir) != deltas.DirName {
+		return nil
+	}
+
+	tableDir := filepath.Dir(deltaDir)
+	if _, ok := r.tableDirs[tableDir]; ok {
+		return nil
+	}
+	r.tableDirs[tableDir] = struct{}{}
+
+	archive := storage.NewLocal(tableDir, false)
+	gens, err := generations.List(archive, ".")
+	if err != nil {
+		return err
+	}
+
+	lsn, err := utils.GetLSNFromDeltaFilename(filepath.Base(deltaFilepath))
+	if err != nil {
+		lsn = dbutils.InvalidLSN
+	}
+
+	gen, ok := generations.Covering(gens, lsn)
+	if !ok {
+		if len(gens) == 0 {
+			return nil
+		}
+		gen = gens[0] // the file precedes the oldest basebackup kept
+	}
+
+	info, err := gen.LoadInfo(archive)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := r.byOID[info.Relation.OID]; !ok && info.Relation.OID != dbutils.InvalidOID {
+		r.byOID[info.Relation.OID] = info.Relation
+	}
+
+	return nil
+}
+
+// update follows the relation messages of the stream
+func (r *relations) update(msg message.Message) {
+	if rel, ok := msg.(message.Relation); ok {
+		r.byOID[rel.OID] = rel
+	}
+}
+
+// get returns the relation if its columns match the tuple
+func (r *relations) get(oid dbutils.OID, tuples ...[]message.TupleData) (message.Relation, bool) {
+	rel, ok := r.byOID[oid]
+	if !ok {
+		return rel, false
+	}
+
+	for _, tuple := range tuples {
+		if tuple != nil && len(tuple) != len(rel.Columns) {
+			return rel, false
+		}
+	}
+
+	return rel, true
+}
+
+// columnValues returns the values of the tuple as col=value pairs, only the key columns if keyOnly is set
+func columnValues(rel message.Relation, tuple []message.TupleData, keyOnly bool) string {
+	values := make([]string, 0, len(tuple))
+	for i, col := range rel.Columns {
+		if keyOnly && !col.IsKey {
+			continue
+		}
+
+		values = append(values, fmt.Sprintf("%s=%s", col.Name, tuple[i]))
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// columnMap returns the values of the tuple by the column names, null values are nil, unchanged values are omitted
+func columnMap(rel message.Relation, tuple []message.TupleData, keyOnly bool) columns {
+	if tuple == nil {
+		return nil
+	}
+
+	values := make(columns, len(tuple))
+	for i, col := range rel.Columns {
+		if keyOnly && !col.IsKey {
+			continue
+		}
+
+		switch tuple[i].Kind {
+		case message.TupleText:
+			values[col.Name] = string(tuple[i].Value)
+		case message.TupleNull:
+			values[col.Name] = nil
+		}
+	}
+
+	return values
+}
+
+// identLabel returns the label of the old values of the update or delete message
+func identLabel(identIsKey bool) string {
+	if identIsKey {
+		return "key"
+	}
+
+	return "oldValues"
+}
+
+// describe returns the message with the tuples printed as col=value pairs, or the message as is if the relation is
+// not known
+func (r *relations) describe(msg message.Message) string {
+	switch v := msg.(type) {
+	case message.Insert:
+		if rel, ok := r.get(v.RelationOID, v.NewRow); ok {
+			return fmt.Sprintf("%s newValues: [%s]", rel.NamespacedName, columnValues(rel, v.NewRow, false))
+		}
+	case message.Update:
+		if rel, ok := r.get(v.RelationOID, v.NewRow, v.Ident); ok {
+			str := fmt.Sprintf("%s newValues: [%s]", rel.NamespacedName, columnValues(rel, v.NewRow, false))
+			if v.Ident != nil {
+				str += fmt.Sprintf(" %s: [%s]", identLabel(v.IdentIsKey), columnValues(rel, v.Ident, v.IdentIsKey))
+			}
+
+			return str
+		}
+	case message.Delete:
+		if rel, ok := r.get(v.RelationOID, v.Ident); ok {
+			return fmt.Sprintf("%s %s: [%s]",
+				rel.NamespacedName, identLabel(v.IdentIsKey), columnValues(rel, v.Ident, v.IdentIsKey))
+		}
+	}
+
+	return msg.String()
+}
+
+// sql returns the statement applying the message, or the message as the sql comment if it has no statement
+func (r *relations) sql(msg message.Message) string {
+	switch v := msg.(type) {
+	case message.Begin:
+		return "begin;"
+	case message.Commit:
+		return "commit;"
+	case message.Insert:
+		if rel, ok := r.get(v.RelationOID, v.NewRow); ok {
+			return v.SQL(rel)
+		}
+	case message.Update:
+		if rel, ok := r.get(v.RelationOID, v.NewRow, v.Ident); ok {
+			return v.SQL(rel)
+		}
+	case message.Delete:
+		if rel, ok := r.get(v.RelationOID, v.Ident); ok {
+			return v.SQL(rel)
+		}
+	}
+
+	return fmt.Sprintf("-- %s: %s", msg.MsgType(), msg.String())
+}
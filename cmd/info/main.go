@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/catalog"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
+)
+
+const timeFormat = "2006-01-02 15:04:05"
+
+var (
+	backupDir   *string
+	tableName   *string
+	format      *string
+	fromCatalog *bool
+
+	encryptionKeys encryption.KeyFlags
+
+	s3Endpoint  *string
+	s3Region    *string
+	s3PathStyle *bool
+
+	Version  = "devel"
+	Revision = "devel"
+
+	GoVersion = runtime.Version()
+)
+
+// tableInfo is the backup status of the table
+type tableInfo struct {
+	OID         dbutils.OID `json:"oid"`
+	Names       []string    `json:"names"`
+	Generations int         `json:"generations"`
+
+	BasebackupTime time.Time   `json:"basebackupTime"`
+	BasebackupLSN  dbutils.LSN `json:"basebackupLSN"`
+	BasebackupSize int64       `json:"basebackupSize"`
+
+	DeltaCount int   `json:"deltaCount"`
+	DeltaSize  int64 `json:"deltaSize"`
+
+	// range of the lsns and commit times the table can be restored to
+	FirstLSN  dbutils.LSN `json:"firstLSN"`
+	LastLSN   dbutils.LSN `json:"lastLSN"`
+	FirstTime time.Time   `json:"firstTime"`
+	LastTime  time.Time   `json:"lastTime"`
+
+	State catalog.State `json:"state"`
+}
+
+func buildInfo() string {
+	return fmt.Sprintf("logical backup info tool %s git revision %s go version %s", Version, Revision, GoVersion)
+}
+
+func init() {
+	backupDir = flag.String("backup-dir", "", "Backups dir or s3://bucket/prefix url")
+	tableName = flag.String("table", "", "Show only the tables which ever had the name, i.e. public.foo")
+	format = flag.String("format", "table", "Output format: table or json")
+	fromCatalog = flag.Bool("catalog", false, "Read the catalog file instead of scanning the archive")
+	flag.Var(&encryptionKeys, "encryption-key",
+		"Key to decrypt the backup with, as id:/path/to/file or id:$ENV_VARIABLE (can be repeated)")
+
+	s3Endpoint = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3-compatible storage endpoint")
+	s3Region = flag.String("s3-region", "", "S3 region")
+	s3PathStyle = flag.Bool("s3-path-style", false, "Address the S3 bucket as the path, i.e. for MinIO")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n", buildInfo())
+		fmt.Fprintf(os.Stderr, "\nUsage:\n\t%s [options]\n\nOptions:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *backupDir == "" || (*format != "table" && *format != "json") {
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+func newTableInfo(t catalog.Table) tableInfo {
+	info := tableInfo{
+		OID:         t.OID,
+		Names:       make([]string, 0, len(t.Names)),
+		Generations: len(t.Basebackups),
+		DeltaCount:  len(t.Deltas),
+		State:       t.State,
+	}
+
+	for _, n := range t.Names {
+		info.Names = append(info.Names, n.Name.String())
+	}
+
+	if bb, ok := t.Basebackup(); ok {
+		info.BasebackupTime = bb.CreateDate
+		info.BasebackupLSN = bb.StartLSN
+		info.BasebackupSize = bb.Size
+	}
+
+	for _, d := range t.Deltas {
+		info.DeltaSize += d.Size
+	}
+
+	if len(t.Basebackups) == 0 {
+		return info
+	}
+
+	first := t.Basebackups[0]
+	info.FirstLSN, info.FirstTime = first.StartLSN, first.CreateDate
+	info.LastLSN, info.LastTime = info.BasebackupLSN, info.BasebackupTime
+	for _, d := range t.DeltasSince(t.Basebackups[len(t.Basebackups)-1].StartLSN) {
+		info.LastLSN, info.LastTime = d.MaxLSN, d.MaxTime
+	}
+
+	return info
+}
+
+func hasName(t catalog.Table, name string) bool {
+	for _, n := range t.Names {
+		if n.Name.String() == name || n.Name.Namespace+"."+n.Name.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Format(timeFormat)
+}
+
+func printTable(tables []tableInfo) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OID\tNAME\tGENERATIONS\tBASEBACKUP\tBASEBACKUP LSN\tDELTAS\tDELTA SIZE\tRESTORABLE FROM\tRESTORABLE TO\t"+
+		"MESSAGES SINCE BACKUP\tDELTAS SINCE BACKUP\tLAST MESSAGE")
+
+	for _, t := range tables {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\t%d\t%d\t%s\t%s\t%d\t%d\t%s\n",
+			t.OID, strings.Join(t.Names, ", "), t.Generations, formatTime(t.BasebackupTime), t.BasebackupLSN,
+			t.DeltaCount, t.DeltaSize,
+			fmt.Sprintf("%s (%s)", t.FirstLSN, formatTime(t.FirstTime)),
+			fmt.Sprintf("%s (%s)", t.LastLSN, formatTime(t.LastTime)),
+			t.State.MessagesSinceBackupCount, t.State.DeltasSinceBackupCount, formatTime(t.State.LastProcessedMessage))
+	}
+
+	w.Flush()
+}
+
+func main() {
+	keyring, err := encryptionKeys.Keyring()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load encryption keys: %v\n", err)
+		os.Exit(1)
+	}
+
+	// credentials are taken from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+	archive, err := storage.NewFromLocation(*backupDir, storage.S3Config{
+		Endpoint:  *s3Endpoint,
+		Region:    *s3Region,
+		PathStyle: *s3PathStyle,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not init backup storage: %v\n", err)
+		os.Exit(1)
+	}
+
+	cat := catalog.New(archive, keyring)
+	if *fromCatalog {
+		err = cat.Load()
+	} else {
+		err = cat.Scan()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read the archive: %v\n", err)
+		os.Exit(1)
+	}
+
+	tables := make([]tableInfo, 0)
+	for _, t := range cat.Tables() {
+		if *tableName != "" && !hasName(t, *tableName) {
+			continue
+		}
+
+		tables = append(tables, newTableInfo(t))
+	}
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(tables); err != nil {
+			fmt.Fprintf(os.Stderr, "could not encode output: %v\n", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	printTable(tables)
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"flag"
 	"log"
+	"log/slog"
 	"os"
 
 	"github.com/jackc/pgx"
 
 	"github.com/mkabilov/logical_backup/pkg/logicalrestore"
 	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
 )
 
 var (
@@ -24,6 +28,15 @@ var (
 	tableName   *string
 	schemaName  *string
 	truncate    *bool
+	createTable *bool
+	jobs        *int
+	targetLSN   *string
+
+	encryptionKeys encryption.KeyFlags
+
+	s3Endpoint  *string
+	s3Region    *string
+	s3PathStyle *bool
 )
 
 func init() {
@@ -37,8 +50,17 @@ func init() {
 	tableName = flag.String("table", "", "Source table name")
 	schemaName = flag.String("schema", "public", "Schema name")
 	targetTable = flag.String("target-table", "", "Target table name (optional)")
-	backupDir = flag.String("backup-dir", "", "Backups dir")
+	backupDir = flag.String("backup-dir", "", "Backups dir or s3://bucket/prefix url")
 	truncate = flag.Bool("truncate", false, "Truncate table before restoring")
+	createTable = flag.Bool("create-table", false, "Create the table from the backed up definition if it does not exist")
+	jobs = flag.Int("jobs", 1, "Number of parallel jobs loading the basebackup chunks")
+	targetLSN = flag.String("target-lsn", "", "Restore the table as of the lsn, i.e. 0/16B3748 (latest by default)")
+	flag.Var(&encryptionKeys, "encryption-key",
+		"Key to decrypt the backup with, as id:/path/to/file or id:$ENV_VARIABLE (can be repeated)")
+
+	s3Endpoint = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3-compatible storage endpoint")
+	s3Region = flag.String("s3-region", "", "S3 region")
+	s3PathStyle = flag.Bool("s3-path-style", false, "Address the S3 bucket as the path, i.e. for MinIO")
 
 	flag.Parse()
 
@@ -50,7 +72,7 @@ func init() {
 
 func main() {
 	if *targetTable != "" {
-		log.Printf("restoring into %v", targetTable)
+		slog.Info("restoring into another table", "table", *targetTable)
 	}
 
 	config := pgx.ConnConfig{
@@ -67,8 +89,30 @@ func main() {
 		config = config.Merge(envConfig)
 	}
 
+	lsn := dbutils.InvalidLSN
+	if *targetLSN != "" {
+		if err := lsn.Parse(*targetLSN); err != nil {
+			log.Fatalf("could not parse target lsn: %v", err)
+		}
+	}
+
+	keyring, err := encryptionKeys.Keyring()
+	if err != nil {
+		log.Fatalf("could not load encryption keys: %v", err)
+	}
+
+	// credentials are taken from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+	archive, err := storage.NewFromLocation(*backupDir, storage.S3Config{
+		Endpoint:  *s3Endpoint,
+		Region:    *s3Region,
+		PathStyle: *s3PathStyle,
+	})
+	if err != nil {
+		log.Fatalf("could not init backup storage: %v", err)
+	}
+
 	tbl := message.NamespacedName{Namespace: *schemaName, Name: *tableName}
-	r := logicalrestore.New(context.Background(), tbl, *backupDir, *truncate, config)
+	r := logicalrestore.New(context.Background(), tbl, archive, lsn, *truncate, *createTable, *jobs, keyring, config)
 
 	if err := r.Restore(); err != nil {
 		log.Fatalf("could not restore table: %v", err)
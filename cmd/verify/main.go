@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/mkabilov/logical_backup/pkg/logicalbackup"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
+	"github.com/mkabilov/logical_backup/pkg/utils/namehistory"
+	"github.com/mkabilov/logical_backup/pkg/verify"
+)
+
+const (
+	exitProblems = 1
+	exitFailure  = 2
+)
+
+var (
+	backupDir *string
+	tableName *string
+
+	encryptionKeys encryption.KeyFlags
+
+	s3Endpoint  *string
+	s3Region    *string
+	s3PathStyle *bool
+
+	Version  = "devel"
+	Revision = "devel"
+
+	GoVersion = runtime.Version()
+)
+
+func buildInfo() string {
+	return fmt.Sprintf("logical backup verify tool %s git revision %s go version %s", Version, Revision, GoVersion)
+}
+
+func init() {
+	backupDir = flag.String("backup-dir", "", "Backups dir or s3://bucket/prefix url")
+	tableName = flag.String("table", "", "Verify only the table with the name, i.e. public.foo")
+	flag.Var(&encryptionKeys, "encryption-key",
+		"Key to decrypt the backup with, as id:/path/to/file or id:$ENV_VARIABLE (can be repeated)")
+
+	s3Endpoint = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3-compatible storage endpoint")
+	s3Region = flag.String("s3-region", "", "S3 region")
+	s3PathStyle = flag.Bool("s3-path-style", false, "Address the S3 bucket as the path, i.e. for MinIO")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s\n", buildInfo())
+		fmt.Fprintf(os.Stderr, "\nUsage:\n\t%s [options]\n\nExits with %d if the archive is damaged.\n\nOptions:\n",
+			os.Args[0], exitProblems)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *backupDir == "" {
+		flag.Usage()
+		os.Exit(exitFailure)
+	}
+}
+
+func fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(exitFailure)
+}
+
+func main() {
+	keyring, err := encryptionKeys.Keyring()
+	if err != nil {
+		fail("could not load encryption keys: %v", err)
+	}
+
+	// credentials are taken from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+	archive, err := storage.NewFromLocation(*backupDir, storage.S3Config{
+		Endpoint:  *s3Endpoint,
+		Region:    *s3Region,
+		PathStyle: *s3PathStyle,
+	})
+	if err != nil {
+		fail("could not init backup storage: %v", err)
+	}
+
+	oids := make([]dbutils.OID, 0)
+	if *tableName != "" {
+		tbl := message.NamespacedName{Namespace: "public", Name: *tableName}
+		if parts := strings.SplitN(*tableName, ".", 2); len(parts) == 2 {
+			tbl = message.NamespacedName{Namespace: parts[0], Name: parts[1]}
+		}
+
+		names := namehistory.New(archive, logicalbackup.OidNameMapFile, keyring)
+		if err := names.Load(); err != nil {
+			fail("could not load table names: %v", err)
+		}
+
+		oid, _ := names.GetOID(tbl, dbutils.InvalidLSN)
+		if oid == dbutils.InvalidOID {
+			fail("could not find table %s", tbl)
+		}
+		oids = append(oids, oid)
+	}
+
+	report, err := verify.Verify(archive, keyring, oids...)
+	if err != nil {
+		fail("could not verify archive: %v", err)
+	}
+
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+
+	fmt.Printf("verified %d tables, %d delta files, %d messages: %d problems found\n",
+		report.Tables, report.DeltaFiles, report.Messages, len(report.Problems))
+
+	if len(report.Problems) > 0 {
+		os.Exit(exitProblems)
+	}
+}
@@ -3,14 +3,16 @@ package archiver
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 	"sync"
 	"time"
 
-	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/prometheus"
+	"github.com/mkabilov/logical_backup/pkg/storage"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
 	"github.com/mkabilov/logical_backup/pkg/utils/queue"
 )
 
@@ -30,35 +32,61 @@ type Archiver interface {
 	QueueFile(string)
 	QueueDeltaFile(string, dbutils.LSN)
 	SetBasebackupLSN(minLSN dbutils.LSN)
+	Status() Status
 	Run()
 	Wait()
 }
 
+// Table is the table the archived files belong to
+type Table interface {
+	OID() dbutils.OID
+	String() string
+	Archived(filename string) // called once the file is stored in the archive
+}
+
+// Status describes the progress of the archiver
+type Status struct {
+	Queued        int       `json:"queued"`              // files waiting to be archived
+	PendingSince  time.Time `json:"pendingSince"`        // since when the archiver has had work without making progress, zero if idle
+	LastArchived  time.Time `json:"lastArchived"`        // time the last file was archived
+	LastError     string    `json:"lastError,omitempty"` // error of the last failed file
+	LastErrorTime time.Time `json:"lastErrorTime"`       // time of the last failure
+}
+
 type archive struct {
 	wg    sync.WaitGroup
 	ctx   context.Context
 	queue *queue.Queue
-	fsync bool
 
 	basebackupLSN dbutils.LSN
 
+	statusMu sync.Mutex
+	status   Status
+
 	tableSourceDir      string
-	tableDestinationDir string
+	storage             storage.Storage
+	tableDestinationDir string // table directory within the storage
+
+	table Table
+	prom  promexporter.PromInterface
 }
 
-// New instantiate archiver
-func New(ctx context.Context, tableSourceDir, tableDestinationDir string, fsync bool) *archive {
-	if tableSourceDir == "" || tableDestinationDir == "" || tableDestinationDir == tableSourceDir {
-		panic("source and destination dirs must be set and different")
+// New instantiate archiver moving the files from the local source dir to the destination dir of the storage
+func New(ctx context.Context, tableSourceDir string, storage storage.Storage, tableDestinationDir string, table Table,
+	prom promexporter.PromInterface) *archive {
+	if tableSourceDir == "" || tableDestinationDir == "" {
+		panic("source and destination dirs must be set")
 	}
 
 	return &archive{
 		queue:               queue.New(ctx),
-		fsync:               fsync,
 		ctx:                 ctx,
 		tableSourceDir:      tableSourceDir,
+		storage:             storage,
 		tableDestinationDir: tableDestinationDir,
 		basebackupLSN:       dbutils.InvalidLSN,
+		table:               table,
+		prom:                prom,
 	}
 }
 
@@ -71,13 +99,72 @@ func (a *archive) Run() {
 
 // QueueFile puts the file into the queue
 func (a *archive) QueueFile(filepath string) {
+	a.queued()
 	a.queue.Put(file(filepath))
+	a.updateQueueMetrics()
 }
 
 // QueueDeltaFile puts the delta file into the queue
 // filepath is relative to the table directory
 func (a *archive) QueueDeltaFile(filepath string, lsn dbutils.LSN) {
+	a.queued()
 	a.queue.Put(deltaFile{filename: filepath, lsn: lsn})
+	a.updateQueueMetrics()
+}
+
+// Status returns the progress of the archiver
+func (a *archive) Status() Status {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+
+	s := a.status
+	s.Queued = a.queue.Size()
+
+	return s
+}
+
+func (a *archive) queued() {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+
+	if a.status.PendingSince.IsZero() {
+		a.status.PendingSince = time.Now()
+	}
+}
+
+// done records the outcome of archiving the file, failures keep the archiver pending until some file succeeds
+func (a *archive) done(err error) {
+	a.updateQueueMetrics()
+
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+
+	now := time.Now()
+	if err != nil {
+		a.status.LastError = err.Error()
+		a.status.LastErrorTime = now
+		return
+	}
+
+	a.status.LastArchived = now
+	if a.queue.IsEmpty() {
+		a.status.PendingSince = time.Time{}
+	} else {
+		a.status.PendingSince = now
+	}
+}
+
+// log returns the logger with the fields of the table
+func (a *archive) log() *slog.Logger {
+	return logger.Table(a.table.OID(), a.table)
+}
+
+func (a *archive) updateQueueMetrics() {
+	err := a.prom.Set(promexporter.PerTableArchiverQueueGauge, float64(a.queue.Size()),
+		[]string{a.table.OID().String(), a.table.String()})
+	if err != nil {
+		a.log().Warn("could not set metric", "metric", promexporter.PerTableArchiverQueueGauge, "error", err)
+	}
 }
 
 // SetBasebackupLSN sets the minimum lsn
@@ -100,29 +187,36 @@ func (a *archive) run() {
 				} else if err == context.Canceled {
 					return
 				} else if err != nil {
-					log.Fatalf("unhandled queue error: %v", err)
+					a.log().Error("unhandled queue error", "error", err)
+					os.Exit(1)
 				}
 
 				switch v := obj.(type) {
 				case file:
-					if err := a.archiveFile(string(v), false); err != nil {
-						log.Printf("could not archive basebackup file %s: %v", v, err)
+					err := a.archiveFile(string(v))
+					a.done(err)
+					if err != nil {
+						a.log().Error("could not archive basebackup file", "file", v, "error", err)
 						continue
 					}
+					a.table.Archived(string(v))
 				case deltaFile:
 					if a.basebackupLSN.IsValid() {
 						if v.lsn < a.basebackupLSN {
 							if err := os.Remove(path.Join(a.tableSourceDir, v.filename)); err != nil {
-								log.Printf("could not delete old file: %v", err)
+								a.log().Warn("could not delete old file", "error", err)
 							}
 
-							log.Printf("skipping files prior to basebackup %s", v.filename)
+							a.log().Debug("skipping file prior to basebackup", "file", v.filename, logger.LSN, v.lsn)
+							a.done(nil)
 							continue
 						}
 					}
 
-					if err := a.archiveFile(v.filename, false); err != nil {
-						log.Printf("could not archive delta file %s: %v", v.filename, err)
+					err := a.archiveFile(v.filename)
+					a.done(err)
+					if err != nil {
+						a.log().Error("could not archive delta file", "file", v.filename, "error", err)
 						continue
 					}
 				}
@@ -136,60 +230,39 @@ func (a *archive) Wait() {
 	a.wg.Wait()
 }
 
-func (a *archive) archiveFile(filename string, checkIfDstFileExists bool) error {
+func (a *archive) archiveFile(filename string) error {
 	srcFile := path.Join(a.tableSourceDir, filename)
 	dstFile := path.Join(a.tableDestinationDir, filename)
 
-	if _, err := os.Stat(srcFile); os.IsNotExist(err) {
-		log.Printf("source file doesn't exist: %q; skipping", srcFile)
+	fp, err := os.Open(srcFile)
+	if os.IsNotExist(err) {
+		a.log().Warn("source file doesn't exist; skipping", "file", srcFile)
 		return nil
 	} else if err != nil {
-		return fmt.Errorf("could not stat source file %q: %v", srcFile, err)
+		return fmt.Errorf("could not open source file %q: %v", srcFile, err)
 	}
+	defer fp.Close()
 
-	if st, err := os.Stat(dstFile); !os.IsNotExist(err) {
-		if err != nil {
-			return fmt.Errorf("could not stat destination file %q: %s", dstFile, err)
-		}
-
-		if checkIfDstFileExists {
-			if st.Size() == 0 {
-				if err := os.Remove(dstFile); err != nil {
-					return fmt.Errorf("could not delete empty dst file: %v", err)
-				}
-			} else {
-				return fmt.Errorf("destination file %q is not empty", dstFile)
-			}
-		}
+	srcFInfo, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat source file: %v", err)
 	}
 
-	if _, err := utils.CopyFile(srcFile, dstFile, a.fsync); err != nil {
-		os.Remove(dstFile)
+	// the storage fails if it gets less or more bytes than the size of the source file
+	start := time.Now()
+	if err := a.storage.Put(dstFile, fp, srcFInfo.Size()); err != nil {
 		return fmt.Errorf("could not move %s -> %s file: %v", srcFile, dstFile, err)
 	}
 
-	srcFInfo, srcErr := os.Stat(srcFile)
-	if srcErr != nil {
-		os.Remove(dstFile)
-		return fmt.Errorf("could not stat source file: %v", srcErr)
-	}
-
-	dstFInfo, dstErr := os.Stat(dstFile)
-	if dstErr != nil {
-		os.Remove(dstFile)
-		return fmt.Errorf("could not stat destination file: %v", dstErr)
-	}
-
-	if sSize, dSize := srcFInfo.Size(), dstFInfo.Size(); sSize != dSize {
-		os.Remove(dstFile)
-		return fmt.Errorf("source(%v) and destionation(%v) file size do not match", sSize, dSize)
+	if err := a.prom.Observe(promexporter.ArchiveCopyDurationHistogram, time.Since(start).Seconds(), nil); err != nil {
+		a.log().Warn("could not observe metric", "metric", promexporter.ArchiveCopyDurationHistogram, "error", err)
 	}
 
 	if err := os.Remove(srcFile); err != nil {
-		log.Printf("could not delete old file: %v", err)
+		a.log().Warn("could not delete old file", "error", err)
 	}
 
-	log.Printf("successfully archived %s", dstFile)
+	a.log().Debug("successfully archived", "file", dstFile)
 
 	return nil
 }
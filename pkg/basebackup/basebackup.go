@@ -3,19 +3,29 @@ package basebackup
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"sync"
 	"time"
 
+	"github.com/mkabilov/logical_backup/pkg/basebackup/bbqueue"
 	"github.com/mkabilov/logical_backup/pkg/basebackup/bbtable"
+	"github.com/mkabilov/logical_backup/pkg/basebackup/throttle"
+	"github.com/mkabilov/logical_backup/pkg/catalog"
 	"github.com/mkabilov/logical_backup/pkg/config"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/prometheus"
 	"github.com/mkabilov/logical_backup/pkg/tablebackup"
-	"github.com/mkabilov/logical_backup/pkg/utils/queue"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
 	"github.com/mkabilov/logical_backup/pkg/utils/tablesmap"
 )
 
 const (
 	sleepBetweenBackups = time.Second * 3
+
+	// how often the cron expressions and the windows of the queued tables are checked
+	scheduleInterval = 30 * time.Second
 )
 
 // Basebackuper represents interface for creating base backups,
@@ -24,6 +34,17 @@ type Basebackuper interface {
 	Run(int)
 	Wait()
 	QueueTable(tablebackup.TableBackuper)
+	Queued() []QueuedTable
+	Expedite(dbutils.OID) bool
+	SetPriority(dbutils.OID, int) bool
+	InProgress() map[dbutils.OID]time.Time
+	Failures() (int, error)
+}
+
+// QueuedTable describes the table waiting for the basebackup
+type QueuedTable struct {
+	bbqueue.Item
+	Deferred bool // waits for the window of the table to open
 }
 
 type basebackup struct {
@@ -31,58 +52,70 @@ type basebackup struct {
 	wg  *sync.WaitGroup
 
 	cfg          *config.Config
-	queue        *queue.Queue
+	queue        *bbqueue.Queue
 	backupTables tablesmap.TablesMapInterface
-	inProgress   sync.Map
+	catalog      catalog.Interface // sizes and age of the basebackups and the deltas to order the queue by
+	prom         promexporter.PromInterface
+	limiter      *throttle.Limiter // shared by all the workers
+
+	failuresMu sync.Mutex
+	failures   int   // consecutive failed basebackups
+	lastError  error // error of the latest failed basebackup
 }
 
 // New instantiates basebackup,
 // we need to pass backupTables so that we can remove deleted tables from the backupTables
-func New(ctx context.Context, backupTables tablesmap.TablesMapInterface, cfg *config.Config) *basebackup {
-	b := basebackup{
+func New(ctx context.Context, backupTables tablesmap.TablesMapInterface, cat catalog.Interface, cfg *config.Config,
+	prom promexporter.PromInterface) *basebackup {
+	b := &basebackup{
 		ctx:          ctx,
 		cfg:          cfg,
 		wg:           &sync.WaitGroup{},
 		backupTables: backupTables,
-		queue:        queue.New(ctx),
+		catalog:      cat,
+		prom:         prom,
+		limiter:      throttle.NewLimiter(cfg.BasebackupThrottle.BytesPerSecond),
 	}
+	b.queue = bbqueue.New(ctx, b.ready, b.score)
 
-	return &b
+	return b
 }
 
 // Run starts background processes of the basebackuper
 func (b *basebackup) Run(cnt int) {
-	log.Printf("Starting %d background backupers", cnt)
+	slog.Info("starting background backupers", "count", cnt)
 	for i := 0; i < cnt; i++ {
 		b.wg.Add(1)
 		go b.worker(i)
 	}
+
+	if b.cfg.BasebackupSchedule.IsSet() {
+		b.wg.Add(1)
+		go b.scheduler()
+	}
 }
 
-func (b *basebackup) basebackupTable(table tablebackup.TableBackuper) error {
+func (b *basebackup) basebackupTable(workerID int, table tablebackup.TableBackuper,
+	workerLimiter *throttle.Limiter) error {
 	var bbTable bbtable.TableBasebackuper
 
-	if _, loaded := b.inProgress.LoadOrStore(table.OID(), struct{}{}); loaded {
-		log.Printf("Basebackup of the %s table is in progress by another process; skipping", table)
-		return nil
-	}
-	defer b.inProgress.Delete(table.OID())
-
+	log := logger.Table(table.OID(), table).With(logger.WorkerID, workerID)
 	if lbTime := table.LastBasebackupTime(); !lbTime.IsZero() && time.Since(lbTime) <= sleepBetweenBackups {
-		log.Printf("Base backups happening too often; skipping this one")
+		log.Info("base backups happening too often; skipping this one")
 		return nil
 	}
 
 	if table.MessagesProcessed() == 0 && !table.LastBasebackupTime().IsZero() {
-		log.Printf("No backup needed. no processed messages since last basebackup")
+		log.Info("no backup needed, no processed messages since last basebackup")
 		return nil
 	}
 
-	log.Printf("Starting base backup of %s", table)
-	bbTable = bbtable.New(b.cfg.DB, table)
+	log.Info("starting base backup")
+	bbTable = bbtable.New(b.ctx, b.cfg, table, log, b.limiter, workerLimiter)
 	if err := bbTable.Basebackup(); err != nil {
+		b.failed(bbtable.FailureReason(err))
 		if err == bbtable.ErrTableNotFound {
-			log.Printf("Table %s not found, skipping basebackup and removing from the list", table)
+			log.Warn("table not found, skipping basebackup and removing from the list")
 			b.backupTables.Delete(table.OID())
 			return nil
 		} else {
@@ -90,9 +123,11 @@ func (b *basebackup) basebackupTable(table tablebackup.TableBackuper) error {
 		}
 	}
 
-	if err := table.BasebackupDone(bbTable.DumpFilename(), bbTable.InfoFilename(), bbTable.Lsn()); err != nil {
+	if err := table.BasebackupDone(bbTable.DumpFilenames(), bbTable.InfoFilename(), bbTable.Info()); err != nil {
+		b.failed(bbtable.FailureOther)
 		return fmt.Errorf("could not process post basebackup operations: %v", err)
 	}
+	b.updateMetricsAfterBasebackup(table, bbTable.Info())
 
 	return nil
 }
@@ -104,22 +139,204 @@ func (b *basebackup) Wait() {
 
 // QueueTable queues the table for the base backups
 func (b *basebackup) QueueTable(t tablebackup.TableBackuper) {
-	b.queue.Put(t)
+	// the name is cached, the table might be renamed while it waits
+	name := t.Name()
+	item := bbqueue.Item{
+		Table:    t,
+		Name:     name,
+		Priority: b.cfg.BasebackupQueue.Priority(name),
+	}
+	b.queue.Put(item)
+
+	if !b.queue.Ready(item) {
+		logger.Table(t.OID(), t).Info("deferring basebackup until the window of the table opens")
+	}
+	b.updateQueueMetrics()
+}
+
+// score returns the urgency of the basebackup of the queued table according to the order of the queue, the tables with
+// no basebackup yet are the most urgent
+func (b *basebackup) score(item bbqueue.Item) float64 {
+	if b.cfg.BasebackupQueue.Order == bbqueue.OrderFIFO {
+		return 0
+	}
+
+	entry, ok := b.catalog.Table(item.Table.OID())
+	if !ok {
+		return math.MaxFloat64
+	}
+
+	bb, ok := entry.Basebackup()
+	if !ok {
+		return math.MaxFloat64
+	}
+
+	if b.cfg.BasebackupQueue.Order == bbqueue.OrderAge {
+		return time.Since(bb.CreateDate).Seconds()
+	}
+
+	var deltasSize int64
+	for _, d := range entry.DeltasSince(bb.StartLSN) {
+		deltasSize += d.Size
+	}
+
+	if bb.Size <= 0 {
+		return float64(deltasSize)
+	}
+
+	return float64(deltasSize) / float64(bb.Size)
+}
+
+// Queued returns the tables waiting for the basebackup in the order they are backed up
+func (b *basebackup) Queued() []QueuedTable {
+	items := b.queue.Items()
+
+	tables := make([]QueuedTable, 0, len(items))
+	for _, item := range items {
+		tables = append(tables, QueuedTable{Item: item, Deferred: !b.queue.Ready(item)})
+	}
+
+	return tables
+}
+
+// Expedite lets the basebackup of the queued table start first and outside of its windows, returns false if the
+// table is not queued
+func (b *basebackup) Expedite(oid dbutils.OID) bool {
+	if !b.queue.Expedite(oid) {
+		return false
+	}
+	b.updateQueueMetrics()
+
+	return true
+}
+
+// SetPriority changes the priority of the queued table, returns false if the table is not queued
+func (b *basebackup) SetPriority(oid dbutils.OID, priority int) bool {
+	return b.queue.SetPriority(oid, priority)
+}
+
+// ready returns true if the basebackup of the table may start now
+func (b *basebackup) ready(item bbqueue.Item) bool {
+	return b.cfg.BasebackupSchedule.Allowed(item.Name.String(), time.Now())
+}
+
+// scheduler queues the tables whose cron expression fired and lets the deferred tables go once their window opens
+func (b *basebackup) scheduler() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case now := <-ticker.C:
+			b.backupTables.Map(func(t tablebackup.TableBackuper) {
+				if b.cfg.BasebackupSchedule.Due(t.Name().String(), last, now) {
+					logger.Table(t.OID(), t).Info("queueing table for basebackup due to the schedule")
+					t.QueueBasebackup()
+				}
+			})
+			b.queue.Wake()
+			b.updateQueueMetrics()
+			last = now
+		}
+	}
+}
+
+// InProgress returns the start times of the basebackups in progress by the table oid
+func (b *basebackup) InProgress() map[dbutils.OID]time.Time {
+	return b.queue.InProgress()
+}
+
+// Failures returns the number of the basebackups failed in a row and the error of the latest one
+func (b *basebackup) Failures() (int, error) {
+	b.failuresMu.Lock()
+	defer b.failuresMu.Unlock()
+
+	return b.failures, b.lastError
+}
+
+func (b *basebackup) recordResult(err error) {
+	b.failuresMu.Lock()
+	defer b.failuresMu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.lastError = err
 }
 
 func (b *basebackup) worker(id int) {
 	defer b.wg.Done()
 
+	limiter := throttle.NewLimiter(b.cfg.BasebackupThrottle.BytesPerSecondPerWorker)
+
 	for {
-		obj, err := b.queue.Get()
+		item, err := b.queue.Get()
 		if err == context.Canceled {
-			log.Printf("Quiting background base backuper %d", id)
+			logger.Worker(id).Info("quitting background base backuper")
 			return
 		}
+		b.updateQueueMetrics()
 
-		t := obj.(tablebackup.TableBackuper)
-		if err := b.basebackupTable(t); err != nil {
-			log.Printf("Could not basebackup %s: %v", t, err)
+		t := item.Table.(tablebackup.TableBackuper)
+		err = b.basebackupTable(id, t, limiter)
+		b.queue.Done(t.OID())
+		b.updateQueueMetrics()
+
+		b.recordResult(err)
+		if err != nil {
+			logger.Table(t.OID(), t).Error("could not basebackup", logger.WorkerID, id, "reason",
+				bbtable.FailureReason(err), "error", err)
 		}
 	}
 }
+
+func (b *basebackup) updateQueueMetrics() {
+	deferred := 0
+	for _, t := range b.Queued() {
+		if t.Deferred {
+			deferred++
+		}
+	}
+
+	if err := b.prom.Set(promexporter.BasebackupQueueGauge, float64(b.queue.Size()-deferred), nil); err != nil {
+		slog.Warn("could not set metric", "metric", promexporter.BasebackupQueueGauge, "error", err)
+	}
+
+	if err := b.prom.Set(promexporter.BasebackupDeferredGauge, float64(deferred), nil); err != nil {
+		slog.Warn("could not set metric", "metric", promexporter.BasebackupDeferredGauge, "error", err)
+	}
+
+	if err := b.prom.Set(promexporter.BasebackupInProgressGauge, float64(len(b.InProgress())), nil); err != nil {
+		slog.Warn("could not set metric", "metric", promexporter.BasebackupInProgressGauge, "error", err)
+	}
+}
+
+func (b *basebackup) failed(reason string) {
+	if err := b.prom.Inc(promexporter.BasebackupFailuresCounter, []string{reason}); err != nil {
+		slog.Warn("could not increment metric", "metric", promexporter.BasebackupFailuresCounter, "error", err)
+	}
+}
+
+func (b *basebackup) updateMetricsAfterBasebackup(t tablebackup.TableBackuper, info message.DumpInfo) {
+	labels := []string{t.OID().String(), t.String()}
+
+	if err := b.prom.Observe(promexporter.BasebackupDurationHistogram, info.BackupDuration.Seconds(), nil); err != nil {
+		slog.Warn("could not observe metric", "metric", promexporter.BasebackupDurationHistogram, "error", err)
+	}
+
+	if err := b.prom.Set(promexporter.PerTableBasebackupDurationGauge, info.BackupDuration.Seconds(), labels); err != nil {
+		slog.Warn("could not set metric", "metric", promexporter.PerTableBasebackupDurationGauge, "error", err)
+	}
+
+	if err := b.prom.Set(promexporter.PerTableBasebackupSizeGauge, float64(info.Size), labels); err != nil {
+		slog.Warn("could not set metric", "metric", promexporter.PerTableBasebackupSizeGauge, "error", err)
+	}
+}
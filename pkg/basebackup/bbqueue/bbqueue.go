@@ -0,0 +1,274 @@
+package bbqueue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+const (
+	// OrderDeltas puts first the tables with the most deltas relative to the size of their last basebackup
+	OrderDeltas = "deltas"
+	// OrderAge puts first the tables with the oldest last basebackup
+	OrderAge = "age"
+	// OrderFIFO keeps the tables in the order they were queued
+	OrderFIFO = "fifo"
+)
+
+// Config describes the order of the basebackup queue
+type Config struct {
+	Order      string         `yaml:"order"`      // deltas (default), age or fifo
+	Priorities map[string]int `yaml:"priorities"` // by the table name, the tables of the higher priority go first
+}
+
+// Validate checks the settings and sets the defaults
+func (c *Config) Validate() error {
+	switch c.Order {
+	case "":
+		c.Order = OrderDeltas
+	case OrderDeltas, OrderAge, OrderFIFO:
+	default:
+		return fmt.Errorf("unknown order: %q", c.Order)
+	}
+
+	priorities := make(map[string]int, len(c.Priorities))
+	for name, p := range c.Priorities {
+		key := message.ParseNamespacedName(name).String()
+		if _, ok := priorities[key]; ok {
+			return fmt.Errorf("table %q is listed more than once", name)
+		}
+		priorities[key] = p
+	}
+	c.Priorities = priorities
+
+	return nil
+}
+
+// Priority returns the configured priority of the table
+func (c Config) Priority(name message.NamespacedName) int {
+	return c.Priorities[name.String()]
+}
+
+// Table is the table to basebackup
+type Table interface {
+	OID() dbutils.OID
+}
+
+// Item is the table waiting for the basebackup
+type Item struct {
+	Table    Table
+	Name     message.NamespacedName // name of the table as of the time it was queued
+	Priority int                    // manual priority, higher first
+	Score    float64                // urgency according to the order of the queue as of the last look at it, higher first
+	Urgent   bool                   // the basebackup may start regardless of the ready function of the queue
+	QueuedAt time.Time              // the first time the table was queued
+}
+
+// before returns true if the item goes before the other one
+func (i Item) before(other Item) bool {
+	if i.Urgent != other.Urgent {
+		return i.Urgent
+	}
+
+	if i.Priority != other.Priority {
+		return i.Priority > other.Priority
+	}
+
+	if i.Score != other.Score {
+		return i.Score > other.Score
+	}
+
+	return i.QueuedAt.Before(other.QueuedAt)
+}
+
+// Queue is the basebackup queue holding at most one item per table, the tables are got in the order of their
+// priority; the table is not got while its basebackup is in progress
+type Queue struct {
+	ctx   context.Context
+	ready func(Item) bool    // whether the basebackup of the table may start now
+	score func(Item) float64 // urgency of the basebackup of the table, it changes while the table waits
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	items      map[dbutils.OID]*Item
+	inProgress map[dbutils.OID]time.Time // start time of the basebackup by the table oid
+}
+
+// New instantiates the queue, the items not ready wait in the queue until Wake is called; the scores of the queued
+// items are recomputed every time the queue is looked at
+func New(ctx context.Context, ready func(Item) bool, score func(Item) float64) *Queue {
+	q := &Queue{
+		ctx:        ctx,
+		ready:      ready,
+		score:      score,
+		items:      make(map[dbutils.OID]*Item),
+		inProgress: make(map[dbutils.OID]time.Time),
+	}
+	q.cond = sync.NewCond(&q.mu)
+
+	go func() {
+		<-ctx.Done()
+		q.Wake()
+	}()
+
+	return q
+}
+
+// Put queues the table, if the table is queued already the priorities are merged keeping its place in the queue
+func (q *Queue) Put(item Item) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if item.QueuedAt.IsZero() {
+		item.QueuedAt = time.Now()
+	}
+
+	oid := item.Table.OID()
+	if queued, ok := q.items[oid]; ok {
+		if queued.Priority > item.Priority {
+			item.Priority = queued.Priority
+		}
+		item.Urgent = item.Urgent || queued.Urgent
+		item.QueuedAt = queued.QueuedAt
+	}
+	item.Score = q.score(item)
+	q.items[oid] = &item
+
+	q.cond.Broadcast()
+}
+
+// rescore recomputes the scores of the queued items, i.e. the deltas of the table grew while it waits
+func (q *Queue) rescore() {
+	for _, item := range q.items {
+		item.Score = q.score(*item)
+	}
+}
+
+// update changes the queued item of the table, returns false if the table is not queued
+func (q *Queue) update(oid dbutils.OID, fn func(*Item)) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	item, ok := q.items[oid]
+	if !ok {
+		return false
+	}
+	fn(item)
+
+	q.cond.Broadcast()
+
+	return true
+}
+
+// Expedite marks the queued table urgent, returns false if the table is not queued
+func (q *Queue) Expedite(oid dbutils.OID) bool {
+	return q.update(oid, func(item *Item) { item.Urgent = true })
+}
+
+// SetPriority changes the priority of the queued table, returns false if the table is not queued
+func (q *Queue) SetPriority(oid dbutils.OID, priority int) bool {
+	return q.update(oid, func(item *Item) { item.Priority = priority })
+}
+
+// Get returns the first ready table not being backed up and marks it in progress, blocks until there is one;
+// Done must be called once the basebackup is over
+func (q *Queue) Get() (Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if err := q.ctx.Err(); err != nil {
+			return Item{}, err
+		}
+		q.rescore()
+
+		var next *Item
+		for oid, item := range q.items {
+			if _, ok := q.inProgress[oid]; ok {
+				continue
+			}
+
+			if next != nil && !item.before(*next) {
+				continue
+			}
+
+			if item.Urgent || q.ready(*item) {
+				next = item
+			}
+		}
+
+		if next != nil {
+			oid := next.Table.OID()
+			delete(q.items, oid)
+			q.inProgress[oid] = time.Now()
+
+			return *next, nil
+		}
+
+		q.cond.Wait()
+	}
+}
+
+// Done marks the basebackup of the table over
+func (q *Queue) Done(oid dbutils.OID) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.inProgress, oid)
+	q.cond.Broadcast()
+}
+
+// Wake makes the waiting Get calls check the queued tables again, i.e. when they might have become ready
+func (q *Queue) Wake() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cond.Broadcast()
+}
+
+// Items returns the queued tables in the order they would be got if all were ready
+func (q *Queue) Items() []Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rescore()
+
+	items := make([]Item, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].before(items[j]) })
+
+	return items
+}
+
+// Ready returns true if the basebackup of the queued item may start now
+func (q *Queue) Ready(item Item) bool {
+	return item.Urgent || q.ready(item)
+}
+
+// Size returns the number of the queued tables
+func (q *Queue) Size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+// InProgress returns the start times of the basebackups in progress by the table oid
+func (q *Queue) InProgress() map[dbutils.OID]time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	result := make(map[dbutils.OID]time.Time, len(q.inProgress))
+	for oid, startedAt := range q.inProgress {
+		result[oid] = startedAt
+	}
+
+	return result
+}
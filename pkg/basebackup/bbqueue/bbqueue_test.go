@@ -0,0 +1,251 @@
+package bbqueue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+type testTable dbutils.OID
+
+func (t testTable) OID() dbutils.OID { return dbutils.OID(t) }
+
+// testQueue is the queue with the scores and the readiness of the tables set by the test
+type testQueue struct {
+	*Queue
+
+	mu       sync.Mutex
+	scores   map[dbutils.OID]float64
+	deferred map[dbutils.OID]bool
+}
+
+func newTestQueue(ctx context.Context) *testQueue {
+	q := &testQueue{scores: make(map[dbutils.OID]float64), deferred: make(map[dbutils.OID]bool)}
+	q.Queue = New(ctx, q.ready, q.score)
+
+	return q
+}
+
+func (q *testQueue) ready(item Item) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return !q.deferred[item.Table.OID()]
+}
+
+func (q *testQueue) score(item Item) float64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.scores[item.Table.OID()]
+}
+
+func (q *testQueue) set(oid dbutils.OID, score float64, deferred bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.scores[oid] = score
+	q.deferred[oid] = deferred
+}
+
+func oids(items []Item) []dbutils.OID {
+	result := make([]dbutils.OID, 0, len(items))
+	for _, item := range items {
+		result = append(result, item.Table.OID())
+	}
+
+	return result
+}
+
+func equalOIDs(a, b []dbutils.OID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestOrder(t *testing.T) {
+	q := newTestQueue(context.Background())
+	now := time.Now()
+
+	q.set(1, 0.5, false)
+	q.set(2, 2, false)
+	q.set(3, 0.5, false)
+	q.set(4, 0, false)
+	q.set(5, 0, false)
+
+	q.Put(Item{Table: testTable(1), QueuedAt: now})
+	q.Put(Item{Table: testTable(2), QueuedAt: now.Add(time.Second)})
+	q.Put(Item{Table: testTable(3), QueuedAt: now.Add(-time.Second)})
+	q.Put(Item{Table: testTable(4), Priority: 1, QueuedAt: now})
+	q.Put(Item{Table: testTable(5), Urgent: true, QueuedAt: now})
+
+	// urgent, then by the priority, the score and the queue time
+	want := []dbutils.OID{5, 4, 2, 3, 1}
+	if got := oids(q.Items()); !equalOIDs(got, want) {
+		t.Fatalf("expected order %v, got %v", want, got)
+	}
+
+	for _, oid := range want {
+		item, err := q.Get()
+		if err != nil {
+			t.Fatalf("could not get: %v", err)
+		}
+		if item.Table.OID() != oid {
+			t.Errorf("expected table %d, got %d", oid, item.Table.OID())
+		}
+		q.Done(item.Table.OID())
+	}
+
+	if q.Size() != 0 {
+		t.Errorf("expected the queue to be empty, got %d items", q.Size())
+	}
+}
+
+func TestRescore(t *testing.T) {
+	q := newTestQueue(context.Background())
+
+	q.set(1, 2, false)
+	q.set(2, 1, false)
+	q.Put(Item{Table: testTable(1)})
+	q.Put(Item{Table: testTable(2)})
+
+	// the deltas of the second table grew while it waited
+	q.set(2, 3, false)
+
+	items := q.Items()
+	if want := []dbutils.OID{2, 1}; !equalOIDs(oids(items), want) {
+		t.Fatalf("expected order %v, got %v", want, oids(items))
+	}
+	if items[0].Score != 3 {
+		t.Errorf("expected the score to be recomputed, got %v", items[0].Score)
+	}
+
+	if item, err := q.Get(); err != nil || item.Table.OID() != 2 {
+		t.Errorf("expected table 2, got %v, %v", item.Table, err)
+	}
+}
+
+func TestPutMerge(t *testing.T) {
+	q := newTestQueue(context.Background())
+	queuedAt := time.Now().Add(-time.Hour)
+	name := message.NamespacedName{Namespace: "public", Name: "t"}
+
+	q.Put(Item{Table: testTable(1), Name: name, Priority: 5, QueuedAt: queuedAt})
+	q.Put(Item{Table: testTable(1), Name: name, Priority: 1, Urgent: true})
+	q.Put(Item{Table: testTable(1), Name: name, Priority: 3})
+
+	items := q.Items()
+	if len(items) != 1 {
+		t.Fatalf("expected the table to be queued once, got %d items", len(items))
+	}
+
+	item := items[0]
+	if item.Priority != 5 || !item.Urgent || !item.QueuedAt.Equal(queuedAt) || item.Name != name {
+		t.Errorf("expected the merged item to keep priority 5, urgency and queue time, got %+v", item)
+	}
+
+	if !q.SetPriority(1, 7) || q.Items()[0].Priority != 7 {
+		t.Errorf("expected the priority to be changed")
+	}
+	if q.SetPriority(2, 7) || q.Expedite(2) {
+		t.Errorf("expected the table not queued not to be changed")
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	q := newTestQueue(context.Background())
+
+	q.set(1, 1, false)
+	q.Put(Item{Table: testTable(1)})
+
+	item, err := q.Get()
+	if err != nil || item.Table.OID() != 1 {
+		t.Fatalf("expected table 1, got %v, %v", item.Table, err)
+	}
+	if _, ok := q.InProgress()[1]; !ok {
+		t.Errorf("expected table 1 in progress")
+	}
+
+	// the table queued again during its basebackup waits for it to finish
+	q.Put(Item{Table: testTable(1)})
+	q.Put(Item{Table: testTable(2)})
+
+	if item, err := q.Get(); err != nil || item.Table.OID() != 2 {
+		t.Fatalf("expected table 2 while table 1 is in progress, got %v, %v", item.Table, err)
+	}
+
+	got := make(chan dbutils.OID)
+	go func() {
+		item, err := q.Get()
+		if err != nil {
+			got <- 0
+			return
+		}
+		got <- item.Table.OID()
+	}()
+
+	select {
+	case oid := <-got:
+		t.Fatalf("expected to wait for the basebackup in progress, got %d", oid)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.Done(1)
+	if oid := <-got; oid != 1 {
+		t.Errorf("expected table 1 after its basebackup is done, got %d", oid)
+	}
+}
+
+func TestDeferred(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := newTestQueue(ctx)
+
+	q.set(1, 1, true)
+	q.Put(Item{Table: testTable(1)})
+
+	if q.Ready(Item{Table: testTable(1)}) || !q.Ready(Item{Table: testTable(1), Urgent: true}) {
+		t.Errorf("expected only the urgent item to be ready")
+	}
+
+	got := make(chan error)
+	go func() {
+		_, err := q.Get()
+		got <- err
+	}()
+
+	select {
+	case err := <-got:
+		t.Fatalf("expected the deferred table to wait, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// the window of the table opened
+	q.set(1, 1, false)
+	q.Wake()
+	if err := <-got; err != nil {
+		t.Fatalf("could not get: %v", err)
+	}
+
+	go func() {
+		_, err := q.Get()
+		got <- err
+	}()
+	cancel()
+
+	if err := <-got; err != context.Canceled {
+		t.Errorf("expected the context error, got %v", err)
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 	"time"
@@ -13,27 +13,33 @@ import (
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 
+	"github.com/mkabilov/logical_backup/pkg/basebackup/generations"
+	"github.com/mkabilov/logical_backup/pkg/basebackup/throttle"
+	"github.com/mkabilov/logical_backup/pkg/config"
 	"github.com/mkabilov/logical_backup/pkg/message"
 	"github.com/mkabilov/logical_backup/pkg/tablebackup"
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
 )
 
 const (
 	errCodeTableNotFound = "42P01"
 
 	//BasebackupFilename represents file name of the copy dump file
-	BasebackupFilename = "basebackup.copy"
+	BasebackupFilename = generations.DumpFilename
 
 	//BasebackupInfoFilename represents file name of the table info file
-	BasebackupInfoFilename = "basebackup_info.yaml"
+	BasebackupInfoFilename = generations.InfoFilename
 )
 
 // TableBasebackuper represents interface for basebackup table
 type TableBasebackuper interface {
 	Basebackup() error
-	DumpFilename() string
+	DumpFilenames() []string
 	InfoFilename() string
 	Lsn() dbutils.LSN
+	Info() message.DumpInfo
 }
 
 type tableBasebackup struct {
@@ -41,13 +47,18 @@ type tableBasebackup struct {
 
 	conn *pgx.Conn
 
-	table tablebackup.TableBackuper
-	tx    *pgx.Tx
-	dbCfg pgx.ConnConfig
-	dir   string
-
-	infoFilename string
-	dumpFilename string
+	ctx        context.Context
+	table      tablebackup.TableBackuper
+	tx         *pgx.Tx
+	cfg        *config.Config
+	dbCfg      pgx.ConnConfig
+	chunkDBCfg pgx.ConnConfig // of the connections dumping the chunks
+	dir        string
+	log        *slog.Logger
+	limiters   []*throttle.Limiter // the COPY output is passed through
+
+	infoFilename  string
+	dumpFilenames []string
 }
 
 var (
@@ -55,14 +66,56 @@ var (
 	ErrTableNotFound = errors.New("table not found")
 )
 
-// New instantiates basebackup table
-func New(dbCfg pgx.ConnConfig, table tablebackup.TableBackuper) *tableBasebackup {
+// reasons of the basebackup failures, see FailureReason
+const (
+	FailureConnect  = "connect"
+	FailureLock     = "lock"
+	FailureNotFound = "not_found"
+	FailureCopy     = "copy"
+	FailureOther    = "other"
+)
+
+// failure is the error of the basebackup step given by the reason
+type failure struct {
+	reason string
+	err    error
+}
+
+func (f failure) Error() string {
+	return f.err.Error()
+}
+
+// FailureReason returns the reason of the error returned by Basebackup
+func FailureReason(err error) string {
+	if err == ErrTableNotFound {
+		return FailureNotFound
+	}
+
+	if f, ok := err.(failure); ok {
+		return f.reason
+	}
+
+	return FailureOther
+}
+
+// New instantiates basebackup table, the output of COPY is limited by the limiters until the context is done
+func New(ctx context.Context, cfg *config.Config, table tablebackup.TableBackuper, log *slog.Logger,
+	limiters ...*throttle.Limiter) *tableBasebackup {
+	chunkDBCfg := cfg.DB.Merge(pgx.ConnConfig{
+		RuntimeParams:        cfg.BasebackupThrottle.SessionParams,
+		PreferSimpleProtocol: cfg.DB.PreferSimpleProtocol})
+
 	return &tableBasebackup{
+		ctx:   ctx,
 		table: table,
-		dbCfg: dbCfg.Merge(pgx.ConnConfig{
+		cfg:   cfg,
+		dbCfg: chunkDBCfg.Merge(pgx.ConnConfig{
 			RuntimeParams:        map[string]string{"replication": "database"},
 			PreferSimpleProtocol: true}),
-		dir: table.TableDirectory(),
+		chunkDBCfg: chunkDBCfg,
+		dir:        table.TableDirectory(),
+		log:        log,
+		limiters:   limiters,
 	}
 }
 
@@ -71,9 +124,14 @@ func (t *tableBasebackup) InfoFilename() string {
 	return t.infoFilename
 }
 
-// DumpFilename returns path to the copy dump file
-func (t *tableBasebackup) DumpFilename() string {
-	return t.dumpFilename
+// DumpFilenames returns paths to the copy dump files
+func (t *tableBasebackup) DumpFilenames() []string {
+	return t.dumpFilenames
+}
+
+// Info returns the info of the basebackup
+func (t *tableBasebackup) Info() message.DumpInfo {
+	return t.DumpInfo
 }
 
 // Lsn returns basebackup LSN
@@ -103,17 +161,54 @@ func (t *tableBasebackup) fetchRelationInfo() error {
 	return nil
 }
 
+// fetchTableDefinition fetches complete table definition within the same snapshot as the dump
+func (t *tableBasebackup) fetchTableDefinition() error {
+	var def message.TableDefinition
+
+	if err := def.FetchByOID(t.tx, t.table.OID()); err != nil {
+		return fmt.Errorf("could not fetch table definition from db: %v", err)
+	}
+	t.Definition = &def
+
+	return nil
+}
+
 func (t *tableBasebackup) copyDump(filename string) error {
+	return t.copyToFile(t.ctx, t.tx, filename, fmt.Sprintf("copy %s to stdout", t.table.Name().Sanitize()))
+}
+
+// copyToFile runs the copy query within the transaction and writes its output to the file compressing and
+// encrypting it if needed
+func (t *tableBasebackup) copyToFile(ctx context.Context, tx *pgx.Tx, filename, query string) error {
 	fp, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
 	if err != nil {
 		return fmt.Errorf("could not open file: %v", err)
 	}
 	defer fp.Close()
 
-	if err := t.tx.CopyToWriter(fp, fmt.Sprintf("copy %s to stdout", t.table.Name().Sanitize())); err != nil {
+	ew, err := t.cfg.Keyring.NewWriter(fp)
+	if err != nil {
+		return fmt.Errorf("could not init encryption: %v", err)
+	}
+
+	w, err := t.cfg.Compression.NewWriter(ew)
+	if err != nil {
+		return fmt.Errorf("could not init compression: %v", err)
+	}
+
+	if err := tx.CopyToWriter(throttle.NewWriter(ctx, w, t.limiters...), query); err != nil {
+		w.Close()
 		return fmt.Errorf("could not copy: %v", err)
 	}
 
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("could not flush compressed data: %v", err)
+	}
+
+	if err := ew.Close(); err != nil {
+		return fmt.Errorf("could not flush encrypted data: %v", err)
+	}
+
 	return nil
 }
 
@@ -139,8 +234,8 @@ func (t *tableBasebackup) createTempReplicationSlot(slotName string) error {
 
 	defer func() {
 		if _, err := t.tx.Exec(fmt.Sprintf("DROP_REPLICATION_SLOT %s", slotName)); err != nil {
-			log.Printf("could not drop replication slot %s right away: %v, it will be dropped at the end of the backup",
-				slotName, err)
+			t.log.Warn("could not drop replication slot right away, it will be dropped at the end of the backup",
+				"slot", slotName, "error", err)
 		}
 	}()
 
@@ -176,7 +271,7 @@ func (t *tableBasebackup) lockTable() error {
 
 func (t *tableBasebackup) rollback() {
 	if err := t.tx.Rollback(); err != nil {
-		log.Printf("could not rollback: %v", err)
+		t.log.Warn("could not rollback", "error", err)
 	}
 }
 
@@ -194,13 +289,27 @@ func (t *tableBasebackup) connect() error {
 	}
 	t.conn.ConnInfo = connInfo
 
+	t.lowerPriority(t.conn)
+
 	return nil
 }
 
+// lowerPriority renices the backend of the connection if configured, the basebackup goes on if it fails
+func (t *tableBasebackup) lowerPriority(conn *pgx.Conn) {
+	priority := t.cfg.BasebackupThrottle.BackendPriority
+	if priority == 0 {
+		return
+	}
+
+	if _, err := conn.Exec("select set_backend_priority(pg_backend_pid(), $1)", priority); err != nil {
+		t.log.Warn("could not lower backend priority", "extension", throttle.PriorityExtension, "error", err)
+	}
+}
+
 // Basebackup performs base backup of the table
 func (t *tableBasebackup) Basebackup() error {
 	if err := t.connect(); err != nil {
-		return fmt.Errorf("could not connect to db: %v", err)
+		return failure{FailureConnect, fmt.Errorf("could not connect to db: %v", err)}
 	}
 
 	tempInfoFilepath := path.Join(t.dir, BasebackupInfoFilename+".new")
@@ -210,7 +319,7 @@ func (t *tableBasebackup) Basebackup() error {
 		}
 
 		if err := os.Remove(tempInfoFilepath); err != nil {
-			log.Printf("could not delete old temp info file: %v", err)
+			t.log.Warn("could not delete old temp file", "error", err)
 		}
 	}
 
@@ -230,7 +339,7 @@ func (t *tableBasebackup) Basebackup() error {
 		}
 
 		if err := os.Remove(tempDumpFilepath); err != nil {
-			log.Printf("could not delete old temp info file: %v", err)
+			t.log.Warn("could not delete old temp file", "error", err)
 		}
 	}
 	defer os.Remove(tempDumpFilepath)
@@ -260,7 +369,7 @@ func (t *tableBasebackup) Basebackup() error {
 
 		t.rollback()
 
-		return fmt.Errorf("could not lock table: %v", err)
+		return failure{FailureLock, fmt.Errorf("could not lock table: %v", err)}
 	}
 
 	if err := t.fetchRelationInfo(); err != nil {
@@ -268,32 +377,83 @@ func (t *tableBasebackup) Basebackup() error {
 		return fmt.Errorf("could not fetch relation info: %v", err)
 	}
 
-	if err := t.copyDump(tempDumpFilepath); err != nil {
+	if err := t.fetchTableDefinition(); err != nil {
+		t.rollback()
+		return fmt.Errorf("could not fetch table definition: %v", err)
+	}
+
+	chunks, err := t.splitIntoChunks()
+	if err != nil {
 		t.rollback()
-		return fmt.Errorf("could not dump table: %v", err)
+		return fmt.Errorf("could not split table into chunks: %v", err)
+	}
+	defer t.removeTempChunkFiles(chunks)
+
+	if len(chunks) == 0 {
+		if err := t.copyDump(tempDumpFilepath); err != nil {
+			t.rollback()
+			return failure{FailureCopy, fmt.Errorf("could not dump table: %v", err)}
+		}
+	} else {
+		t.log.Info("dumping table in chunks", "chunks", len(chunks))
+		if err := t.copyChunks(chunks); err != nil {
+			t.rollback()
+			return failure{FailureCopy, fmt.Errorf("could not dump table chunks: %v", err)}
+		}
 	}
 
 	if err := t.tx.Commit(); err != nil {
 		return fmt.Errorf("could not commit: %v", err)
 	}
 
-	t.dumpFilename = BasebackupFilename
-	if err := os.Rename(tempDumpFilepath, path.Join(t.dir, t.dumpFilename)); err != nil {
-		return fmt.Errorf("could not move copy dump file: %v", err)
+	// each basebackup goes into its own generation directory, the file names are relative to the table directory
+	genDir := generations.Dir(t.StartLSN)
+	if err := os.MkdirAll(path.Join(t.dir, genDir), os.ModePerm); err != nil {
+		return fmt.Errorf("could not create generation dir: %v", err)
+	}
+
+	if len(chunks) == 0 {
+		t.dumpFilenames = []string{path.Join(genDir, BasebackupFilename)}
+		if err := os.Rename(tempDumpFilepath, path.Join(t.dir, genDir, BasebackupFilename)); err != nil {
+			return fmt.Errorf("could not move copy dump file: %v", err)
+		}
+	} else {
+		for _, chunk := range chunks {
+			filename := ChunkFilename(chunk.id)
+			if err := os.Rename(path.Join(t.dir, filename+".new"), path.Join(t.dir, genDir, filename)); err != nil {
+				return fmt.Errorf("could not move copy dump chunk file: %v", err)
+			}
+
+			t.Chunks = append(t.Chunks, filename)
+			t.dumpFilenames = append(t.dumpFilenames, path.Join(genDir, filename))
+		}
+	}
+
+	for _, filename := range t.dumpFilenames {
+		fi, err := os.Stat(path.Join(t.dir, filename))
+		if err != nil {
+			return fmt.Errorf("could not stat dump file: %v", err)
+		}
+		t.Size += fi.Size()
+	}
+
+	t.Compression = compression.None
+	if t.cfg.Compression.Enabled() {
+		t.Compression = t.cfg.Compression.Method
 	}
+	t.EncryptionKey = t.cfg.Keyring.CurrentKeyID()
 
 	t.BackupDuration = time.Since(t.CreateDate)
 	if err := yaml.NewEncoder(infoFp).Encode(t.DumpInfo); err != nil {
 		return fmt.Errorf("could not save info file: %v", err)
 	}
 
-	t.infoFilename = BasebackupInfoFilename
+	t.infoFilename = path.Join(genDir, BasebackupInfoFilename)
 	if err := os.Rename(tempInfoFilepath, path.Join(t.dir, t.infoFilename)); err != nil {
 		return fmt.Errorf("could not move dump info file: %v", err)
 	}
 
-	log.Printf("snapshotLSN: %v", t.StartLSN)
-	log.Printf("It took %v to basebackup", t.BackupDuration)
+	t.log.Info("basebackup done", logger.LSN, t.StartLSN, "duration", t.BackupDuration, "size", t.Size)
 
 	return nil
 }
@@ -0,0 +1,263 @@
+package bbtable
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+// tidRangeScanVersion is the first server version scanning the ctid ranges without reading the whole table
+const tidRangeScanVersion = 140000
+
+// chunk represents the part of the table dumped into a single chunk file
+type chunk struct {
+	id   int
+	cond string // the rows of the chunk
+}
+
+// ChunkFilename returns file name of the copy dump chunk file with the given number
+func ChunkFilename(id int) string {
+	return fmt.Sprintf("%s.%05d", BasebackupFilename, id)
+}
+
+// splitIntoChunks splits the table into the chunks of the configured size, returns no chunks if the table should be
+// dumped in one piece. The servers older than 14 scan the whole table for every ctid range, the table is split by the
+// ranges of its primary key instead.
+func (t *tableBasebackup) splitIntoChunks() ([]chunk, error) {
+	var (
+		blocks, blockSize int64
+		tuples            float64
+		version           int
+	)
+
+	if t.cfg.BasebackupWorkersPerTable <= 1 {
+		return nil, nil
+	}
+
+	row := t.tx.QueryRow(fmt.Sprintf(`select pg_relation_size(oid) / current_setting('block_size')::int8,
+		current_setting('block_size')::int8, reltuples, current_setting('server_version_num')::int
+		from pg_class where oid = %d`, t.table.OID()))
+	if err := row.Scan(&blocks, &blockSize, &tuples, &version); err != nil {
+		return nil, fmt.Errorf("could not fetch table size: %v", err)
+	}
+
+	chunkBlocks := int64(t.cfg.BasebackupChunkSizeMB) * 1024 * 1024 / blockSize
+	if blocks <= chunkBlocks {
+		return nil, nil
+	}
+
+	if version >= tidRangeScanVersion {
+		return ctidChunks(blocks, chunkBlocks), nil
+	}
+
+	if tuples <= 0 {
+		t.log.Info("table was never analyzed, dumping it in one piece")
+		return nil, nil
+	}
+	chunkRows := int64(tuples) * chunkBlocks / blocks
+
+	return t.keyChunks(chunkRows)
+}
+
+// ctidChunks splits the table into the ranges of the blocks
+func ctidChunks(blocks, chunkBlocks int64) []chunk {
+	chunks := make([]chunk, 0)
+	for start := int64(0); start < blocks; start += chunkBlocks {
+		c := chunk{id: len(chunks), cond: fmt.Sprintf("ctid >= '(%d,0)'::tid", start)}
+
+		// the table might have grown since we fetched its size, those rows are invisible to us, but let the last
+		// chunk cover them nevertheless.
+		if end := start + chunkBlocks; end < blocks {
+			c.cond += fmt.Sprintf(" and ctid < '(%d,0)'::tid", end)
+		}
+
+		chunks = append(chunks, c)
+	}
+
+	return chunks
+}
+
+// keyChunks splits the table into the ranges of its single column primary key holding about the given number of rows
+func (t *tableBasebackup) keyChunks(chunkRows int64) ([]chunk, error) {
+	var key string
+
+	err := t.tx.QueryRow(fmt.Sprintf(`select a.attname
+		from pg_index i
+		       join pg_attribute a on (a.attrelid = i.indrelid and a.attnum = i.indkey[0])
+		where i.indrelid = %d
+		  and i.indisprimary
+		  and i.indnatts = 1`, t.table.OID())).Scan(&key)
+	if err == pgx.ErrNoRows {
+		t.log.Info("table has no single column primary key, dumping it in one piece")
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not fetch primary key: %v", err)
+	}
+	keyName := pgx.Identifier{key}.Sanitize()
+
+	if chunkRows < 1 {
+		chunkRows = 1
+	}
+
+	// a single scan of the primary key index fetches the lower bounds of all the chunks but the first one
+	rows, err := t.tx.Query(fmt.Sprintf(`select k::text
+		from (select %[1]s as k, row_number() over (order by %[1]s) as n from %[2]s) s
+		where n %% %[3]d = 1 and n > 1
+		order by n`, keyName, t.table.Name().Sanitize(), chunkRows))
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch chunk bounds: %v", err)
+	}
+	defer rows.Close()
+
+	bounds := make([]string, 0)
+	for rows.Next() {
+		var bound string
+
+		if err := rows.Scan(&bound); err != nil {
+			return nil, fmt.Errorf("could not scan: %v", err)
+		}
+
+		bounds = append(bounds, dbutils.QuoteLiteral(bound))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("could not fetch chunk bounds: %v", err)
+	}
+
+	if len(bounds) == 0 {
+		return nil, nil
+	}
+
+	chunks := make([]chunk, 0, len(bounds)+1)
+	for i := 0; i <= len(bounds); i++ {
+		cond := make([]string, 0, 2)
+		if i > 0 {
+			cond = append(cond, fmt.Sprintf("%s >= %s", keyName, bounds[i-1]))
+		}
+		if i < len(bounds) {
+			cond = append(cond, fmt.Sprintf("%s < %s", keyName, bounds[i]))
+		}
+
+		chunks = append(chunks, chunk{id: i, cond: strings.Join(cond, " and ")})
+	}
+
+	return chunks, nil
+}
+
+// copyChunks dumps the chunks in parallel, each worker imports the snapshot of the basebackup transaction
+func (t *tableBasebackup) copyChunks(chunks []chunk) error {
+	var snapshotName string
+
+	if err := t.tx.QueryRow("select pg_export_snapshot()").Scan(&snapshotName); err != nil {
+		return fmt.Errorf("could not export snapshot: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.ctx)
+	defer cancel()
+
+	chunksCh := make(chan chunk, len(chunks))
+	for _, c := range chunks {
+		chunksCh <- c
+	}
+	close(chunksCh)
+
+	errCh := make(chan error, t.cfg.BasebackupWorkersPerTable)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < t.cfg.BasebackupWorkersPerTable && i < len(chunks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := t.chunkWorker(ctx, snapshotName, chunksCh); err != nil {
+				// the siblings interrupted by the cancel must not report their errors first
+				errCh <- err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	// return the first error, the rest are most likely the consequences of it
+	for err := range errCh {
+		return err
+	}
+
+	return nil
+}
+
+func (t *tableBasebackup) chunkWorker(ctx context.Context, snapshotName string, chunks <-chan chunk) error {
+	conn, err := pgx.Connect(t.chunkDBCfg)
+	if err != nil {
+		return fmt.Errorf("could not connect to db: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			t.log.Warn("could not close db connection", "error", err)
+		}
+	}()
+	t.lowerPriority(conn)
+
+	tx, err := conn.BeginEx(ctx, &pgx.TxOptions{
+		IsoLevel:   pgx.RepeatableRead,
+		AccessMode: pgx.ReadOnly,
+	})
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %v", err)
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil {
+			t.log.Warn("could not rollback", "error", err)
+		}
+	}()
+
+	if _, err := tx.Exec(fmt.Sprintf("set transaction snapshot %s", dbutils.QuoteLiteral(snapshotName))); err != nil {
+		return fmt.Errorf("could not import snapshot: %v", err)
+	}
+
+	// every chunk is to be read with the tid range or the index scan, never by scanning the whole table
+	if _, err := tx.Exec("set local enable_seqscan = off"); err != nil {
+		return fmt.Errorf("could not disable sequential scans: %v", err)
+	}
+
+	for c := range chunks {
+		select {
+		case <-ctx.Done():
+			return nil
+		default:
+		}
+
+		if err := t.copyChunk(ctx, tx, c); err != nil {
+			return fmt.Errorf("could not dump chunk %d: %v", c.id, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *tableBasebackup) copyChunk(ctx context.Context, tx *pgx.Tx, c chunk) error {
+	// the columns as in copy of the whole table, i.e. without the generated ones
+	columns := make([]string, 0, len(t.Relation.Columns))
+	for _, col := range t.Relation.Columns {
+		columns = append(columns, pgx.Identifier{col.Name}.Sanitize())
+	}
+
+	return t.copyToFile(ctx, tx, path.Join(t.dir, ChunkFilename(c.id)+".new"),
+		fmt.Sprintf("copy (select %s from %s where %s) to stdout",
+			strings.Join(columns, ", "), t.table.Name().Sanitize(), c.cond))
+}
+
+func (t *tableBasebackup) removeTempChunkFiles(chunks []chunk) {
+	for _, c := range chunks {
+		filename := path.Join(t.dir, ChunkFilename(c.id)+".new")
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			t.log.Warn("could not remove temp chunk file", "file", filename, "error", err)
+		}
+	}
+}
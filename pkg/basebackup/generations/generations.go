@@ -0,0 +1,192 @@
+package generations
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+const (
+	// DirName is the name of the table subdirectory holding the basebackup generations
+	DirName = "basebackups"
+
+	// DumpFilename represents file name of the copy dump file
+	DumpFilename = "basebackup.copy"
+
+	// InfoFilename represents file name of the table info file, it is written last and marks the generation complete
+	InfoFilename = "basebackup_info.yaml"
+)
+
+// Generation represents a basebackup of the table, restoring it requires the deltas following its start lsn
+type Generation struct {
+	StartLSN   dbutils.LSN
+	CreateDate time.Time
+	Dir        string // directory of the generation relative to the root of the storage
+	Legacy     bool   // basebackup written into the table directory by the older versions
+}
+
+// Policy describes how many generations to retain
+type Policy struct {
+	Generations int           // number of the latest generations to keep, at least one
+	Period      time.Duration // keep the generations needed to restore to any point within the period
+}
+
+// Dir returns directory of the generation starting at the lsn relative to the table directory
+func Dir(lsn dbutils.LSN) string {
+	return path.Join(DirName, lsn.Hex())
+}
+
+// List returns complete generations of the table ordered by the start lsn
+func List(archive storage.Storage, tableDir string) ([]Generation, error) {
+	gens := make([]Generation, 0)
+
+	objects, err := archive.List(path.Join(tableDir, DirName))
+	if err != nil {
+		return nil, fmt.Errorf("could not list generations: %v", err)
+	}
+
+	for _, obj := range objects {
+		if path.Base(obj.Name) != InfoFilename {
+			continue
+		}
+
+		gen := Generation{Dir: path.Dir(obj.Name)}
+		if err := gen.loadDates(archive); err != nil {
+			return nil, err
+		}
+
+		gens = append(gens, gen)
+	}
+
+	legacy := Generation{Dir: tableDir, Legacy: true}
+	if err := legacy.loadDates(archive); err == nil {
+		gens = append(gens, legacy)
+	} else if err != storage.ErrNotExist {
+		return nil, err
+	}
+
+	sort.Slice(gens, func(i, j int) bool { return gens[i].StartLSN < gens[j].StartLSN })
+
+	return gens, nil
+}
+
+func (g *Generation) loadDates(archive storage.Storage) error {
+	info, err := g.LoadInfo(archive)
+	if err != nil {
+		return err
+	}
+
+	g.StartLSN = info.StartLSN
+	g.CreateDate = info.CreateDate
+
+	return nil
+}
+
+// LoadInfo loads basebackup info of the generation, returns storage.ErrNotExist if there is no info file
+func (g Generation) LoadInfo(archive storage.Storage) (message.DumpInfo, error) {
+	var info message.DumpInfo
+
+	fp, err := archive.Get(path.Join(g.Dir, InfoFilename))
+	if err == storage.ErrNotExist {
+		return info, err
+	} else if err != nil {
+		return info, fmt.Errorf("could not open info file: %v", err)
+	}
+	defer fp.Close()
+
+	if err := yaml.NewDecoder(fp).Decode(&info); err != nil {
+		return info, fmt.Errorf("could not decode info file of %q: %v", g.Dir, err)
+	}
+
+	return info, nil
+}
+
+// Files returns the stored files of the generation
+func (g Generation) Files(archive storage.Storage) ([]storage.Object, error) {
+	if !g.Legacy {
+		return archive.List(g.Dir)
+	}
+
+	objects, err := archive.List(g.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]storage.Object, 0)
+	for _, obj := range objects {
+		if path.Dir(obj.Name) != g.Dir {
+			continue
+		}
+
+		if filename := path.Base(obj.Name); filename == InfoFilename || strings.HasPrefix(filename, DumpFilename) {
+			files = append(files, obj)
+		}
+	}
+
+	return files, nil
+}
+
+// Delete deletes the files of the generation, the info file goes last so that the generation is never seen complete
+// with some of its dump files missing
+func (g Generation) Delete(archive storage.Storage) error {
+	files, err := g.Files(archive)
+	if err != nil {
+		return fmt.Errorf("could not list files: %v", err)
+	}
+
+	for _, obj := range files {
+		if path.Base(obj.Name) == InfoFilename {
+			continue
+		}
+
+		if err := archive.Delete(obj.Name); err != nil {
+			return fmt.Errorf("could not delete %q: %v", obj.Name, err)
+		}
+	}
+
+	return archive.Delete(path.Join(g.Dir, InfoFilename))
+}
+
+// Covering returns the latest generation starting at or before the lsn, or the latest generation if the lsn is invalid
+func Covering(gens []Generation, lsn dbutils.LSN) (Generation, bool) {
+	for i := len(gens) - 1; i >= 0; i-- {
+		if !lsn.IsValid() || gens[i].StartLSN <= lsn {
+			return gens[i], true
+		}
+	}
+
+	return Generation{}, false
+}
+
+// Expired returns the generations not retained by the policy, gens must be ordered by the start lsn
+func (p Policy) Expired(gens []Generation, now time.Time) []Generation {
+	keep := p.Generations
+	if keep < 1 {
+		keep = 1
+	}
+
+	expired := make([]Generation, 0)
+	periodStart := now.Add(-p.Period)
+	periodStartCovered := false
+	for i := len(gens) - 1; i >= 0; i-- {
+		// the newest generation created before the period start is needed to restore to the start of the period
+		if len(gens)-i > keep && (p.Period == 0 || periodStartCovered) {
+			expired = append(expired, gens[i])
+			continue
+		}
+
+		if !gens[i].CreateDate.After(periodStart) {
+			periodStartCovered = true
+		}
+	}
+
+	return expired
+}
@@ -0,0 +1,159 @@
+package throttle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// lowest priority accepted by set_backend_priority
+	maxBackendPriority = 19
+
+	// PriorityExtension provides set_backend_priority to renice the backend
+	PriorityExtension = "prioritize"
+)
+
+// Config describes how the basebackups are slowed down to spare the database
+type Config struct {
+	BytesPerSecond          int64             `yaml:"bytesPerSecond"`          // of all the basebackups together, 0 for no limit
+	BytesPerSecondPerWorker int64             `yaml:"bytesPerSecondPerWorker"` // of every basebackup worker, 0 for no limit
+	BackendPriority         int               `yaml:"backendPriority"`         // nice value of the backends running COPY, 0 to leave as is
+	SessionParams           map[string]string `yaml:"sessionParams"`           // set on the basebackup connections, i.e. work_mem
+}
+
+// Validate checks the settings
+func (c Config) Validate() error {
+	if c.BytesPerSecond < 0 || c.BytesPerSecondPerWorker < 0 {
+		return fmt.Errorf("bandwidth limits must not be negative")
+	}
+
+	if c.BackendPriority < 0 || c.BackendPriority > maxBackendPriority {
+		return fmt.Errorf("backendPriority must be between 1 and %d, or 0 to leave the priority as is", maxBackendPriority)
+	}
+
+	if _, ok := c.SessionParams["replication"]; ok {
+		return fmt.Errorf("replication can not be set in sessionParams")
+	}
+
+	return nil
+}
+
+// Enabled returns true if anything is throttled
+func (c Config) Enabled() bool {
+	return c.BytesPerSecond > 0 || c.BytesPerSecondPerWorker > 0 || c.BackendPriority > 0 || len(c.SessionParams) > 0
+}
+
+// String implements Stringer
+func (c Config) String() string {
+	limit := func(v int64) string {
+		if v == 0 {
+			return "unlimited"
+		}
+
+		return fmt.Sprintf("%d bytes/s", v)
+	}
+
+	params := make([]string, 0, len(c.SessionParams))
+	for k, v := range c.SessionParams {
+		params = append(params, k+"="+v)
+	}
+
+	return fmt.Sprintf("total: %s per worker: %s backend priority: %d session params: %s",
+		limit(c.BytesPerSecond), limit(c.BytesPerSecondPerWorker), c.BackendPriority, strings.Join(params, ","))
+}
+
+// Limiter is the token bucket limiting the rate of bytes passed through it, safe for concurrent use; the nil limiter
+// does not limit anything
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64 // may go negative, the debt is paid off by sleeping
+	last   time.Time
+}
+
+// NewLimiter returns the limiter of the given rate allowing a burst of one second worth of bytes, nil if the rate
+// is not positive
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until the n bytes fit into the rate or the context is done
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type writer struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*Limiter
+}
+
+// NewWriter returns the writer waiting for every limiter before writing, the write fails once the context is done
+func NewWriter(ctx context.Context, w io.Writer, limiters ...*Limiter) io.Writer {
+	active := make([]*Limiter, 0, len(limiters))
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+
+	if len(active) == 0 {
+		return w
+	}
+
+	return &writer{ctx: ctx, w: w, limiters: active}
+}
+
+// Write implements io.Writer
+func (w *writer) Write(p []byte) (int, error) {
+	for _, l := range w.limiters {
+		if err := l.Wait(w.ctx, len(p)); err != nil {
+			return 0, err
+		}
+	}
+
+	return w.w.Write(p)
+}
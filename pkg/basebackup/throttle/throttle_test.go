@@ -0,0 +1,109 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		err  bool
+	}{
+		{"empty", Config{}, false},
+		{"limits", Config{BytesPerSecond: 1 << 20, BytesPerSecondPerWorker: 1 << 10, BackendPriority: 19}, false},
+		{"negative total", Config{BytesPerSecond: -1}, true},
+		{"negative per worker", Config{BytesPerSecondPerWorker: -1}, true},
+		{"negative priority", Config{BackendPriority: -1}, true},
+		{"priority too low", Config{BackendPriority: 20}, true},
+		{"session params", Config{SessionParams: map[string]string{"work_mem": "4MB"}}, false},
+		{"replication param", Config{SessionParams: map[string]string{"replication": "database"}}, true},
+	}
+
+	for _, tt := range tests {
+		if err := tt.cfg.Validate(); (err != nil) != tt.err {
+			t.Errorf("%s: expected error %t, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	if l := NewLimiter(0); l != nil {
+		t.Fatalf("expected no limiter for the zero rate")
+	}
+
+	var l *Limiter
+	if err := l.Wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("expected the nil limiter not to wait, got %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if w := NewWriter(context.Background(), buf, nil, nil); w != buf {
+		t.Errorf("expected the writer without limiters to be returned as is")
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := NewLimiter(1000)
+	ctx := context.Background()
+
+	// the burst of one second worth of bytes passes at once
+	start := time.Now()
+	if err := l.Wait(ctx, 1000); err != nil {
+		t.Fatalf("could not wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("expected the burst not to wait, waited %v", elapsed)
+	}
+
+	start = time.Now()
+	if err := l.Wait(ctx, 100); err != nil {
+		t.Fatalf("could not wait: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected to wait about 100ms, waited %v", elapsed)
+	}
+}
+
+func TestLimiterCancel(t *testing.T) {
+	l := NewLimiter(100)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errCh := make(chan error)
+	go func() {
+		// a minute beyond the burst
+		errCh <- l.Wait(ctx, 6100)
+	}()
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+	select {
+	case err := <-errCh:
+		if err != context.Canceled {
+			t.Errorf("expected the context error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the wait to be interrupted by the cancel")
+	}
+
+	if err := l.Wait(ctx, 0); err != context.Canceled {
+		t.Errorf("expected the done context to fail the wait, got %v", err)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	buf := &bytes.Buffer{}
+	w := NewWriter(ctx, buf, NewLimiter(1<<20), nil)
+
+	if n, err := w.Write([]byte("data")); err != nil || n != 4 || buf.String() != "data" {
+		t.Fatalf("expected the data to be written, got %d, %v, %q", n, err, buf.String())
+	}
+
+	cancel()
+	if n, err := w.Write([]byte("more")); err != context.Canceled || n != 0 || buf.String() != "data" {
+		t.Errorf("expected the write to fail after the cancel, got %d, %v, %q", n, err, buf.String())
+	}
+}
@@ -0,0 +1,438 @@
+package catalog
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mkabilov/logical_backup/pkg/deltas"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/deltafiles"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
+	"github.com/mkabilov/logical_backup/pkg/utils/namehistory"
+)
+
+// Filename is the name of the catalog file in the root of the archive
+const Filename = "catalog.yaml"
+
+const formatVersion = 1
+
+// Interface represents the catalog maintained by the backup process
+type Interface interface {
+	Load() error
+	Save() error
+	SetName(dbutils.OID, dbutils.LSN, message.NamespacedName)
+	AddDelta(dbutils.OID, Delta)
+	AddBasebackup(dbutils.OID, Basebackup)
+	Purge(dbutils.OID, dbutils.LSN)
+	SetState(dbutils.OID, State)
+	Table(dbutils.OID) (Table, bool)
+}
+
+// Basebackup describes a basebackup generation of the table
+type Basebackup struct {
+	StartLSN   dbutils.LSN   `yaml:"startLSN"`
+	CreateDate time.Time     `yaml:"createDate"`
+	Duration   time.Duration `yaml:"duration"`
+	Size       int64         `yaml:"size"` // size of the dump files as stored
+	Dir        string        `yaml:"dir"`  // relative to the root of the archive
+}
+
+// Delta describes a delta file of the table
+type Delta struct {
+	Filename string      `yaml:"filename"` // name of the file in the deltas directory of the table
+	MinLSN   dbutils.LSN `yaml:"minLSN"`
+	MaxLSN   dbutils.LSN `yaml:"maxLSN"`
+	MinTime  time.Time   `yaml:"minTime"`
+	MaxTime  time.Time   `yaml:"maxTime"`
+	Messages uint32      `yaml:"messages"`
+	Size     int64       `yaml:"size"`
+}
+
+// State represents the counters of the table backup as of the latest saved state
+type State struct {
+	MessagesSinceBackupCount uint        `yaml:"messagesSinceBackupCount" json:"messagesSinceBackupCount"`
+	DeltasSinceBackupCount   uint        `yaml:"deltasSinceBackupCount" json:"deltasSinceBackupCount"`
+	LastProcessedMessage     time.Time   `yaml:"lastProcessedMessageTime" json:"lastProcessedMessageTime"`
+	LatestFinalLSN           dbutils.LSN `yaml:"latestFinalLSN" json:"latestFinalLSN"`
+	LatestFlushLSN           dbutils.LSN `yaml:"latestFlushLSN" json:"latestFlushLSN"`
+}
+
+// Table is the catalog entry of the table
+type Table struct {
+	OID         dbutils.OID             `yaml:"oid"`
+	Dir         string                  `yaml:"dir"` // relative to the root of the archive
+	Names       []namehistory.NameAtLSN `yaml:"names"`
+	Basebackups []Basebackup            `yaml:"basebackups"` // retained generations ordered by the start lsn
+	Deltas      []Delta                 `yaml:"deltas"`      // ordered by the lsn
+	State       State                   `yaml:"state"`
+	UpdatedAt   time.Time               `yaml:"updatedAt"`
+}
+
+type catalogFile struct {
+	Version int      `yaml:"version"`
+	Tables  []*Table `yaml:"tables"`
+}
+
+// Catalog represents the catalog of the archive: the file in the root of the archive with the entry per table. The
+// backup process updates it as the files are written, i.e. the files might not be moved from the staging dir yet.
+type Catalog struct {
+	saveMutex sync.Mutex // serializes the uploads of the catalog file
+	mutex     sync.RWMutex
+	isChanged bool
+	tables    map[dbutils.OID]*Table
+	storage   storage.Storage
+	keyring   *encryption.Keyring
+}
+
+// New instantiates empty catalog stored in the archive storage, the file is encrypted if the keyring is enabled
+func New(storage storage.Storage, keyring *encryption.Keyring) *Catalog {
+	return &Catalog{
+		tables:  make(map[dbutils.OID]*Table),
+		storage: storage,
+		keyring: keyring,
+	}
+}
+
+// NewDelta returns the catalog entry of the delta file given its header
+func NewDelta(filename string, size int64, h deltas.Header) Delta {
+	return Delta{
+		Filename: filename,
+		MinLSN:   h.MinLSN,
+		MaxLSN:   h.MaxLSN,
+		MinTime:  h.MinTime,
+		MaxTime:  h.MaxTime,
+		Messages: h.MessageCount,
+		Size:     size,
+	}
+}
+
+// NewBasebackup returns the catalog entry of the basebackup stored in the directory
+func NewBasebackup(dir string, info message.DumpInfo) Basebackup {
+	return Basebackup{
+		StartLSN:   info.StartLSN,
+		CreateDate: info.CreateDate,
+		Duration:   info.BackupDuration,
+		Size:       info.Size,
+		Dir:        dir,
+	}
+}
+
+// Name returns the latest name of the table
+func (t Table) Name() message.NamespacedName {
+	if len(t.Names) == 0 {
+		return message.NamespacedName{}
+	}
+
+	return t.Names[len(t.Names)-1].Name
+}
+
+// Basebackup returns the latest basebackup of the table
+func (t Table) Basebackup() (Basebackup, bool) {
+	if len(t.Basebackups) == 0 {
+		return Basebackup{}, false
+	}
+
+	return t.Basebackups[len(t.Basebackups)-1], true
+}
+
+// Covering returns the latest basebackup starting at or before the lsn, or the latest one if the lsn is invalid
+func (t Table) Covering(lsn dbutils.LSN) (Basebackup, bool) {
+	for i := len(t.Basebackups) - 1; i >= 0; i-- {
+		if !lsn.IsValid() || t.Basebackups[i].StartLSN <= lsn {
+			return t.Basebackups[i], true
+		}
+	}
+
+	return Basebackup{}, false
+}
+
+// DeltasSince returns the delta files containing the transactions committed after the lsn
+func (t Table) DeltasSince(lsn dbutils.LSN) []Delta {
+	res := make([]Delta, 0)
+	for _, d := range t.Deltas {
+		if d.MaxLSN > lsn {
+			res = append(res, d)
+		}
+	}
+
+	return res
+}
+
+// table returns the entry of the table, creating it if needed; must be called with the mutex locked
+func (c *Catalog) table(oid dbutils.OID) *Table {
+	t, ok := c.tables[oid]
+	if !ok {
+		t = &Table{
+			OID:         oid,
+			Dir:         utils.TableDir(oid),
+			Names:       make([]namehistory.NameAtLSN, 0),
+			Basebackups: make([]Basebackup, 0),
+			Deltas:      make([]Delta, 0),
+		}
+		c.tables[oid] = t
+	}
+
+	t.UpdatedAt = time.Now()
+	c.isChanged = true
+
+	return t
+}
+
+// SetName records the name of the table if it differs from the latest known one
+func (c *Catalog) SetName(oid dbutils.OID, lsn dbutils.LSN, name message.NamespacedName) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if t, ok := c.tables[oid]; ok && t.Name() == name {
+		return
+	}
+
+	t := c.table(oid)
+	t.Names = append(t.Names, namehistory.NameAtLSN{Name: name, LSN: lsn})
+}
+
+// AddDelta adds the delta file of the table, replacing the entry of the file with the same name
+func (c *Catalog) AddDelta(oid dbutils.OID, delta Delta) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := c.table(oid)
+	for i := range t.Deltas {
+		if t.Deltas[i].Filename == delta.Filename {
+			t.Deltas[i] = delta
+			return
+		}
+	}
+
+	t.Deltas = append(t.Deltas, delta)
+	sortDeltas(t.Deltas)
+}
+
+// AddBasebackup adds the basebackup generation of the table
+func (c *Catalog) AddBasebackup(oid dbutils.OID, bb Basebackup) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := c.table(oid)
+	for i := range t.Basebackups {
+		if t.Basebackups[i].Dir == bb.Dir {
+			t.Basebackups[i] = bb
+			return
+		}
+	}
+
+	t.Basebackups = append(t.Basebackups, bb)
+	sort.Slice(t.Basebackups, func(i, j int) bool { return t.Basebackups[i].StartLSN < t.Basebackups[j].StartLSN })
+}
+
+// Purge removes the basebackups and the delta files of the table prior to the lsn
+func (c *Catalog) Purge(oid dbutils.OID, lsn dbutils.LSN) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := c.table(oid)
+
+	basebackups := make([]Basebackup, 0, len(t.Basebackups))
+	for _, bb := range t.Basebackups {
+		if bb.StartLSN >= lsn {
+			basebackups = append(basebackups, bb)
+		}
+	}
+	t.Basebackups = basebackups
+
+	// delta files are named after their min lsn, the same way the backup process purges them
+	deltaFiles := make([]Delta, 0, len(t.Deltas))
+	for _, d := range t.Deltas {
+		if fileLSN, err := utils.GetLSNFromDeltaFilename(d.Filename); err != nil || fileLSN >= lsn {
+			deltaFiles = append(deltaFiles, d)
+		}
+	}
+	t.Deltas = deltaFiles
+}
+
+// SetState sets the latest state of the table
+func (c *Catalog) SetState(oid dbutils.OID, state State) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.table(oid).State = state
+}
+
+// Tables returns the entries of all the tables ordered by oid
+func (c *Catalog) Tables() []Table {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	tables := make([]Table, 0, len(c.tables))
+	for _, t := range c.tables {
+		tables = append(tables, t.copy())
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].OID < tables[j].OID })
+
+	return tables
+}
+
+// Table returns the entry of the table
+func (c *Catalog) Table(oid dbutils.OID) (Table, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	t, ok := c.tables[oid]
+	if !ok {
+		return Table{}, false
+	}
+
+	return t.copy(), true
+}
+
+// Lookup returns the entry of the table which had the name at the lsn, the latest one if the lsn is invalid
+func (c *Catalog) Lookup(name message.NamespacedName, lsn dbutils.LSN) (Table, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var (
+		found     *Table
+		recentLSN dbutils.LSN
+	)
+
+	for _, t := range c.tables {
+		for _, v := range t.Names {
+			if v.Name != name || (v.LSN > lsn && lsn.IsValid()) {
+				continue
+			}
+
+			if found == nil || recentLSN < v.LSN {
+				found = t
+				recentLSN = v.LSN
+			}
+		}
+	}
+
+	if found == nil {
+		return Table{}, false
+	}
+
+	return found.copy(), true
+}
+
+func (t *Table) copy() Table {
+	res := *t
+	res.Names = append([]namehistory.NameAtLSN(nil), t.Names...)
+	res.Basebackups = append([]Basebackup(nil), t.Basebackups...)
+	res.Deltas = append([]Delta(nil), t.Deltas...)
+
+	return res
+}
+
+// Save saves the catalog to the archive if it has changed, the catalog is not locked while the file is uploaded
+func (c *Catalog) Save() error {
+	c.saveMutex.Lock()
+	defer c.saveMutex.Unlock()
+
+	buf, err := c.encode()
+	if err != nil || buf == nil {
+		return err
+	}
+
+	if err := c.storage.Put(Filename, buf, int64(buf.Len())); err != nil {
+		c.mutex.Lock()
+		c.isChanged = true
+		c.mutex.Unlock()
+
+		return fmt.Errorf("could not store catalog file: %v", err)
+	}
+
+	return nil
+}
+
+// encode returns the contents of the catalog file and resets the changed flag, nil if nothing has changed
+func (c *Catalog) encode() (*bytes.Buffer, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.isChanged {
+		return nil, nil
+	}
+
+	file := catalogFile{Version: formatVersion, Tables: make([]*Table, 0, len(c.tables))}
+	for _, t := range c.tables {
+		file.Tables = append(file.Tables, t)
+	}
+	sort.Slice(file.Tables, func(i, j int) bool { return file.Tables[i].OID < file.Tables[j].OID })
+
+	buf := &bytes.Buffer{}
+	w, err := c.keyring.NewWriter(buf)
+	if err != nil {
+		return nil, fmt.Errorf("could not init encryption: %v", err)
+	}
+
+	if err := yaml.NewEncoder(w).Encode(file); err != nil {
+		return nil, fmt.Errorf("could not encode catalog: %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("could not encrypt catalog: %v", err)
+	}
+	c.isChanged = false
+
+	return buf, nil
+}
+
+// Load loads the catalog from the archive, returns storage.ErrNotExist if there is no catalog file
+func (c *Catalog) Load() error {
+	var file catalogFile
+
+	fp, err := c.storage.Get(Filename)
+	if err == storage.ErrNotExist {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("could not open %q file: %v", Filename, err)
+	}
+	defer fp.Close()
+
+	r, err := c.keyring.NewOptionalReader(fp)
+	if err != nil {
+		return fmt.Errorf("could not init decryption: %v", err)
+	}
+
+	if err := yaml.NewDecoder(r).Decode(&file); err != nil {
+		return fmt.Errorf("could not decode catalog: %v", err)
+	}
+
+	if file.Version > formatVersion {
+		return fmt.Errorf("unsupported catalog version: %d", file.Version)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.tables = make(map[dbutils.OID]*Table)
+	for _, t := range file.Tables {
+		c.tables[t.OID] = t
+	}
+	c.isChanged = false
+
+	return nil
+}
+
+func sortDeltas(list []Delta) {
+	filenames := make(deltafiles.DeltaFiles, len(list))
+	byFilename := make(map[string]Delta, len(list))
+	for i, d := range list {
+		filenames[i] = d.Filename
+		byFilename[d.Filename] = d
+	}
+
+	sort.Sort(filenames)
+	for i, filename := range filenames {
+		list[i] = byFilename[filename]
+	}
+}
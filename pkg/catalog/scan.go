@@ -0,0 +1,127 @@
+package catalog
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mkabilov/logical_backup/pkg/basebackup/generations"
+	"github.com/mkabilov/logical_backup/pkg/deltas"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/namehistory"
+)
+
+// Scan rebuilds the catalog by walking the tables of the oid to name map file, i.e. for the archives written before
+// the catalog was introduced
+func (c *Catalog) Scan() error {
+	fp, err := c.storage.Get(utils.OidNameMapFile)
+	if err == storage.ErrNotExist {
+		return nil // the archive is empty
+	} else if err != nil {
+		return fmt.Errorf("could not open %q file: %v", utils.OidNameMapFile, err)
+	}
+	fp.Close()
+
+	names := namehistory.New(c.storage, utils.OidNameMapFile, c.keyring)
+	if err := names.Load(); err != nil {
+		return fmt.Errorf("could not load table names: %v", err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for oid, history := range names.Entries() {
+		t := c.table(oid)
+		t.Names = append(t.Names[:0], history...)
+
+		if err := c.scanTable(t); err != nil {
+			return fmt.Errorf("could not scan table %d: %v", oid, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Catalog) scanTable(t *Table) error {
+	gens, err := generations.List(c.storage, t.Dir)
+	if err != nil {
+		return err
+	}
+
+	t.Basebackups = t.Basebackups[:0]
+	for _, gen := range gens {
+		info, err := gen.LoadInfo(c.storage)
+		if err != nil {
+			return err
+		}
+
+		// info files of the older versions have no size
+		if info.Size == 0 {
+			files, err := gen.Files(c.storage)
+			if err != nil {
+				return fmt.Errorf("could not list basebackup files: %v", err)
+			}
+
+			for _, obj := range files {
+				if path.Base(obj.Name) != generations.InfoFilename {
+					info.Size += obj.Size
+				}
+			}
+		}
+
+		t.Basebackups = append(t.Basebackups, NewBasebackup(gen.Dir, info))
+	}
+
+	objects, err := c.storage.List(path.Join(t.Dir, deltas.DirName))
+	if err != nil {
+		return fmt.Errorf("could not list delta files: %v", err)
+	}
+
+	t.Deltas = t.Deltas[:0]
+	for _, obj := range objects {
+		h, err := c.readDeltaHeader(obj.Name)
+		if err != nil {
+			slog.Warn("could not read delta header", "file", obj.Name, "error", err)
+			continue
+		}
+
+		t.Deltas = append(t.Deltas, NewDelta(path.Base(obj.Name), obj.Size, h))
+	}
+	sortDeltas(t.Deltas)
+
+	return c.scanState(t)
+}
+
+func (c *Catalog) readDeltaHeader(name string) (deltas.Header, error) {
+	fp, err := c.storage.Get(name)
+	if err != nil {
+		return deltas.Header{}, err
+	}
+	defer fp.Close()
+
+	return deltas.ReadHeader(fp)
+}
+
+func (c *Catalog) scanState(t *Table) error {
+	fp, err := c.storage.Get(path.Join(t.Dir, utils.TableStateFile))
+	if err == storage.ErrNotExist {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open state file: %v", err)
+	}
+	defer fp.Close()
+
+	r, err := c.keyring.NewOptionalReader(fp)
+	if err != nil {
+		return fmt.Errorf("could not init decryption: %v", err)
+	}
+
+	if err := yaml.NewDecoder(r).Decode(&t.State); err != nil {
+		return fmt.Errorf("could not decode state file: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package cdc
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"github.com/mkabilov/logical_backup/pkg/basebackup/generations"
+	"github.com/mkabilov/logical_backup/pkg/deltas"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/deltafiles"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
+)
+
+// ExportTable writes the events of the transactions of the table archived after the fromLSN. The structure of the
+// table is taken from the basebackup the first exported delta file belongs to unless it is already known.
+func ExportTable(archive storage.Storage, keyring *encryption.Keyring, oid dbutils.OID, fromLSN dbutils.LSN,
+	e *Exporter) error {
+	tableDir := utils.TableDir(oid)
+
+	objects, err := archive.List(path.Join(tableDir, deltas.DirName))
+	if err != nil {
+		return fmt.Errorf("could not list delta files: %v", err)
+	}
+
+	deltaFiles := make(deltafiles.DeltaFiles, 0, len(objects))
+	for _, obj := range objects {
+		if _, err := utils.GetLSNFromDeltaFilename(path.Base(obj.Name)); err != nil {
+			continue
+		}
+
+		deltaFiles = append(deltaFiles, path.Base(obj.Name))
+	}
+	sort.Sort(deltaFiles)
+
+	if len(deltaFiles) == 0 {
+		return nil
+	}
+
+	if !e.HasRelation(oid) {
+		if err := loadRelation(archive, tableDir, deltaFiles[0], e); err != nil {
+			return err
+		}
+	}
+
+	// messages preceding the first begin belong to the transaction started in a purged delta file
+	started, skip := false, false
+	for _, filename := range deltaFiles {
+		filename = path.Join(tableDir, deltas.DirName, filename)
+
+		err := forEachMessage(archive, keyring, filename, func(msg message.Message) error {
+			switch v := msg.(type) {
+			case message.Begin:
+				started = true
+				skip = fromLSN.IsValid() && v.FinalLSN <= fromLSN
+			case message.Relation:
+				return e.HandleMessage(msg)
+			}
+
+			if !started || skip {
+				return nil
+			}
+
+			return e.HandleMessage(msg)
+		})
+		if err != nil {
+			return fmt.Errorf("could not export %q: %v", filename, err)
+		}
+	}
+
+	return nil
+}
+
+func loadRelation(archive storage.Storage, tableDir, deltaFilename string, e *Exporter) error {
+	gens, err := generations.List(archive, tableDir)
+	if err != nil {
+		return err
+	}
+
+	lsn, _ := utils.GetLSNFromDeltaFilename(deltaFilename)
+	gen, ok := generations.Covering(gens, lsn)
+	if !ok {
+		if len(gens) == 0 {
+			return nil // the relation message of the stream might follow
+		}
+		gen = gens[0]
+	}
+
+	info, err := gen.LoadInfo(archive)
+	if err != nil {
+		return fmt.Errorf("could not load basebackup info: %v", err)
+	}
+
+	if info.Relation.OID != dbutils.InvalidOID {
+		e.SetRelation(info.Relation)
+	}
+
+	return nil
+}
+
+func forEachMessage(archive storage.Storage, keyring *encryption.Keyring, filename string,
+	fn func(message.Message) error) error {
+	fp, err := archive.Get(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	d := deltas.New("", false, compression.Config{}, keyring)
+	if err := d.LoadFrom(filename, fp); err != nil {
+		return fmt.Errorf("could not load file: %v", err)
+	}
+
+	for {
+		msg, err := d.GetMessage()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not read message: %v", err)
+		}
+
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package cdc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+// Operations of the change events, the same as the ones of Debezium
+const (
+	OpCreate   = "c"
+	OpUpdate   = "u"
+	OpDelete   = "d"
+	OpTruncate = "t"
+)
+
+// Source describes the origin of the change
+type Source struct {
+	Schema string      `json:"schema"`
+	Table  string      `json:"table"`
+	OID    dbutils.OID `json:"oid"`
+	LSN    dbutils.LSN `json:"lsn"`   // final lsn of the transaction
+	XID    int32       `json:"txId"`  // xid of the transaction
+	TsMs   int64       `json:"ts_ms"` // commit timestamp of the transaction in milliseconds
+}
+
+// Event is the change event; the values of the columns are given in the text representation of postgres, the
+// unchanged toasted values are omitted
+type Event struct {
+	Op     string                 `json:"op"`
+	Before map[string]interface{} `json:"before"` // old values of the row, only the key for the default replica identity
+	After  map[string]interface{} `json:"after"`
+	Source Source                 `json:"source"`
+	TsMs   int64                  `json:"ts_ms"` // time of the export in milliseconds
+}
+
+// Exporter writes the change events of the replication messages as JSON Lines
+type Exporter struct {
+	enc       *json.Encoder
+	relations map[dbutils.OID]message.Relation
+	tx        message.Begin
+}
+
+// New instantiates exporter writing the events to w
+func New(w io.Writer) *Exporter {
+	return &Exporter{
+		enc:       json.NewEncoder(w),
+		relations: make(map[dbutils.OID]message.Relation),
+	}
+}
+
+// SetRelation sets the structure of the table for the messages preceding its relation message, i.e. the one from
+// the basebackup info
+func (e *Exporter) SetRelation(rel message.Relation) {
+	e.relations[rel.OID] = rel
+}
+
+// HasRelation returns true if the structure of the table is known
+func (e *Exporter) HasRelation(oid dbutils.OID) bool {
+	_, ok := e.relations[oid]
+
+	return ok
+}
+
+// HandleMessage writes the event for the data change message, the other messages update the exporter state
+func (e *Exporter) HandleMessage(msg message.Message) error {
+	switch v := msg.(type) {
+	case message.Begin:
+		e.tx = v
+	case message.Relation:
+		e.relations[v.OID] = v
+	case message.Insert:
+		return e.write(OpCreate, v.RelationOID, nil, false, v.NewRow)
+	case message.Update:
+		return e.write(OpUpdate, v.RelationOID, v.Ident, v.IdentIsKey, v.NewRow)
+	case message.Delete:
+		return e.write(OpDelete, v.RelationOID, v.Ident, v.IdentIsKey, nil)
+	case message.Truncate:
+		for _, oid := range v.RelationOIDs {
+			if err := e.write(OpTruncate, oid, nil, false, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *Exporter) write(op string, oid dbutils.OID, before []message.TupleData, beforeIsKey bool,
+	after []message.TupleData) error {
+	rel, ok := e.relations[oid]
+	if !ok {
+		return fmt.Errorf("unknown relation with oid %d", oid)
+	}
+
+	event := Event{
+		Op: op,
+		Source: Source{
+			Schema: rel.Namespace,
+			Table:  rel.Name,
+			OID:    oid,
+			LSN:    e.tx.FinalLSN,
+			XID:    e.tx.XID,
+			TsMs:   toMillis(e.tx.Timestamp),
+		},
+		TsMs: toMillis(time.Now()),
+	}
+
+	var err error
+	if event.Before, err = columnValues(rel, before, beforeIsKey); err != nil {
+		return err
+	}
+
+	if event.After, err = columnValues(rel, after, false); err != nil {
+		return err
+	}
+
+	if err := e.enc.Encode(event); err != nil {
+		return fmt.Errorf("could not write event: %v", err)
+	}
+
+	return nil
+}
+
+// columnValues maps the tuple values to the column names, only the key columns are taken if keyOnly is set
+func columnValues(rel message.Relation, tuple []message.TupleData, keyOnly bool) (map[string]interface{}, error) {
+	if tuple == nil {
+		return nil, nil
+	}
+
+	if len(tuple) != len(rel.Columns) {
+		return nil, fmt.Errorf("relation %s has %d columns, got %d values", rel.NamespacedName, len(rel.Columns), len(tuple))
+	}
+
+	values := make(map[string]interface{}, len(tuple))
+	for i, col := range rel.Columns {
+		if keyOnly && !col.IsKey {
+			continue
+		}
+
+		switch tuple[i].Kind {
+		case message.TupleText:
+			values[col.Name] = string(tuple[i].Value)
+		case message.TupleNull:
+			values[col.Name] = nil
+		}
+	}
+
+	return values, nil
+}
+
+func toMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/logical_backup/pkg/basebackup/throttle"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+// checkObjectName is the object written to and deleted from the archive to check the storage is writable
+const checkObjectName = ".check-config"
+
+// Check is the outcome of checking the environment against the config
+type Check struct {
+	Name string
+	Err  error
+}
+
+// CheckEnvironment checks the directories, the archive storage and the database the config refers to
+func (c *Config) CheckEnvironment() []Check {
+	checks := make([]Check, 0)
+	add := func(name string, err error) {
+		checks = append(checks, Check{Name: name, Err: err})
+	}
+
+	if c.ArchiveStorage.IsLocal() {
+		add("archiveDir is writable", checkWritableDir(c.ArchiveDir))
+	} else {
+		add("archive storage is writable", c.checkStorage())
+	}
+
+	if c.StagingDir != "" {
+		add("stagingDir is writable", checkWritableDir(c.StagingDir))
+	}
+
+	if c.CDCExportFile != "" {
+		add("cdcExportFile directory is writable", checkWritableDir(filepath.Dir(c.CDCExportFile)))
+	}
+
+	conn, err := pgx.Connect(c.DB)
+	add("database connection", err)
+	if err != nil {
+		return checks
+	}
+	defer conn.Close()
+
+	add("replication privileges", checkReplicationRole(conn))
+	add("wal_level is logical", checkSetting(conn, "wal_level", "logical"))
+	add("publication", c.checkPublication(conn))
+	add("replication slot", c.checkSlot(conn))
+	if c.BasebackupThrottle.BackendPriority > 0 {
+		add("backend priority extension", checkExtension(conn, throttle.PriorityExtension))
+	}
+
+	replConn, err := pgx.ReplicationConnect(c.DB)
+	if err == nil {
+		err = replConn.Close()
+	}
+	add("replication connection", err)
+
+	return checks
+}
+
+// checkWritableDir checks the directory or, if it does not exist yet, the closest existing parent is writable
+func checkWritableDir(dir string) error {
+	for {
+		fi, err := os.Stat(dir)
+		if os.IsNotExist(err) && path.Dir(dir) != dir {
+			dir = path.Dir(dir)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("could not stat: %v", err)
+		}
+
+		if !fi.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+
+		break
+	}
+
+	fp, err := ioutil.TempFile(dir, checkObjectName)
+	if err != nil {
+		return fmt.Errorf("could not create file in %s: %v", dir, err)
+	}
+	fp.Close()
+
+	return os.Remove(fp.Name())
+}
+
+// checkStorage puts and deletes the probe object in the object storage
+func (c *Config) checkStorage() error {
+	archive, err := storage.New(c.ArchiveStorage, c.ArchiveDir, false)
+	if err != nil {
+		return fmt.Errorf("could not init archive storage: %v", err)
+	}
+
+	if err := archive.Put(checkObjectName, bytes.NewReader(nil), 0); err != nil {
+		return fmt.Errorf("could not put object: %v", err)
+	}
+
+	if err := archive.Delete(checkObjectName); err != nil {
+		return fmt.Errorf("could not delete object: %v", err)
+	}
+
+	return nil
+}
+
+func checkReplicationRole(conn *pgx.Conn) error {
+	var replication bool
+
+	err := conn.QueryRow("select rolreplication or rolsuper from pg_roles where rolname = current_user").
+		Scan(&replication)
+	if err != nil {
+		return fmt.Errorf("could not query role: %v", err)
+	}
+
+	if !replication {
+		return fmt.Errorf("the user has neither the replication nor the superuser attribute")
+	}
+
+	return nil
+}
+
+func checkSetting(conn *pgx.Conn, name, expected string) error {
+	var value string
+
+	if err := conn.QueryRow("select current_setting($1)", name).Scan(&value); err != nil {
+		return fmt.Errorf("could not query %s: %v", name, err)
+	}
+
+	if value != expected {
+		return fmt.Errorf("%s is %q, expected %q", name, value, expected)
+	}
+
+	return nil
+}
+
+func checkExtension(conn *pgx.Conn, name string) error {
+	var exists bool
+
+	if err := conn.QueryRow("select exists(select 1 from pg_extension where extname = $1)", name).Scan(&exists); err != nil {
+		return fmt.Errorf("could not query extensions: %v", err)
+	}
+
+	if !exists {
+		return fmt.Errorf("extension %q is not installed", name)
+	}
+
+	return nil
+}
+
+// checkPublication checks the publication exists or can be created on the start
+func (c *Config) checkPublication(conn *pgx.Conn) error {
+	var exists, superuser bool
+
+	err := conn.QueryRow(`select exists(select 1 from pg_publication where pubname = $1),
+		(select rolsuper from pg_roles where rolname = current_user)`, c.PublicationName).Scan(&exists, &superuser)
+	if err != nil {
+		return fmt.Errorf("could not query publication: %v", err)
+	}
+
+	if !exists && !superuser {
+		return fmt.Errorf("publication %q does not exist and only a superuser can create it for all tables",
+			c.PublicationName)
+	}
+
+	return nil
+}
+
+// checkSlot checks the slot, if it exists, is the logical slot of the configured database using pgoutput
+func (c *Config) checkSlot(conn *pgx.Conn) error {
+	var plugin, slotType, database string
+
+	err := conn.QueryRow(`select coalesce(plugin, ''), slot_type, coalesce(database, '')
+		from pg_replication_slots where slot_name = $1`, c.SlotName).Scan(&plugin, &slotType, &database)
+	if err == pgx.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not query replication slot: %v", err)
+	}
+
+	if slotType != "logical" {
+		return fmt.Errorf("slot %q is not a logical slot", c.SlotName)
+	}
+
+	if plugin != dbutils.OutputPlugin {
+		return fmt.Errorf("slot %q uses %q output plugin instead of %q", c.SlotName, plugin, dbutils.OutputPlugin)
+	}
+
+	if database != c.DB.Database {
+		return fmt.Errorf("slot %q belongs to %q database", c.SlotName, database)
+	}
+
+	return nil
+}
@@ -2,50 +2,86 @@ package config
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"regexp"
 	"time"
 
 	"github.com/jackc/pgx"
 	"gopkg.in/yaml.v2"
+
+	"github.com/mkabilov/logical_backup/pkg/basebackup/bbqueue"
+	"github.com/mkabilov/logical_backup/pkg/basebackup/throttle"
+	"github.com/mkabilov/logical_backup/pkg/health"
+	"github.com/mkabilov/logical_backup/pkg/httpsrv"
+	"github.com/mkabilov/logical_backup/pkg/schedule"
+	"github.com/mkabilov/logical_backup/pkg/sink"
+	"github.com/mkabilov/logical_backup/pkg/slotmonitor"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
 )
 
 const (
-	defaultPrometheusPort = 1999
+	// NAMEDATALEN - 1
+	maxIdentifierLength = 63
+
+	defaultArchiverTimeout = time.Minute
 )
 
+// slotNameRe matches the names postgres accepts for the replication slots
+var slotNameRe = regexp.MustCompile(fmt.Sprintf("^[a-z0-9_]{1,%d}$", maxIdentifierLength))
+
 type Config struct {
-	DB                                     pgx.ConnConfig `yaml:"db"`
-	SlotName                               string         `yaml:"slotname"`
-	PublicationName                        string         `yaml:"publication"`
-	TrackNewTables                         bool           `yaml:"trackNewTables"`
-	MessagesPerDelta                       uint32         `yaml:"messagesPerDelta"`
-	BackupThreshold                        uint           `yaml:"backupThreshold"`
-	ConcurrentBasebackups                  int            `yaml:"concurrentBasebackups"`
-	InitialBasebackup                      bool           `yaml:"initialBasebackup"`
-	Fsync                                  bool           `yaml:"fsync"`
-	StagingDir                             string         `yaml:"stagingDir"`
-	ArchiveDir                             string         `yaml:"archiveDir"`
-	ForceBasebackupAfterInactivityInterval time.Duration  `yaml:"forceBasebackupAfterInactivityInterval"`
-	ArchiverTimeout                        time.Duration  `yaml:"archiverTimeout"`
-	PrometheusPort                         int            `yaml:"prometheusPort"`
+	DB                                     pgx.ConnConfig     `yaml:"db"`
+	SlotName                               string             `yaml:"slotname"`
+	PublicationName                        string             `yaml:"publication"`
+	TrackNewTables                         bool               `yaml:"trackNewTables"`
+	MessagesPerDelta                       uint32             `yaml:"messagesPerDelta"`
+	BackupThreshold                        uint               `yaml:"backupThreshold"`
+	ConcurrentBasebackups                  int                `yaml:"concurrentBasebackups"`
+	InitialBasebackup                      bool               `yaml:"initialBasebackup"`
+	Fsync                                  bool               `yaml:"fsync"`
+	StagingDir                             string             `yaml:"stagingDir"`
+	ArchiveDir                             string             `yaml:"archiveDir"`
+	ArchiveStorage                         storage.Config     `yaml:"archiveStorage"`
+	ForceBasebackupAfterInactivityInterval time.Duration      `yaml:"forceBasebackupAfterInactivityInterval"`
+	BasebackupSchedule                     schedule.Config    `yaml:"basebackupSchedule"`
+	BasebackupThrottle                     throttle.Config    `yaml:"basebackupThrottle"`
+	BasebackupQueue                        bbqueue.Config     `yaml:"basebackupQueue"`
+	ArchiverTimeout                        time.Duration      `yaml:"archiverTimeout"`
+	PrometheusPort                         int                `yaml:"prometheusPort"` // deprecated, the port of http.listen if not set
+	HTTP                                   httpsrv.Config     `yaml:"http"`
+	BasebackupWorkersPerTable              int                `yaml:"basebackupWorkersPerTable"`
+	BasebackupChunkSizeMB                  uint               `yaml:"basebackupChunkSizeMB"`
+	Compression                            compression.Config `yaml:"compression"`
+	DeltaCompression                       compression.Config `yaml:"deltaCompression"`
+	Encryption                             encryption.Config  `yaml:"encryption"`
+	RetainGenerations                      int                `yaml:"retainGenerations"`
+	RetainFor                              Duration           `yaml:"retainFor"`
+	CDCExportFile                          string             `yaml:"cdcExportFile"`
+	Sinks                                  []sink.Config      `yaml:"sinks"`
+	Health                                 health.Config      `yaml:"health"`
+	SlotMonitor                            slotmonitor.Config `yaml:"slotMonitor"`
+	LogLevel                               string             `yaml:"logLevel"`
+	LogFormat                              string             `yaml:"logFormat"`
+
+	Keyring *encryption.Keyring `yaml:"-"` // keys loaded according to the Encryption settings
 }
 
+// Duration is the time.Duration which accepts the number of days with the "d" suffix, i.e. 14d
+type Duration = utils.Duration
+
+// New loads the config file, if given, and overrides its settings with the LBT_* environment variables
 func New(filename string) (*Config, error) {
 	var cfg Config
 
-	fp, err := os.Open(filename)
-	if err != nil {
-		return nil, fmt.Errorf("could not open config file: %v", err)
-	}
-	defer func() {
-		if err := fp.Close(); err != nil {
-			log.Printf("could not close file: %v", err)
+	if filename != "" {
+		if err := cfg.load(filename); err != nil {
+			return nil, err
 		}
-	}()
-
-	if err := yaml.NewDecoder(fp).Decode(&cfg); err != nil {
-		return nil, fmt.Errorf("could not decode config file: %v", err)
 	}
 
 	// honor PGHOST, PGPORT and other libpq variables when set.
@@ -55,6 +91,23 @@ func New(filename string) (*Config, error) {
 	}
 	cfg.DB = cfg.DB.Merge(envConfig)
 
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if cfg.SlotName == "" {
+		return nil, fmt.Errorf("slotname is not set")
+	} else if !slotNameRe.MatchString(cfg.SlotName) {
+		return nil, fmt.Errorf("invalid slotname %q: only lower case letters, numbers and underscores are allowed, "+
+			"up to %d characters", cfg.SlotName, maxIdentifierLength)
+	}
+
+	if cfg.PublicationName == "" {
+		return nil, fmt.Errorf("publication is not set")
+	} else if len(cfg.PublicationName) > maxIdentifierLength {
+		return nil, fmt.Errorf("publication name must not be longer than %d characters", maxIdentifierLength)
+	}
+
 	// forcing backups with sub-minute inactivity period makes no sense.
 	cfg.ForceBasebackupAfterInactivityInterval = cfg.ForceBasebackupAfterInactivityInterval.Truncate(time.Minute)
 
@@ -62,6 +115,19 @@ func New(filename string) (*Config, error) {
 		cfg.StagingDir = ""
 	}
 
+	if err := cfg.ArchiveStorage.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid archiveStorage: %v", err)
+	}
+
+	if cfg.ArchiveStorage.IsLocal() && cfg.ArchiveDir == "" {
+		return nil, fmt.Errorf("archiveDir is not set")
+	}
+
+	// files are written locally first and then moved to the remote storage by the archiver
+	if !cfg.ArchiveStorage.IsLocal() && cfg.StagingDir == "" {
+		return nil, fmt.Errorf("stagingDir must be set when the archive is not stored locally")
+	}
+
 	if cfg.MessagesPerDelta <= 0 {
 		return nil, fmt.Errorf("messagesPerDelta must be greater than 0")
 	}
@@ -70,29 +136,160 @@ func New(filename string) (*Config, error) {
 		return nil, fmt.Errorf("backupThreshold must be greater than 0")
 	}
 
-	if cfg.PrometheusPort == 0 {
-		cfg.PrometheusPort = defaultPrometheusPort
+	// with no timeout every message would be written to the delta file right away
+	if cfg.ArchiverTimeout < 0 {
+		return nil, fmt.Errorf("archiverTimeout must not be negative")
+	} else if cfg.ArchiverTimeout == 0 {
+		cfg.ArchiverTimeout = defaultArchiverTimeout
+	}
+
+	if cfg.ConcurrentBasebackups < 0 {
+		return nil, fmt.Errorf("concurrentBasebackups must not be negative")
+	} else if cfg.ConcurrentBasebackups == 0 {
+		cfg.ConcurrentBasebackups = 1
+	}
+
+	if cfg.ForceBasebackupAfterInactivityInterval < 0 {
+		return nil, fmt.Errorf("forceBasebackupAfterInactivityInterval must not be negative")
+	}
+
+	if cfg.BasebackupWorkersPerTable <= 0 {
+		cfg.BasebackupWorkersPerTable = 1
+	}
+
+	if cfg.BasebackupWorkersPerTable > 1 && cfg.BasebackupChunkSizeMB == 0 {
+		return nil, fmt.Errorf("basebackupChunkSizeMB must be greater than 0 when basebackupWorkersPerTable is set")
+	}
+
+	if err := cfg.Compression.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid compression: %v", err)
+	}
+
+	if err := cfg.DeltaCompression.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid deltaCompression: %v", err)
+	}
+
+	if cfg.RetainGenerations < 0 {
+		return nil, fmt.Errorf("retainGenerations must not be negative")
+	}
+
+	if cfg.RetainFor < 0 {
+		return nil, fmt.Errorf("retainFor must not be negative")
+	}
+
+	for i := range cfg.Sinks {
+		if err := cfg.Sinks[i].Validate(); err != nil {
+			return nil, fmt.Errorf("invalid sink %d: %v", i+1, err)
+		}
+	}
+
+	if err := cfg.Health.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid health: %v", err)
+	}
+
+	if err := cfg.SlotMonitor.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid slotMonitor: %v", err)
+	}
+
+	if err := cfg.BasebackupSchedule.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid basebackupSchedule: %v", err)
+	}
+
+	if err := cfg.BasebackupThrottle.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid basebackupThrottle: %v", err)
+	}
+
+	if err := cfg.BasebackupQueue.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid basebackupQueue: %v", err)
+	}
+
+	if err := logger.Validate(cfg.LogLevel, cfg.LogFormat); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.HTTP.Validate(cfg.PrometheusPort); err != nil {
+		return nil, fmt.Errorf("invalid http: %v", err)
+	}
+
+	cfg.Keyring, err = encryption.NewKeyring(cfg.Encryption)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption: %v", err)
 	}
 
 	return &cfg, nil
 }
 
+func (c *Config) load(filename string) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("could not open config file: %v", err)
+	}
+	defer func() {
+		if err := fp.Close(); err != nil {
+			slog.Error("could not close file", "error", err)
+		}
+	}()
+
+	if err := yaml.NewDecoder(fp).Decode(c); err != nil {
+		return fmt.Errorf("could not decode config file: %v", err)
+	}
+
+	return nil
+}
+
 func (c Config) Print() {
 	if c.StagingDir != "" {
-		log.Printf("Staging directory: %q", c.StagingDir)
+		slog.Info("staging directory", "dir", c.StagingDir)
 	} else {
-		log.Printf("No staging directory. Writing directly to the archive dir")
+		slog.Info("no staging directory, writing directly to the archive dir")
 	}
 
-	log.Printf("Archive directory: %q", c.ArchiveDir)
-	log.Printf("BackupThreshold: %v", c.BackupThreshold)
-	log.Printf("MessagesPerDelta: %v", c.MessagesPerDelta)
-	log.Printf("DB connection string: %s@%s:%d/%s slot:%q publication:%q",
-		c.DB.User, c.DB.Host, c.DB.Port, c.DB.Database, c.SlotName, c.PublicationName)
-	log.Printf("Backing up new tables: %t", c.TrackNewTables)
-	log.Printf("Fsync: %t", c.Fsync)
+	if c.ArchiveStorage.IsLocal() {
+		slog.Info("archive directory", "dir", c.ArchiveDir)
+	} else {
+		slog.Info("archive storage", "storage", c.ArchiveStorage.String())
+	}
+	slog.Info("backup threshold", "deltas", c.BackupThreshold)
+	slog.Info("messages per delta", "messages", c.MessagesPerDelta)
+	slog.Info("db connection", "user", c.DB.User, "host", c.DB.Host, "port", c.DB.Port, "database", c.DB.Database,
+		"slot", c.SlotName, "publication", c.PublicationName)
+	slog.Info("backing up new tables", "enabled", c.TrackNewTables)
+	slog.Info("fsync", "enabled", c.Fsync)
+	slog.Info("basebackup compression", "compression", c.Compression.String())
+	slog.Info("delta compression", "compression", c.DeltaCompression.String())
+	if c.Keyring.Enabled() {
+		slog.Info("encryption", "cipher", "aes-256-gcm", "key", c.Keyring.CurrentKeyID())
+	} else {
+		slog.Info("encryption", "cipher", "none")
+	}
+	if c.RetainGenerations > 1 || c.RetainFor > 0 {
+		slog.Info("retain basebackup generations", "generations", c.RetainGenerations, "for", c.RetainFor.String())
+	}
+	if c.CDCExportFile != "" {
+		slog.Info("exporting change events", "file", c.CDCExportFile)
+	}
+	for _, s := range c.Sinks {
+		slog.Info("delivering transactions to sink", "sink", s.String())
+	}
+	slog.Info("http server", "server", c.HTTP.String())
+	if c.SlotMonitor.RetentionLimitMB > 0 {
+		slog.Info("warning when the slot retains too much wal", "percent", c.SlotMonitor.WarnPercent,
+			"limitMB", c.SlotMonitor.RetentionLimitMB)
+	}
+	if c.BasebackupWorkersPerTable > 1 {
+		slog.Info("basebackup workers per table", "workers", c.BasebackupWorkersPerTable,
+			"chunkSizeMB", c.BasebackupChunkSizeMB)
+	}
 	if c.ForceBasebackupAfterInactivityInterval > 0 {
-		log.Printf("Force new basebackup of a modified table after inactivity for: %v",
-			c.ForceBasebackupAfterInactivityInterval)
+		slog.Info("force new basebackup of a modified table after inactivity",
+			"interval", c.ForceBasebackupAfterInactivityInterval.String())
+	}
+	if c.BasebackupSchedule.IsSet() {
+		slog.Info("basebackup schedule", "schedule", c.BasebackupSchedule.String())
+	}
+	slog.Info("basebackup queue", "order", c.BasebackupQueue.Order,
+		"prioritizedTables", len(c.BasebackupQueue.Priorities))
+	if c.BasebackupThrottle.Enabled() {
+		slog.Info("basebackup throttling", "throttle", c.BasebackupThrottle.String())
 	}
 }
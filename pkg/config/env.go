@@ -0,0 +1,155 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v2"
+)
+
+const envPrefix = "LBT_"
+
+// secretKeys are the settings not shown by PrintEffective
+var secretKeys = map[string]struct{}{
+	"password":        {},
+	"secretAccessKey": {},
+	"sessionToken":    {},
+	"bearerToken":     {},
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	unmarshalerType = reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem()
+)
+
+// setting is the leaf value of the config
+type setting struct {
+	path  []string // yaml keys from the top of the config
+	value reflect.Value
+}
+
+// key returns the dotted yaml key, i.e. archiveStorage.s3.bucket
+func (s setting) key() string {
+	return strings.Join(s.path, ".")
+}
+
+// env returns the name of the environment variable overriding the setting, i.e. LBT_ARCHIVE_STORAGE_S3_BUCKET
+func (s setting) env() string {
+	parts := make([]string, 0, len(s.path))
+	for _, p := range s.path {
+		parts = append(parts, upperSnake(p))
+	}
+
+	return envPrefix + strings.Join(parts, "_")
+}
+
+func (s setting) secret() bool {
+	_, ok := secretKeys[s.path[len(s.path)-1]]
+	return ok
+}
+
+// upperSnake converts the camel case to the upper snake case, i.e. retentionLimitMB to RETENTION_LIMIT_MB
+func upperSnake(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+
+	return b.String()
+}
+
+// settings returns the leaf values of the struct the way yaml decodes them, the values which can not be set from
+// yaml, i.e. functions, are skipped
+func settings(v reflect.Value, path []string) []setting {
+	result := make([]setting, 0)
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		fv := v.Field(i)
+		fieldPath := append(append([]string{}, path...), name)
+		for _, flag := range tag[1:] {
+			if flag == "inline" {
+				fieldPath = path
+			}
+		}
+
+		switch fv.Kind() {
+		case reflect.Func, reflect.Interface, reflect.Chan, reflect.Ptr, reflect.UnsafePointer:
+			continue
+		case reflect.Struct:
+			if fv.Type() != timeType && !reflect.PtrTo(fv.Type()).Implements(unmarshalerType) {
+				result = append(result, settings(fv, fieldPath)...)
+				continue
+			}
+		}
+
+		result = append(result, setting{path: fieldPath, value: fv})
+	}
+
+	return result
+}
+
+// applyEnv overrides the settings given by the LBT_* environment variables, the values are parsed as yaml except for
+// the strings taken as is
+func (c *Config) applyEnv() error {
+	for _, s := range settings(reflect.ValueOf(c).Elem(), nil) {
+		value, ok := os.LookupEnv(s.env())
+		if !ok {
+			continue
+		}
+
+		if s.value.Kind() == reflect.String {
+			s.value.SetString(value)
+			continue
+		}
+
+		parsed := reflect.New(s.value.Type())
+		if err := yaml.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+			return fmt.Errorf("could not parse %s: %v", s.env(), err)
+		}
+		s.value.Set(parsed.Elem())
+	}
+
+	return nil
+}
+
+// PrintEffective writes every setting with the environment variable overriding it, the secrets are masked
+func (c *Config) PrintEffective(w io.Writer) {
+	for _, s := range settings(reflect.ValueOf(c).Elem(), nil) {
+		value := fmt.Sprintf("%v", s.value.Interface())
+		if s.secret() && value != "" {
+			value = "********"
+		}
+
+		fmt.Fprintf(w, "%s: %s (%s)\n", s.key(), value, s.env())
+	}
+}
@@ -3,8 +3,9 @@ package consumer
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx"
@@ -12,11 +13,13 @@ import (
 	"github.com/mkabilov/logical_backup/pkg/decoder"
 	"github.com/mkabilov/logical_backup/pkg/message"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
 )
 
 const (
-	statusTimeout   = time.Second * 10
-	replWaitTimeout = time.Second * 10
+	statusTimeout      = time.Second * 10
+	replWaitTimeout    = time.Second * 10
+	pauseCheckInterval = time.Second
 )
 
 // Handler represents interface for processing logical replication messages
@@ -30,6 +33,17 @@ type Interface interface {
 	Run(Handler) error
 	AdvanceLSN(dbutils.LSN)
 	Wait()
+	Pause()
+	Resume()
+	Paused() bool
+	Status() Status
+}
+
+// Status describes the replication connection
+type Status struct {
+	Connected    bool
+	LastMessage  time.Time   // time of the last wal message or keepalive received
+	ServerWALEnd dbutils.LSN // end of the wal on the server as of the last message
 }
 
 type consumer struct {
@@ -41,6 +55,10 @@ type consumer struct {
 	publicationName string
 	currentLSN      dbutils.LSN
 	errCh           chan error
+	paused          int32 // the messages are not read while set, the status is still sent to keep the connection
+
+	statusMu sync.Mutex
+	status   Status
 }
 
 // New instantiates the consumer
@@ -61,6 +79,50 @@ func (c *consumer) AdvanceLSN(lsn dbutils.LSN) {
 	c.currentLSN = lsn
 }
 
+// Pause stops reading the replication messages
+func (c *consumer) Pause() {
+	if atomic.CompareAndSwapInt32(&c.paused, 0, 1) {
+		slog.Info("consumption paused", logger.LSN, c.currentLSN)
+	}
+}
+
+// Resume continues reading the replication messages
+func (c *consumer) Resume() {
+	if atomic.CompareAndSwapInt32(&c.paused, 1, 0) {
+		slog.Info("consumption resumed", logger.LSN, c.currentLSN)
+	}
+}
+
+// Paused returns true if the consumption is paused
+func (c *consumer) Paused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+// Status returns the state of the replication connection
+func (c *consumer) Status() Status {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	return c.status
+}
+
+func (c *consumer) setConnected(connected bool) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	c.status.Connected = connected
+}
+
+func (c *consumer) received(serverWALEnd uint64) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	c.status.LastMessage = time.Now()
+	if lsn := dbutils.LSN(serverWALEnd); lsn > c.status.ServerWALEnd {
+		c.status.ServerWALEnd = lsn
+	}
+}
+
 // Wait waits for the goroutines
 func (c *consumer) Wait() {
 	c.waitGr.Wait()
@@ -91,6 +153,7 @@ func (c *consumer) Run(handler Handler) error {
 		return fmt.Errorf("could not send replay progress: %v", err)
 	}
 
+	c.setConnected(true)
 	c.waitGr.Add(1)
 	go c.processReplicationMessage(handler)
 
@@ -98,7 +161,7 @@ func (c *consumer) Run(handler Handler) error {
 }
 
 func (c *consumer) startDecoding() error {
-	log.Printf("Starting from %s lsn", c.currentLSN)
+	slog.Info("starting decoding", logger.LSN, c.currentLSN, "slot", c.slotName)
 
 	err := c.conn.StartReplication(c.slotName, uint64(c.currentLSN), -1,
 		`"proto_version" '1'`, fmt.Sprintf(`"publication_names" '%s'`, c.publicationName))
@@ -112,12 +175,13 @@ func (c *consumer) startDecoding() error {
 
 func (c *consumer) closeDbConnection() {
 	if err := c.conn.Close(); err != nil {
-		log.Printf("could not close replication connection: %v", err)
+		slog.Warn("could not close replication connection", "error", err)
 	}
 }
 
 func (c *consumer) processReplicationMessage(handler Handler) {
 	defer c.waitGr.Done()
+	defer c.setConnected(false)
 
 	statusTicker := time.NewTicker(statusTimeout)
 	for {
@@ -132,6 +196,14 @@ func (c *consumer) processReplicationMessage(handler Handler) {
 				return
 			}
 		default:
+			if c.Paused() {
+				select {
+				case <-c.ctx.Done():
+				case <-time.After(pauseCheckInterval):
+				}
+				continue
+			}
+
 			wctx, cancel := context.WithTimeout(c.ctx, replWaitTimeout)
 			repMsg, err := c.conn.WaitForReplicationMessage(wctx)
 			cancel()
@@ -139,7 +211,7 @@ func (c *consumer) processReplicationMessage(handler Handler) {
 			if err == context.DeadlineExceeded {
 				continue
 			} else if err == context.Canceled {
-				log.Printf("received shutdown request: decoding terminated")
+				slog.Info("received shutdown request: decoding terminated")
 				return
 			} else if err != nil {
 				// TODO: make sure we retry and cleanup after ourselves afterwards
@@ -148,10 +220,16 @@ func (c *consumer) processReplicationMessage(handler Handler) {
 			}
 
 			if repMsg == nil {
-				log.Printf("received null replication message")
+				slog.Debug("received null replication message")
 				continue
 			}
 
+			if repMsg.WalMessage != nil {
+				c.received(repMsg.WalMessage.ServerWalEnd)
+			} else if repMsg.ServerHeartbeat != nil {
+				c.received(repMsg.ServerHeartbeat.ServerWalEnd)
+			}
+
 			if repMsg.WalMessage != nil {
 				msg, err := decoder.Parse(repMsg.WalMessage.WalData)
 				if err != nil {
@@ -166,7 +244,7 @@ func (c *consumer) processReplicationMessage(handler Handler) {
 			}
 
 			if repMsg.ServerHeartbeat != nil && repMsg.ServerHeartbeat.ReplyRequested == 1 {
-				log.Println("server wants a reply")
+				slog.Debug("server wants a reply")
 				if err := c.SendStatus(); err != nil {
 					c.close(fmt.Errorf("could not send replay progress: %v", err))
 					return
@@ -178,7 +256,7 @@ func (c *consumer) processReplicationMessage(handler Handler) {
 
 // SendStatus sends the status
 func (c *consumer) SendStatus() error {
-	//log.Printf("sending status: %v", c.currentLSN)
+	slog.Debug("sending status", logger.LSN, c.currentLSN)
 	status, err := pgx.NewStandbyStatus(uint64(c.currentLSN))
 
 	if err != nil {
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"sync"
@@ -16,7 +18,9 @@ import (
 
 	"github.com/mkabilov/logical_backup/pkg/message"
 	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
 )
 
 //DirName represents directory name for the deltas
@@ -25,6 +29,18 @@ const DirName = "deltas"
 // EmptyBuffer represents empty message buffer error
 var EmptyBuffer = errors.New("Empty buffer")
 
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// CorruptedFileError represents an error caused by the damaged delta file
+type CorruptedFileError struct {
+	Filename string
+	Reason   string
+}
+
+func (e CorruptedFileError) Error() string {
+	return fmt.Sprintf("delta file %q is corrupted: %s", e.Filename, e.Reason)
+}
+
 // MessageCollector represents interface
 type MessageCollector interface {
 	AddMessage(message.Message)
@@ -39,8 +55,10 @@ type MessageCollector interface {
 // deltas represents storage for delta messages
 type deltas struct {
 	header
-	fp    *os.File
-	mutex sync.RWMutex
+	loadedFile string // name of the loaded file
+	reader     io.ReadCloser
+	bodySize   int // size of the messages as stored in the loaded file
+	mutex      sync.RWMutex
 
 	tableDir    string
 	buffer      *bytes.Buffer
@@ -50,16 +68,22 @@ type deltas struct {
 	txTime      time.Time
 	postfix     int
 	fsync       bool
+	compression compression.Config
+	keyring     *encryption.Keyring
 	buf         []byte
 }
 
-// New instantiates deltas
-func New(tableDir string, fsync bool) *deltas {
+// New instantiates deltas, compression is used for the files being saved only: the loaded files specify their
+// compression method in the header. Keyring encrypts the files being saved if it is enabled and decrypts the loaded
+// ones if they are encrypted.
+func New(tableDir string, fsync bool, compression compression.Config, keyring *encryption.Keyring) *deltas {
 	return &deltas{
-		tableDir: tableDir,
-		buffer:   &bytes.Buffer{},
-		fsync:    fsync,
-		buf:      make([]byte, 8),
+		tableDir:    tableDir,
+		buffer:      &bytes.Buffer{},
+		fsync:       fsync,
+		compression: compression,
+		keyring:     keyring,
+		buf:         make([]byte, 8),
 	}
 }
 
@@ -102,25 +126,38 @@ func (d *deltas) AddMessage(msg message.Message) {
 }
 
 //GetMessage returns a message
-func (d *deltas) GetMessage() (message.Message, error) {
+func (d *deltas) GetMessage() (msg message.Message, err error) {
 	lnBuf := make([]byte, 8)
-	if n, err := d.fp.Read(lnBuf); err == io.EOF && n == 0 {
+	if n, err := io.ReadFull(d.reader, lnBuf); err == io.EOF && n == 0 {
 		return nil, err
 	} else if err != nil {
-		return nil, fmt.Errorf("could not read from file: %v", err)
+		return nil, d.corrupted(fmt.Sprintf("could not read message length: %v", err))
 	}
+
 	ln := binary.BigEndian.Uint64(lnBuf)
+	if ln <= 8 || (d.header.codec == compression.None && ln-8 > uint64(d.bodySize)) {
+		return nil, d.corrupted(fmt.Sprintf("invalid message length: %d", ln))
+	}
 
 	buf := make([]byte, ln-8)
-	if n, err := d.fp.Read(buf); err == io.EOF && n == 0 {
-		return nil, err
-	} else if err != nil {
-		return nil, fmt.Errorf("could not read from file: %v", err)
+	if _, err := io.ReadFull(d.reader, buf); err != nil {
+		return nil, d.corrupted(fmt.Sprintf("could not read message: %v", err))
 	}
 
+	// the decoder trusts the message format, files written by the older versions have no checksum to rely on
+	defer func() {
+		if r := recover(); r != nil {
+			msg, err = nil, d.corrupted(fmt.Sprintf("could not parse message: %v", r))
+		}
+	}()
+
 	return decoder.Parse(buf)
 }
 
+func (d *deltas) corrupted(reason string) error {
+	return CorruptedFileError{Filename: d.loadedFile, Reason: reason}
+}
+
 func (d *deltas) filename() string {
 	filename := d.minLSN.Hex()
 
@@ -162,11 +199,29 @@ func (d *deltas) Save() (string, dbutils.LSN, dbutils.LSN, error) {
 		d.mutex.Unlock()
 	}()
 
+	body := d.buffer
+	d.header.codec = compression.None
+	if d.compression.Enabled() {
+		if body, err = d.compressBuffer(); err != nil {
+			return "", dbutils.InvalidLSN, dbutils.InvalidLSN, fmt.Errorf("could not compress messages: %v", err)
+		}
+		d.header.codec = d.compression.Method
+	}
+
+	d.header.encrypted = d.keyring.Enabled()
+	if d.header.encrypted {
+		if body, err = d.encrypt(body); err != nil {
+			return "", dbutils.InvalidLSN, dbutils.InvalidLSN, fmt.Errorf("could not encrypt messages: %v", err)
+		}
+	}
+
+	d.header.checksum = crc32.Checksum(body.Bytes(), crcTable)
+
 	if err := d.header.write(fp); err != nil {
 		return "", dbutils.InvalidLSN, dbutils.InvalidLSN, fmt.Errorf("could not write header: %v", err)
 	}
 
-	if _, err := d.buffer.WriteTo(fp); err != nil {
+	if _, err := body.WriteTo(fp); err != nil {
 		return "", dbutils.InvalidLSN, dbutils.InvalidLSN, fmt.Errorf("could not write messages: %v", err)
 	}
 
@@ -193,19 +248,94 @@ func (d *deltas) Load(filename string) error {
 	if err != nil {
 		return fmt.Errorf("could not open file: %v", err)
 	}
-	d.fp = fp
+	defer fp.Close()
+
+	return d.LoadFrom(filepath, fp)
+}
 
-	if err := d.header.read(d.fp); err != nil {
-		d.fp.Close()
+// LoadFrom loads the messages of the delta file with the given name from the reader
+func (d *deltas) LoadFrom(filename string, r io.Reader) error {
+	d.loadedFile = filename
+	if err := d.header.read(r); err != nil {
 		return fmt.Errorf("could not read header: %v", err)
 	}
 
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("could not read messages: %v", err)
+	}
+
+	if d.Header().HasChecksum() {
+		if checksum := crc32.Checksum(body, crcTable); checksum != d.header.checksum {
+			return d.corrupted(fmt.Sprintf("checksum mismatch: expected %08x, got %08x", d.header.checksum, checksum))
+		}
+	}
+
+	d.bodySize = len(body)
+	var bodyReader io.Reader = bytes.NewReader(body)
+	if d.header.encrypted {
+		if bodyReader, err = d.keyring.NewReader(bodyReader); err != nil {
+			return fmt.Errorf("could not decrypt %q: %v", filename, err)
+		}
+	}
+
+	d.reader, err = compression.NewReader(d.header.codec, bodyReader)
+	if err != nil {
+		return d.corrupted(fmt.Sprintf("could not init decompression: %v", err))
+	}
+
 	return nil
 }
 
 // Close closes loaded delta file
 func (d *deltas) Close() error {
-	return d.fp.Close()
+	return d.reader.Close()
+}
+
+// compressBuffer returns compressed content of the message buffer
+func (d *deltas) compressBuffer() (*bytes.Buffer, error) {
+	compressed := &bytes.Buffer{}
+
+	w, err := d.compression.NewWriter(compressed)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(d.buffer.Bytes()); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return compressed, nil
+}
+
+// encrypt returns encrypted content of the given buffer
+func (d *deltas) encrypt(body *bytes.Buffer) (*bytes.Buffer, error) {
+	encrypted := &bytes.Buffer{}
+
+	w, err := d.keyring.NewWriter(encrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := body.WriteTo(w); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return encrypted, nil
+}
+
+// Header returns the header of the loaded file
+func (d *deltas) Header() Header {
+	return d.header.export()
 }
 
 // MessageCnt returns number of messages in the current delta
@@ -1,16 +1,48 @@
 package deltas
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
 )
 
+const (
+	// headerVersion is the version of the delta file header written by Save. Files written prior to introducing the
+	// header magic have no version and start with the checksum, which has always been 0 for them.
+	headerVersion uint8 = 3
+
+	legacyHeaderVersion uint8 = 0
+	// noChecksumHeaderVersion is the last version with the checksum not set
+	noChecksumHeaderVersion uint8 = 1
+	// noFlagsHeaderVersion is the last version without the flags byte
+	noFlagsHeaderVersion uint8 = 2
+
+	// flagEncrypted is set if the messages are encrypted after the compression
+	flagEncrypted uint8 = 1 << 0
+)
+
+var headerMagic = []byte("LBTD")
+
+// codecIDs maps compression methods to their ids stored in the header
+var codecIDs = map[compression.Method]uint8{
+	compression.None: 0,
+	compression.Gzip: 1,
+	compression.Zstd: 2,
+	compression.LZ4:  3,
+}
+
 type header struct {
-	checksum uint32 //TODO
+	version   uint8
+	codec     compression.Method
+	encrypted bool
+
+	checksum uint32 // CRC32C of the messages as they are stored in the file
 
 	minLSN      dbutils.LSN
 	maxLSN      dbutils.LSN
@@ -19,7 +51,68 @@ type header struct {
 	messagesCnt uint32
 }
 
+// Header describes the delta file as recorded in its header
+type Header struct {
+	Version      uint8
+	Compression  compression.Method
+	Encrypted    bool
+	Checksum     uint32
+	MinLSN       dbutils.LSN
+	MaxLSN       dbutils.LSN
+	MinTime      time.Time
+	MaxTime      time.Time
+	MessageCount uint32
+}
+
+// ReadHeader reads the header of the delta file without loading the messages
+func ReadHeader(r io.Reader) (Header, error) {
+	var h header
+
+	if err := h.read(r); err != nil {
+		return Header{}, err
+	}
+
+	return h.export(), nil
+}
+
+// HasChecksum returns true if the file was written with the checksum of the messages
+func (h Header) HasChecksum() bool {
+	return h.Version > noChecksumHeaderVersion
+}
+
+func (h header) export() Header {
+	return Header{
+		Version:      h.version,
+		Compression:  h.codec,
+		Encrypted:    h.encrypted,
+		Checksum:     h.checksum,
+		MinLSN:       h.minLSN,
+		MaxLSN:       h.maxLSN,
+		MinTime:      h.minTime,
+		MaxTime:      h.maxTime,
+		MessageCount: h.messagesCnt,
+	}
+}
+
 func (h header) write(fp *os.File) error {
+	codecID, ok := codecIDs[h.codec]
+	if !ok {
+		return fmt.Errorf("unknown compression method: %q", h.codec)
+	}
+
+	if _, err := fp.Write(headerMagic); err != nil {
+		return fmt.Errorf("could not write magic: %v", err)
+	}
+
+	var flags uint8
+	if h.encrypted {
+		flags |= flagEncrypted
+	}
+
+	if _, err := fp.Write([]byte{headerVersion, codecID, flags}); err != nil {
+		return fmt.Errorf("could not write version: %v", err)
+	}
+
 	if err := writeUint32(fp, h.checksum); err != nil {
 		return fmt.Errorf("could not write checksum: %v", err)
 	}
@@ -47,35 +140,76 @@ func (h header) write(fp *os.File) error {
 	return nil
 }
 
-func (h *header) read(fp *os.File) error {
+func (h *header) read(r io.Reader) error {
 	buf := make([]byte, 8)
 
-	if _, err := fp.Read(buf[:4]); err != nil {
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
 		return fmt.Errorf("could not read from file: %v", err)
 	}
+
+	if bytes.Equal(buf[:4], headerMagic) {
+		if _, err := io.ReadFull(r, buf[:2]); err != nil {
+			return fmt.Errorf("could not read from file: %v", err)
+		}
+
+		h.version = buf[0]
+		if h.version > headerVersion {
+			return fmt.Errorf("unsupported delta file version: %d", h.version)
+		}
+
+		h.codec = ""
+		for method, id := range codecIDs {
+			if id == buf[1] {
+				h.codec = method
+			}
+		}
+		if h.codec == "" {
+			return fmt.Errorf("unknown compression method id: %d", buf[1])
+		}
+
+		h.encrypted = false
+		if h.version > noFlagsHeaderVersion {
+			if _, err := io.ReadFull(r, buf[:1]); err != nil {
+				return fmt.Errorf("could not read from file: %v", err)
+			}
+
+			if buf[0]&^flagEncrypted != 0 {
+				return fmt.Errorf("unknown flags: %08b", buf[0])
+			}
+			h.encrypted = buf[0]&flagEncrypted != 0
+		}
+
+		if _, err := io.ReadFull(r, buf[:4]); err != nil {
+			return fmt.Errorf("could not read from file: %v", err)
+		}
+	} else {
+		h.version = legacyHeaderVersion
+		h.codec = compression.None
+		h.encrypted = false
+	}
 	h.checksum = binary.BigEndian.Uint32(buf[:4])
 
-	if _, err := fp.Read(buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return fmt.Errorf("could not read from file: %v", err)
 	}
 	h.minLSN = dbutils.LSN(binary.BigEndian.Uint64(buf))
 
-	if _, err := fp.Read(buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return fmt.Errorf("could not read from file: %v", err)
 	}
 	h.maxLSN = dbutils.LSN(binary.BigEndian.Uint64(buf))
 
-	if _, err := fp.Read(buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return fmt.Errorf("could not read from file: %v", err)
 	}
 	h.minTime = time.Unix(int64(binary.BigEndian.Uint64(buf)), 0)
 
-	if _, err := fp.Read(buf); err != nil {
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return fmt.Errorf("could not read from file: %v", err)
 	}
 	h.maxTime = time.Unix(int64(binary.BigEndian.Uint64(buf)), 0)
 
-	if _, err := fp.Read(buf[:4]); err != nil {
+	if _, err := io.ReadFull(r, buf[:4]); err != nil {
 		return fmt.Errorf("could not read from file: %v", err)
 	}
 	h.messagesCnt = binary.BigEndian.Uint32(buf[:4])
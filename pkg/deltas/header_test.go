@@ -0,0 +1,68 @@
+package deltas
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
+)
+
+// deltaFile returns the delta file of the given header version holding a single begin message
+func deltaFile(version uint8, checksum func(body []byte) uint32) []byte {
+	msg := make([]byte, 21)
+	msg[0] = 'B'
+
+	body := &bytes.Buffer{}
+	binary.Write(body, binary.BigEndian, uint64(len(msg)+8))
+	body.Write(msg)
+
+	file := &bytes.Buffer{}
+	file.Write(headerMagic)
+	file.Write([]byte{version, codecIDs[compression.None]})
+	if version > noFlagsHeaderVersion {
+		file.WriteByte(0)
+	}
+	binary.Write(file, binary.BigEndian, checksum(body.Bytes()))
+	binary.Write(file, binary.BigEndian, []uint64{1, 1, 0, 0})
+	binary.Write(file, binary.BigEndian, uint32(1))
+	file.Write(body.Bytes())
+
+	return file.Bytes()
+}
+
+func TestLoadChecksum(t *testing.T) {
+	valid := func(body []byte) uint32 { return crc32.Checksum(body, crcTable) }
+	invalid := func(body []byte) uint32 { return valid(body) + 1 }
+	unset := func([]byte) uint32 { return 0 }
+
+	tests := []struct {
+		name      string
+		file      []byte
+		corrupted bool
+	}{
+		{"unset checksum of the version without checksums", deltaFile(noChecksumHeaderVersion, unset), false},
+		{"valid checksum", deltaFile(noFlagsHeaderVersion, valid), false},
+		{"invalid checksum", deltaFile(noFlagsHeaderVersion, invalid), true},
+		{"valid checksum of the current version", deltaFile(headerVersion, valid), false},
+		{"invalid checksum of the current version", deltaFile(headerVersion, invalid), true},
+	}
+
+	for _, tt := range tests {
+		d := New("", false, compression.Config{}, nil)
+
+		err := d.LoadFrom("test", bytes.NewReader(tt.file))
+		if _, corrupted := err.(CorruptedFileError); corrupted != tt.corrupted {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if tt.corrupted {
+			continue
+		}
+
+		if _, err := d.GetMessage(); err != nil {
+			t.Errorf("%s: could not read message: %v", tt.name, err)
+		}
+	}
+}
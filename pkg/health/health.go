@@ -0,0 +1,113 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/utils"
+)
+
+const (
+	statusOK      = "ok"
+	statusFailing = "failing"
+
+	defaultMessageTimeout     = 2 * time.Minute
+	defaultFlushTimeout       = time.Hour
+	defaultArchiverTimeout    = 15 * time.Minute
+	defaultBasebackupFailures = 3
+)
+
+// Config describes the thresholds of the health checks
+type Config struct {
+	MessageTimeout     utils.Duration `yaml:"messageTimeout"`     // no message or keepalive from the server for that long
+	FlushTimeout       utils.Duration `yaml:"flushTimeout"`       // flush lsn not advanced for that long while the wal moved
+	ArchiverTimeout    utils.Duration `yaml:"archiverTimeout"`    // archiver made no progress on the queued files for that long
+	BasebackupFailures int            `yaml:"basebackupFailures"` // basebackups failed in a row
+}
+
+// Validate checks the thresholds and sets the defaults
+func (c *Config) Validate() error {
+	if c.MessageTimeout < 0 || c.FlushTimeout < 0 || c.ArchiverTimeout < 0 || c.BasebackupFailures < 0 {
+		return fmt.Errorf("thresholds must not be negative")
+	}
+
+	if c.MessageTimeout == 0 {
+		c.MessageTimeout = utils.Duration(defaultMessageTimeout)
+	}
+
+	if c.FlushTimeout == 0 {
+		c.FlushTimeout = utils.Duration(defaultFlushTimeout)
+	}
+
+	if c.ArchiverTimeout == 0 {
+		c.ArchiverTimeout = utils.Duration(defaultArchiverTimeout)
+	}
+
+	if c.BasebackupFailures == 0 {
+		c.BasebackupFailures = defaultBasebackupFailures
+	}
+
+	return nil
+}
+
+// Check is the outcome of a single check
+type Check struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// Report is the outcome of all the checks, failing if any of them failed
+type Report struct {
+	Status string  `json:"status"`
+	Checks []Check `json:"checks"`
+}
+
+// NewReport instantiates the report with no checks
+func NewReport() *Report {
+	return &Report{
+		Status: statusOK,
+		Checks: make([]Check, 0),
+	}
+}
+
+// Add adds the outcome of the check
+func (r *Report) Add(name string, ok bool, format string, a ...interface{}) {
+	r.Checks = append(r.Checks, Check{
+		Name:    name,
+		OK:      ok,
+		Message: fmt.Sprintf(format, a...),
+	})
+
+	if !ok {
+		r.Status = statusFailing
+	}
+}
+
+// OK returns true if all the checks passed
+func (r *Report) OK() bool {
+	return r.Status == statusOK
+}
+
+// Handler serves the report as JSON, with 503 status code if the report is failing
+func Handler(report func() *Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rep := report()
+
+		status := http.StatusOK
+		if !rep.OK() {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+
+		if err := json.NewEncoder(w).Encode(rep); err != nil {
+			slog.Warn("could not write health report", "error", err)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package httpsrv
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	unixPrefix    = "unix:"
+	defaultListen = ":1999"
+
+	// how long the requests in progress are given to finish at shutdown
+	shutdownTimeout = 5 * time.Second
+)
+
+// Config describes the http server of the metrics, the admin api and the profiler
+type Config struct {
+	Listen      string `yaml:"listen"`      // host:port or unix:/path/to/socket
+	Pprof       bool   `yaml:"pprof"`       // serve /debug/pprof
+	CertFile    string `yaml:"certFile"`    // serve https if set together with the key file
+	KeyFile     string `yaml:"keyFile"`     // private key of the certificate
+	Username    string `yaml:"username"`    // basic auth user
+	Password    string `yaml:"password"`    // basic auth password
+	BearerToken string `yaml:"bearerToken"` // accepted in the Authorization: Bearer header
+}
+
+// Validate checks the settings and sets the defaults, prometheusPort is the listen port of the older versions
+func (c *Config) Validate(prometheusPort int) error {
+	if c.Listen == "" {
+		c.Listen = defaultListen
+		if prometheusPort != 0 {
+			c.Listen = fmt.Sprintf(":%d", prometheusPort)
+		}
+	}
+
+	if strings.HasPrefix(c.Listen, unixPrefix) {
+		if strings.TrimPrefix(c.Listen, unixPrefix) == "" {
+			return fmt.Errorf("socket path is not set")
+		}
+	} else if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address: %v", err)
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("certFile and keyFile must be set together")
+	}
+
+	if (c.Username == "") != (c.Password == "") {
+		return fmt.Errorf("username and password must be set together")
+	}
+
+	if c.Pprof && !c.AdminAllowed() {
+		return fmt.Errorf("pprof requires the credentials unless listening on the loopback address or a unix socket")
+	}
+
+	return nil
+}
+
+// Local returns true if the server is reachable from the local host only
+func (c Config) Local() bool {
+	if strings.HasPrefix(c.Listen, unixPrefix) {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+// Auth returns true if the credentials are configured
+func (c Config) Auth() bool {
+	return c.Username != "" || c.BearerToken != ""
+}
+
+// AdminAllowed returns true if the admin api and the profiler may be served: they are never exposed to the network
+// without the credentials
+func (c Config) AdminAllowed() bool {
+	return c.Auth() || c.Local()
+}
+
+// TLS returns true if the server serves https
+func (c Config) TLS() bool {
+	return c.CertFile != ""
+}
+
+// String implements Stringer
+func (c Config) String() string {
+	auth := make([]string, 0)
+	if c.Username != "" {
+		auth = append(auth, "basic")
+	}
+	if c.BearerToken != "" {
+		auth = append(auth, "bearer")
+	}
+	if len(auth) == 0 {
+		auth = append(auth, "none")
+	}
+
+	return fmt.Sprintf("%s tls: %t auth: %s pprof: %t", c.Listen, c.TLS(), strings.Join(auth, ","), c.Pprof)
+}
+
+// Authenticate returns the handler passing the request on only if it carries the configured credentials, all the
+// requests are passed on if no credentials are configured
+func (c Config) Authenticate(h http.Handler) http.Handler {
+	if !c.Auth() {
+		return h
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.authorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		if c.Username != "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="logical_backup"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+func (c Config) authorized(r *http.Request) bool {
+	if c.Username != "" {
+		if user, password, ok := r.BasicAuth(); ok {
+			return equal(user, c.Username) && equal(password, c.Password)
+		}
+	}
+
+	if c.BearerToken != "" {
+		if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			return equal(strings.TrimPrefix(header, "Bearer "), c.BearerToken)
+		}
+	}
+
+	return false
+}
+
+func equal(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Server serves the handler on the configured address
+type Server struct {
+	cfg Config
+	srv *http.Server
+}
+
+// New instantiates the server
+func New(cfg Config, handler http.Handler) *Server {
+	return &Server{
+		cfg: cfg,
+		srv: &http.Server{Handler: handler},
+	}
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	if !strings.HasPrefix(s.cfg.Listen, unixPrefix) {
+		return net.Listen("tcp", s.cfg.Listen)
+	}
+
+	// the socket left by the previous run, anything else at the path is not ours to remove
+	socket := strings.TrimPrefix(s.cfg.Listen, unixPrefix)
+	if fi, err := os.Stat(socket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", socket)
+		}
+		if err := os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("could not remove socket file: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not stat socket file: %v", err)
+	}
+
+	return net.Listen("unix", socket)
+}
+
+// Run starts listening and serves the requests until the context is done
+func (s *Server) Run(ctx context.Context, wg *sync.WaitGroup) error {
+	var certs []tls.Certificate
+
+	if s.cfg.TLS() {
+		cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	l, err := s.listen()
+	if err != nil {
+		return fmt.Errorf("could not listen on %s: %v", s.cfg.Listen, err)
+	}
+
+	if s.cfg.TLS() {
+		l = tls.NewListener(l, &tls.Config{Certificates: certs, MinVersion: tls.VersionTLS12})
+	}
+	slog.Info("http server listening", "address", s.cfg.Listen, "tls", s.cfg.TLS())
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			slog.Error("http server failed", "error", err)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := s.srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("could not shut down http server", "error", err)
+		}
+
+		slog.Info("http server shut down")
+	}()
+
+	return nil
+}
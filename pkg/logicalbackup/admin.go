@@ -0,0 +1,279 @@
+package logicalbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/slotmonitor"
+	"github.com/mkabilov/logical_backup/pkg/tablebackup"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
+)
+
+const adminPrefix = "/admin/"
+
+// tableStatus is the state of the table backup as shown by the admin api
+type tableStatus struct {
+	OID                      dbutils.OID `json:"oid"`
+	Name                     string      `json:"name"`
+	FlushLSN                 dbutils.LSN `json:"flushLSN"`
+	LatestCommitLSN          dbutils.LSN `json:"latestCommitLSN"`
+	MessagesProcessed        uint        `json:"messagesProcessed"` // since the last basebackup
+	LastProcessedMessageTime time.Time   `json:"lastProcessedMessageTime"`
+	LastBasebackupTime       time.Time   `json:"lastBasebackupTime"`
+	BasebackupPending        bool        `json:"basebackupPending"`
+}
+
+type basebackupStatus struct {
+	OID       dbutils.OID `json:"oid"`
+	Name      string      `json:"name"`
+	StartedAt *time.Time  `json:"startedAt,omitempty"`
+	QueuedAt  *time.Time  `json:"queuedAt,omitempty"`
+	Priority  int         `json:"priority,omitempty"`
+	Score     float64     `json:"score,omitempty"` // urgency according to basebackupQueue.order
+	Urgent    bool        `json:"urgent,omitempty"`
+}
+
+type lsnStatus struct {
+	FlushLSN  dbutils.LSN `json:"flushLSN"`  // confirmed to the replication slot
+	CommitLSN dbutils.LSN `json:"commitLSN"` // commit lsn of the latest received transaction
+	Paused    bool        `json:"paused"`
+
+	Slot *slotmonitor.Status `json:"slot,omitempty"` // as of the last poll of the replication slot
+}
+
+func newTableStatus(t tablebackup.TableBackuper) tableStatus {
+	return tableStatus{
+		OID:                      t.OID(),
+		Name:                     t.Name().String(),
+		FlushLSN:                 t.FlushLSN(),
+		LatestCommitLSN:          t.LatestCommitLSN(),
+		MessagesProcessed:        t.MessagesProcessed(),
+		LastProcessedMessageTime: t.LastProcessedMessageTime(),
+		LastBasebackupTime:       t.LastBasebackupTime(),
+		BasebackupPending:        t.BasebackupPending(),
+	}
+}
+
+// registerAdminHandlers adds the admin api:
+//
+//	GET  /admin/tables                     tables being backed up
+//	GET  /admin/tables/{table}             the table given by the oid or the name, i.e. public.foo
+//	POST /admin/tables/{table}/basebackup  queue the basebackup of the table, ?priority=N sets its priority in the
+//	                                       queue, ?urgent=true puts it first and ignores the windows
+//	POST /admin/tables/{table}/flush       write the buffered messages of the table to the delta file
+//	GET  /admin/basebackups                queued, deferred and in progress basebackups
+//	GET  /admin/lsn                        flush and commit lsn, state of the replication slot
+//	POST /admin/pause, /admin/resume       pause or resume the consumption of the replication messages
+func (b *logicalBackup) registerAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc(adminPrefix+"tables", b.handleTables)
+	mux.HandleFunc(adminPrefix+"tables/", b.handleTable)
+	mux.HandleFunc(adminPrefix+"basebackups", b.handleBasebackups)
+	mux.HandleFunc(adminPrefix+"lsn", b.handleLSN)
+	mux.HandleFunc(adminPrefix+"pause", b.handlePause)
+	mux.HandleFunc(adminPrefix+"resume", b.handleResume)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("could not write response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, a...)})
+}
+
+// allowMethod writes the error and returns false if the request method is not the given one
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	writeError(w, http.StatusMethodNotAllowed, "method %s is not allowed", r.Method)
+
+	return false
+}
+
+// findTable looks the table up by the oid or the name
+func (b *logicalBackup) findTable(id string) (tablebackup.TableBackuper, bool) {
+	if oid, err := strconv.ParseUint(id, 10, 32); err == nil {
+		return b.tables.Get(dbutils.OID(oid))
+	}
+
+	name := message.ParseNamespacedName(id)
+	var found tablebackup.TableBackuper
+	b.tables.Map(func(t tablebackup.TableBackuper) {
+		if t.Name() == name {
+			found = t
+		}
+	})
+
+	return found, found != nil
+}
+
+func (b *logicalBackup) handleTables(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	tables := make([]tableStatus, 0)
+	b.tables.Map(func(t tablebackup.TableBackuper) {
+		tables = append(tables, newTableStatus(t))
+	})
+	sort.Slice(tables, func(i, j int) bool { return tables[i].OID < tables[j].OID })
+
+	writeJSON(w, http.StatusOK, tables)
+}
+
+func (b *logicalBackup) handleTable(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, adminPrefix+"tables/"), "/")
+	if len(parts) > 2 || parts[0] == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	t, ok := b.findTable(parts[0])
+	if !ok {
+		writeError(w, http.StatusNotFound, "table %q is not backed up", parts[0])
+		return
+	}
+
+	if len(parts) == 1 {
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, newTableStatus(t))
+		}
+		return
+	}
+
+	switch parts[1] {
+	case "basebackup":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		urgent := r.URL.Query().Get("urgent") == "true"
+		priority, err := strconv.Atoi(r.URL.Query().Get("priority"))
+		if err != nil && r.URL.Query().Get("priority") != "" {
+			writeError(w, http.StatusBadRequest, "invalid priority: %v", err)
+			return
+		}
+
+		logger.Table(t.OID(), t).Info("queueing table for basebackup on the admin request", "urgent", urgent,
+			"priority", priority)
+		t.QueueBasebackup()
+
+		queued := true
+		if urgent {
+			queued = b.baseBackuper.Expedite(t.OID())
+		}
+		if queued && r.URL.Query().Get("priority") != "" {
+			queued = b.baseBackuper.SetPriority(t.OID(), priority)
+		}
+
+		if !queued {
+			writeError(w, http.StatusConflict, "table is not in the basebackup queue, its basebackup might be in progress")
+			return
+		}
+	case "flush":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		t.Flush()
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, newTableStatus(t))
+}
+
+func (b *logicalBackup) handleBasebackups(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	queued, deferred := make([]basebackupStatus, 0), make([]basebackupStatus, 0)
+	for _, t := range b.baseBackuper.Queued() {
+		queuedAt := t.QueuedAt
+		status := basebackupStatus{
+			OID:      t.Table.OID(),
+			Name:     t.Name.String(),
+			QueuedAt: &queuedAt,
+			Priority: t.Priority,
+			Score:    t.Score,
+			Urgent:   t.Urgent,
+		}
+
+		if t.Deferred {
+			deferred = append(deferred, status)
+		} else {
+			queued = append(queued, status)
+		}
+	}
+
+	inProgress := make([]basebackupStatus, 0)
+	for oid, startedAt := range b.baseBackuper.InProgress() {
+		startedAt := startedAt
+		status := basebackupStatus{OID: oid, StartedAt: &startedAt}
+		if t, ok := b.tables.Get(oid); ok {
+			status.Name = t.Name().String()
+		}
+
+		inProgress = append(inProgress, status)
+	}
+	sort.Slice(inProgress, func(i, j int) bool { return inProgress[i].StartedAt.Before(*inProgress[j].StartedAt) })
+
+	writeJSON(w, http.StatusOK, map[string][]basebackupStatus{
+		"queued":     queued,
+		"deferred":   deferred,
+		"inProgress": inProgress,
+	})
+}
+
+func (b *logicalBackup) lsnStatus() lsnStatus {
+	flushLSN, commitLSN := b.lsns()
+	status := lsnStatus{
+		FlushLSN:  flushLSN,
+		CommitLSN: commitLSN,
+		Paused:    b.consumer.Paused(),
+	}
+
+	if slot, ok := b.slotMonitor.Status(); ok {
+		status.Slot = &slot
+	}
+
+	return status
+}
+
+func (b *logicalBackup) handleLSN(w http.ResponseWriter, r *http.Request) {
+	if allowMethod(w, r, http.MethodGet) {
+		writeJSON(w, http.StatusOK, b.lsnStatus())
+	}
+}
+
+func (b *logicalBackup) handlePause(w http.ResponseWriter, r *http.Request) {
+	if allowMethod(w, r, http.MethodPost) {
+		b.consumer.Pause()
+		writeJSON(w, http.StatusOK, b.lsnStatus())
+	}
+}
+
+func (b *logicalBackup) handleResume(w http.ResponseWriter, r *http.Request) {
+	if allowMethod(w, r, http.MethodPost) {
+		b.consumer.Resume()
+		writeJSON(w, http.StatusOK, b.lsnStatus())
+	}
+}
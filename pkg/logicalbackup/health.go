@@ -0,0 +1,116 @@
+package logicalbackup
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/health"
+	"github.com/mkabilov/logical_backup/pkg/tablebackup"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+// pendingFlushLSN returns the minimum flush lsn among the tables with the messages waiting for the delta files, false
+// if there are no such tables. The idle tables saved everything they received, they do not count as stuck.
+func (b *logicalBackup) pendingFlushLSN() (dbutils.LSN, bool) {
+	lsn, pending := dbutils.InvalidLSN, false
+
+	b.tables.Map(func(t tablebackup.TableBackuper) {
+		if !t.HasPendingMessages() {
+			return
+		}
+
+		if flushLSN := t.FlushLSN(); !pending || flushLSN < lsn {
+			lsn = flushLSN
+		}
+		pending = true
+	})
+
+	return lsn, pending
+}
+
+// trackFlushProgress records the time and the server wal end when the tables with the pending messages saved some of
+// them or there were no pending messages at all
+func (b *logicalBackup) trackFlushProgress() {
+	lsn, pending := b.pendingFlushLSN()
+
+	b.healthMu.Lock()
+	defer b.healthMu.Unlock()
+
+	if pending && lsn <= b.pendingLSN && !b.flushAdvancedAt.IsZero() {
+		return
+	}
+
+	b.pendingLSN = lsn
+	b.flushAdvancedAt = time.Now()
+	if b.consumer != nil {
+		b.walEndAtFlush = b.consumer.Status().ServerWALEnd
+	}
+}
+
+func (b *logicalBackup) registerHealthHandlers(mux *http.ServeMux) {
+	mux.Handle("/healthz", health.Handler(b.healthReport))
+	mux.Handle("/readyz", health.Handler(b.readinessReport))
+}
+
+// healthReport checks that every part of the pipeline makes progress
+func (b *logicalBackup) healthReport() *health.Report {
+	cfg := b.cfg.Health
+	rep := health.NewReport()
+
+	status := b.consumer.Status()
+	paused := b.consumer.Paused()
+
+	rep.Add("consumer", status.Connected, "connected: %t", status.Connected)
+
+	switch {
+	case paused:
+		rep.Add("messages", true, "consumption is paused")
+	case status.LastMessage.IsZero():
+		rep.Add("messages", false, "no message or keepalive received yet")
+	default:
+		age := time.Since(status.LastMessage).Truncate(time.Second)
+		rep.Add("messages", age <= time.Duration(cfg.MessageTimeout), "last message or keepalive %v ago, limit %v",
+			age, cfg.MessageTimeout)
+	}
+
+	b.healthMu.Lock()
+	flushAge := time.Since(b.flushAdvancedAt).Truncate(time.Second)
+	walEndAtFlush := b.walEndAtFlush
+	b.healthMu.Unlock()
+
+	if pendingLSN, pending := b.pendingFlushLSN(); !pending {
+		rep.Add("flush", true, "no messages waiting for the delta files")
+	} else {
+		walMoved := status.ServerWALEnd > walEndAtFlush && status.ServerWALEnd > pendingLSN
+		rep.Add("flush", !walMoved || flushAge <= time.Duration(cfg.FlushTimeout),
+			"flush lsn of the tables with pending messages %s advanced %v ago, server wal end %s, limit %v",
+			pendingLSN, flushAge, status.ServerWALEnd, cfg.FlushTimeout)
+	}
+
+	stuck := make([]string, 0)
+	b.tables.Map(func(t tablebackup.TableBackuper) {
+		if s, ok := t.ArchiverStatus(); ok && !s.PendingSince.IsZero() && time.Since(s.PendingSince) > time.Duration(cfg.ArchiverTimeout) {
+			stuck = append(stuck, t.String())
+		}
+	})
+	rep.Add("archivers", len(stuck) == 0, "archivers without progress for more than %v: %v", cfg.ArchiverTimeout, stuck)
+
+	failures, err := b.baseBackuper.Failures()
+	if failures == 0 {
+		rep.Add("basebackups", true, "no failed basebackups")
+	} else {
+		rep.Add("basebackups", failures < cfg.BasebackupFailures, "%d basebackups failed in a row, limit %d: %v",
+			failures, cfg.BasebackupFailures, err)
+	}
+
+	return rep
+}
+
+// readinessReport is the health report, additionally failing while the consumption is paused
+func (b *logicalBackup) readinessReport() *health.Report {
+	rep := b.healthReport()
+	paused := b.consumer.Paused()
+	rep.Add("paused", !paused, "paused: %t", paused)
+
+	return rep
+}
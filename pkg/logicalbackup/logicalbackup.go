@@ -1,14 +1,14 @@
 package logicalbackup
 
 import (
+	"bufio"
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
@@ -16,24 +16,35 @@ import (
 	"github.com/jackc/pgx"
 
 	"github.com/mkabilov/logical_backup/pkg/basebackup"
+	"github.com/mkabilov/logical_backup/pkg/catalog"
+	"github.com/mkabilov/logical_backup/pkg/cdc"
 	"github.com/mkabilov/logical_backup/pkg/config"
 	"github.com/mkabilov/logical_backup/pkg/consumer"
+	"github.com/mkabilov/logical_backup/pkg/httpsrv"
 	"github.com/mkabilov/logical_backup/pkg/message"
 	prom "github.com/mkabilov/logical_backup/pkg/prometheus"
+	"github.com/mkabilov/logical_backup/pkg/sink"
+	"github.com/mkabilov/logical_backup/pkg/slotmonitor"
+	"github.com/mkabilov/logical_backup/pkg/storage"
 	"github.com/mkabilov/logical_backup/pkg/tablebackup"
 	"github.com/mkabilov/logical_backup/pkg/utils"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
 	"github.com/mkabilov/logical_backup/pkg/utils/namehistory"
 	"github.com/mkabilov/logical_backup/pkg/utils/tablesmap"
 )
 
 const (
 	//OidNameMapFile represents file name of the oid-to-name map file
-	OidNameMapFile = "oid2name.yaml"
+	OidNameMapFile = utils.OidNameMapFile
 
-	pgApplicationName = "logical_backup"
-	httpSrvPort       = 8080
-	httpSrvTimeout    = 20 * time.Second
+	//TableStateFile represents file name of the state file in the table directory
+	TableStateFile = utils.TableStateFile
+
+	pgApplicationName    = "logical_backup"
+	httpSrvTimeout       = 20 * time.Second
+	catalogFlushInterval = 10 * time.Second
+	cdcExportFileMode    = 0640
 )
 
 type logicalBackup struct {
@@ -47,18 +58,31 @@ type logicalBackup struct {
 	dbCfg pgx.ConnConfig
 
 	// auxiliary background workers
-	srv          http.Server
+	srv          *httpsrv.Server
 	baseBackuper basebackup.Basebackuper
 	consumer     consumer.Interface
+	slotMonitor  *slotmonitor.Monitor
+	archive      storage.Storage
 
 	tables               tablesmap.TablesMapInterface // list of tables to take care
 	nameHistory          namehistory.Interface        // table name history
+	catalog              catalog.Interface            // catalog of the archive
+	lsnMu                sync.Mutex                   // guards the lsns below, they are read by the http handlers
 	transactionCommitLSN dbutils.LSN                  // commit LSN of the latest observed transaction
 	latestFlushLSN       dbutils.LSN                  // latest LSN flushed to disk
 	beginTxLSN           dbutils.LSN
 	relationsPendingTx   map[dbutils.OID]struct{} // list of the relations with begin pending message
 	beginMsg             message.Begin
 	typeMsg              message.Type
+	cdcFile              *os.File      // file the change events are appended to
+	cdcWriter            *bufio.Writer // buffers the change events of the transaction, flushed on commit
+	cdcExporter          *cdc.Exporter // exporter of the change events, nil if not configured
+	sinks                *sink.Fanout  // destinations of the committed transactions, nil if not configured
+
+	healthMu        sync.Mutex
+	pendingLSN      dbutils.LSN // minimum flush lsn among the tables with the messages waiting for the delta files
+	flushAdvancedAt time.Time   // when the pending lsn advanced the last time or there were no pending messages
+	walEndAtFlush   dbutils.LSN // server wal end as of that time
 
 	prom prom.PromInterface
 }
@@ -74,22 +98,55 @@ func New(cfg *config.Config) (*logicalBackup, error) {
 		relationsPendingTx: make(map[dbutils.OID]struct{}),
 		waitGr:             &sync.WaitGroup{},
 		cfg:                cfg,
-		prom:               prom.New(cfg.PrometheusPort),
+		prom:               prom.New(),
 	}
-	lb.baseBackuper = basebackup.New(ctx, lb.tables, cfg)
-
-	lb.initHttpSrv(httpSrvPort)
-	lb.nameHistory = namehistory.New(lb.filePath(OidNameMapFile))
+	lb.initHttpSrv()
 
 	if err := utils.CreateDirs(cfg.StagingDir, cfg.ArchiveDir); err != nil {
 		return nil, err
 	}
 
+	archive, err := storage.New(cfg.ArchiveStorage, cfg.ArchiveDir, cfg.Fsync)
+	if err != nil {
+		return nil, fmt.Errorf("could not init archive storage: %v", err)
+	}
+	lb.archive = archive
+	lb.nameHistory = namehistory.New(archive, OidNameMapFile, cfg.Keyring)
+
+	cat := catalog.New(archive, cfg.Keyring)
+	if err := cat.Load(); err == storage.ErrNotExist {
+		slog.Info("no catalog found, building it from the archive")
+		if err := cat.Scan(); err != nil {
+			return nil, fmt.Errorf("could not build catalog: %v", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("could not load catalog: %v", err)
+	}
+	lb.catalog = cat
+	lb.baseBackuper = basebackup.New(ctx, lb.tables, cat, cfg, lb.prom)
+
+	if cfg.CDCExportFile != "" {
+		lb.cdcFile, err = os.OpenFile(cfg.CDCExportFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, cdcExportFileMode)
+		if err != nil {
+			return nil, fmt.Errorf("could not open cdc export file: %v", err)
+		}
+		lb.cdcWriter = bufio.NewWriter(lb.cdcFile)
+		lb.cdcExporter = cdc.New(lb.cdcWriter)
+	}
+
+	if len(cfg.Sinks) > 0 {
+		lb.sinks, err = sink.NewFanout(ctx, cfg.Sinks)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if err := lb.prepareDB(); err != nil {
 		return nil, err
 	}
 
 	lb.consumer = consumer.New(ctx, lb.errCh, cfg.DB, cfg.SlotName, cfg.PublicationName, lb.latestFlushLSN)
+	lb.slotMonitor = slotmonitor.New(ctx, cfg.SlotMonitor, lb.dbCfg, cfg.SlotName, lb.prom)
 
 	if err := lb.registerMetrics(); err != nil {
 		return nil, err
@@ -100,8 +157,12 @@ func New(cfg *config.Config) (*logicalBackup, error) {
 
 // Run runs logical backup
 func (b *logicalBackup) Run() error {
+	if err := b.srv.Run(b.ctx, b.waitGr); err != nil {
+		return fmt.Errorf("could not run http server: %v", err)
+	}
+
 	if b.cfg.InitialBasebackup {
-		log.Printf("Queueing all the tables for the initial backup")
+		slog.Info("queueing all the tables for the initial backup")
 		b.tables.Map(func(t tablebackup.TableBackuper) {
 			t.QueueBasebackup()
 		})
@@ -110,12 +171,17 @@ func (b *logicalBackup) Run() error {
 	if err := b.consumer.Run(b); err != nil {
 		return fmt.Errorf("could not run consumer: %v", err)
 	}
+	b.trackFlushProgress()
 
 	b.baseBackuper.Run(b.cfg.ConcurrentBasebackups)
-	b.runHttpSrv()
+	b.slotMonitor.Run(b.waitGr)
 
 	b.waitGr.Add(1)
-	go b.prom.Run(b.ctx, b.waitGr)
+	go b.flushCatalog()
+
+	if b.sinks != nil {
+		b.sinks.Run(b.waitGr)
+	}
 
 	b.waitForShutdown()
 	b.cancel()
@@ -127,9 +193,43 @@ func (b *logicalBackup) Run() error {
 	})
 	b.waitGr.Wait()
 
+	if err := b.catalog.Save(); err != nil {
+		slog.Error("could not save catalog", "error", err)
+	}
+
+	if b.cdcFile != nil {
+		if err := b.cdcWriter.Flush(); err != nil {
+			slog.Error("could not flush cdc export file", "error", err)
+		}
+
+		if err := b.cdcFile.Close(); err != nil {
+			slog.Error("could not close cdc export file", "error", err)
+		}
+	}
+
 	return nil
 }
 
+// flushCatalog saves the changes of the catalog periodically, off the replication path; the final save happens on
+// shutdown
+func (b *logicalBackup) flushCatalog() {
+	defer b.waitGr.Done()
+
+	ticker := time.NewTicker(catalogFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := b.catalog.Save(); err != nil {
+				slog.Error("could not save catalog", "error", err)
+			}
+		}
+	}
+}
+
 // prepareDB creates replication slot if necessary
 func (b *logicalBackup) prepareDB() error {
 	b.dbCfg = b.cfg.DB
@@ -141,12 +241,11 @@ func (b *logicalBackup) prepareDB() error {
 	}
 	defer func() {
 		if err := conn.Close(); err != nil {
-			log.Printf("could not close db connection: %v", err)
+			slog.Error("could not close db connection", "error", err)
 		}
 	}()
 
-	//TODO: switch to more sophisticated logger and display pid only if in debug mode
-	log.Printf("Pg backend session PID: %d", conn.PID())
+	slog.Debug("connected to the database", "pid", conn.PID())
 
 	if err := dbutils.CreateMissingPublication(conn, b.cfg.PublicationName); err != nil {
 		return err
@@ -159,13 +258,13 @@ func (b *logicalBackup) prepareDB() error {
 
 	if !b.latestFlushLSN.IsValid() { // invalid start LSN and no error from initSlot denotes a non-existing slot.
 		// TODO: this will discard all existing backup data, we should probably bail out if existing backup is there
-		log.Printf("Creating logical replication slot %s", b.cfg.SlotName)
+		slog.Info("creating logical replication slot", "slot", b.cfg.SlotName)
 
 		initialLSN, err := dbutils.CreateSlot(conn, b.ctx, b.cfg.SlotName)
 		if err != nil {
 			return fmt.Errorf("could not create replication slot: %v", err)
 		}
-		log.Printf("Created missing replication slot %q, consistent point %s", b.cfg.SlotName, initialLSN)
+		slog.Info("created missing replication slot", "slot", b.cfg.SlotName, logger.LSN, initialLSN)
 
 		// solve impedance mismatch between the flush LSN (the LSN we confirmed and flushed) and slot initial LSN
 		// (next, but not yet received LSN).
@@ -192,38 +291,44 @@ func (b *logicalBackup) readRestartLSN() (dbutils.LSN, error) {
 	return dbutils.InvalidLSN, nil
 }
 
-// flushLSN gets the minimum flush lsn among all the tables
+// flushLSN gets the minimum flush lsn among all the tables. It is invalid while some table has the messages waiting for
+// the delta file without having saved anything before: the slot must not be confirmed past those messages.
 func (b *logicalBackup) flushLSN() dbutils.LSN {
 	lsn := dbutils.InvalidLSN
+	blocked := false
 
 	b.tables.Map(func(t tablebackup.TableBackuper) {
-		if flushLSN := t.FlushLSN(); flushLSN.IsValid() {
-			if !lsn.IsValid() || flushLSN < lsn {
-				lsn = flushLSN
-			}
+		flushLSN := t.FlushLSN()
+		if !flushLSN.IsValid() {
+			blocked = blocked || t.HasPendingMessages()
+			return
+		}
+
+		if !lsn.IsValid() || flushLSN < lsn {
+			lsn = flushLSN
 		}
 	})
 
+	if blocked {
+		return dbutils.InvalidLSN
+	}
+
 	return lsn
 }
 
-func (b *logicalBackup) filePath(parts ...string) string {
-	var path string
-
-	if b.cfg.StagingDir != "" {
-		path = b.cfg.StagingDir
+//HandleMessage processes the incoming logical replication message
+func (b *logicalBackup) HandleMessage(msg message.Message, walStart dbutils.LSN) error {
+	// the transactions not confirmed to the slot are streamed again after the restart, hence the events might repeat
+	if b.cdcExporter != nil {
+		b.exportChange(msg)
 	}
-	path = b.cfg.ArchiveDir
 
-	for _, part := range parts {
-		path = filepath.Join(path, part)
+	if b.sinks != nil {
+		if err := b.sinks.HandleMessage(msg); err != nil {
+			return fmt.Errorf("could not pass change to sinks: %v", err)
+		}
 	}
 
-	return path
-}
-
-//HandleMessage processes the incoming logical replication message
-func (b *logicalBackup) HandleMessage(msg message.Message, walStart dbutils.LSN) error {
 	switch v := msg.(type) {
 	case message.Relation:
 		return b.processRelationMessage(v)
@@ -237,7 +342,6 @@ func (b *logicalBackup) HandleMessage(msg message.Message, walStart dbutils.LSN)
 		b.beginTxLSN = walStart
 		return b.processBeginMessage(v)
 	case message.Commit:
-		b.transactionCommitLSN = v.LSN
 		return b.processCommitMessage(v)
 	case message.Origin:
 		return b.processOriginMessage(v)
@@ -250,6 +354,21 @@ func (b *logicalBackup) HandleMessage(msg message.Message, walStart dbutils.LSN)
 	}
 }
 
+// exportChange writes the change event of the message to the cdc export file, the failures do not stop the backup
+func (b *logicalBackup) exportChange(msg message.Message) {
+	if err := b.cdcExporter.HandleMessage(msg); err != nil {
+		slog.Error("could not export change", "error", err)
+	}
+
+	if _, ok := msg.(message.Commit); !ok {
+		return
+	}
+
+	if err := b.cdcWriter.Flush(); err != nil {
+		slog.Error("could not flush cdc export file", "error", err)
+	}
+}
+
 func (b *logicalBackup) writeTableDMLMessage(relOID dbutils.OID, msg message.Message) error {
 	tb, ok := b.tables.Get(relOID)
 	if !ok {
@@ -270,7 +389,7 @@ func (b *logicalBackup) writeTableDMLMessage(relOID dbutils.OID, msg message.Mes
 	}
 
 	if err := b.updateMetricsAfterWriteDelta(tb, msg.MsgType(), uint(len(msg.RawData()))); err != nil {
-		log.Printf("could not update metrics for %s table: %v", tb, err)
+		logger.Table(tb.OID(), tb).Warn("could not update metrics", "error", err)
 	}
 
 	return nil
@@ -290,7 +409,7 @@ func (b *logicalBackup) processDeleteMessage(msg message.Delete) error {
 
 func (b *logicalBackup) processRelationMessage(msg message.Relation) error {
 	if tb, isRegistered := b.tables.Get(msg.OID); isRegistered {
-		b.nameHistory.SetName(tb.OID(), b.beginTxLSN, msg.NamespacedName)
+		b.setTableName(tb.OID(), b.beginTxLSN, msg.NamespacedName)
 		tb.SetName(msg.NamespacedName)
 		return nil
 	}
@@ -334,18 +453,43 @@ func (b *logicalBackup) processBeginMessage(msg message.Begin) error {
 	return nil
 }
 
-// AdvanceLSN checks if we need to advance lsn
+// AdvanceLSN checks if we need to advance lsn, the slot is never advanced past the transactions not delivered to the sinks
 func (b *logicalBackup) AdvanceLSN() {
-	if candidateFlushLSN := b.flushLSN(); candidateFlushLSN > b.latestFlushLSN {
+	// the table backups advance the lsn concurrently once they have saved the delta files
+	b.lsnMu.Lock()
+	defer b.lsnMu.Unlock()
+
+	b.trackFlushProgress()
+
+	candidateFlushLSN := b.flushLSN()
+	if b.sinks != nil {
+		candidateFlushLSN = b.sinks.ConfirmableLSN(candidateFlushLSN)
+	}
+
+	if candidateFlushLSN > b.latestFlushLSN {
 		b.latestFlushLSN = candidateFlushLSN
 		b.consumer.AdvanceLSN(b.latestFlushLSN)
 
 		if err := b.consumer.SendStatus(); err != nil {
-			log.Printf("could not send replay progress: %v", err)
+			slog.Error("could not send replay progress", "error", err)
 		}
 	}
 }
 
+// lsns returns the flush lsn confirmed to the slot and the commit lsn of the latest received transaction
+func (b *logicalBackup) lsns() (dbutils.LSN, dbutils.LSN) {
+	b.lsnMu.Lock()
+	defer b.lsnMu.Unlock()
+
+	return b.latestFlushLSN, b.transactionCommitLSN
+}
+
+// setTableName records the name of the table in the name history and the catalog
+func (b *logicalBackup) setTableName(oid dbutils.OID, lsn dbutils.LSN, name message.NamespacedName) {
+	b.nameHistory.SetName(oid, lsn, name)
+	b.catalog.SetName(oid, lsn, name)
+}
+
 // QueueTable queues the basebackup of the table
 func (b *logicalBackup) QueueTable(t tablebackup.TableBackuper) {
 	b.baseBackuper.QueueTable(t)
@@ -366,15 +510,26 @@ func (b *logicalBackup) processCommitMessage(msg message.Commit) error {
 		}
 	}
 
+	// the transaction counts as received once all of its tables got the commit
+	b.lsnMu.Lock()
+	b.transactionCommitLSN = msg.LSN
+	b.lsnMu.Unlock()
+
 	// if there were any changes in the table names, flush the map file
 	if err := b.nameHistory.Save(); err != nil {
-		log.Printf("could not flush the oid to map file: %v", err)
+		slog.Error("could not flush the oid to map file", "error", err)
+	}
+
+	if b.sinks != nil {
+		if err := b.sinks.Commit(); err != nil {
+			return fmt.Errorf("could not queue transaction to sinks: %v", err)
+		}
 	}
 
 	b.AdvanceLSN()
 
 	if err := b.updateMetricsCommit(b.transactionCommitLSN, msg.Timestamp); err != nil {
-		log.Printf("could not update metrics: %v", err)
+		slog.Warn("could not update metrics", "error", err)
 	}
 
 	return nil
@@ -387,12 +542,11 @@ func (b *logicalBackup) registerNewTable(msg message.Relation) (bool, error) {
 	)
 
 	if !b.cfg.TrackNewTables {
-		log.Printf("skip the table with oid %d and name %v because we are configured not to track new tables",
-			msg.OID, msg.NamespacedName)
+		logger.Table(msg.OID, msg.NamespacedName).Info("skip the table because we are configured not to track new tables")
 		return false, nil
 	}
 
-	tb, err = tablebackup.New(b.ctx, msg.NamespacedName, msg.OID, b, b.cfg, b.prom)
+	tb, err = tablebackup.New(b.ctx, msg.NamespacedName, msg.OID, b, b.cfg, b.archive, b.catalog, b.prom)
 	if err != nil {
 		return false, err
 	}
@@ -402,8 +556,8 @@ func (b *logicalBackup) registerNewTable(msg message.Relation) (bool, error) {
 	}
 
 	b.tables.Set(msg.OID, tb)
-	b.nameHistory.SetName(msg.OID, b.beginTxLSN, msg.NamespacedName)
-	log.Printf("registered new table with oid %d and name %s", msg.OID, msg.NamespacedName.Sanitize())
+	b.setTableName(msg.OID, b.beginTxLSN, msg.NamespacedName)
+	logger.Table(msg.OID, msg.NamespacedName).Info("registered new table", logger.LSN, b.beginTxLSN)
 
 	return true, nil
 }
@@ -470,12 +624,12 @@ func (b *logicalBackup) prepareTablesForPublication(conn *pgx.Conn) error {
 				return fmt.Errorf("could not set replica identity to %s for %s table: %v", targetReplicaIdentity, fqtn, err)
 			}
 
-			log.Printf("set replica identity to %s for %s table", targetReplicaIdentity, fqtn)
+			logger.Table(t.oid, t.name).Info("set replica identity", "replicaIdentity", targetReplicaIdentity)
 		}
 	}
 
 	for _, t := range tables {
-		tb, err := tablebackup.New(b.ctx, t.name, t.oid, b, b.cfg, b.prom)
+		tb, err := tablebackup.New(b.ctx, t.name, t.oid, b, b.cfg, b.archive, b.catalog, b.prom)
 		if err != nil {
 			return fmt.Errorf("could not create tablebackup instance: %v", err)
 		}
@@ -485,12 +639,16 @@ func (b *logicalBackup) prepareTablesForPublication(conn *pgx.Conn) error {
 		}
 
 		b.tables.Set(t.oid, tb)
-		b.nameHistory.SetName(t.oid, b.latestFlushLSN, tb.NamespacedName)
+		b.setTableName(t.oid, b.latestFlushLSN, tb.Name())
 	}
 
 	// flush the OID to name mapping
 	if err := b.nameHistory.Save(); err != nil {
-		log.Printf("could not flush oid name map: %v", err)
+		slog.Error("could not flush oid name map", "error", err)
+	}
+
+	if err := b.catalog.Save(); err != nil {
+		slog.Error("could not save catalog", "error", err)
 	}
 
 	return nil
@@ -516,51 +674,37 @@ loop:
 			case syscall.SIGHUP:
 				//TODO: reload the config?
 			default:
-				log.Printf("unhandled signal: %v", sig)
+				slog.Warn("unhandled signal", "signal", sig)
 			}
 		case err := <-b.errCh:
-			log.Printf("failed: %v", err)
+			slog.Error("failed", "error", err)
 			break loop
 		}
 	}
 }
 
-func (b *logicalBackup) initHttpSrv(port int) {
+func (b *logicalBackup) initHttpSrv() {
+	// everything but the health checks requires the credentials if configured
 	mux := http.NewServeMux()
+	b.registerHealthHandlers(mux)
 
-	mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
-	mux.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
-	mux.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
-	mux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
-	mux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
-
-	b.srv = http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.TimeoutHandler(mux, httpSrvTimeout, ""),
+	protected := http.NewServeMux()
+	protected.Handle("/metrics", b.prom.Handler())
+	if b.cfg.HTTP.AdminAllowed() {
+		b.registerAdminHandlers(protected)
+	} else {
+		slog.Warn("admin api disabled: it requires the credentials unless listening on the loopback address or a unix socket",
+			"address", b.cfg.HTTP.Listen)
 	}
-}
 
-func (b *logicalBackup) runHttpSrv() {
-	b.waitGr.Add(1)
-	go func() {
-		defer b.waitGr.Done()
-
-		if err := b.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("could not start http server %v", err)
-		}
-		return
-	}()
-
-	// XXX: hack to make sure the http server is aware of the context being closed.
-	b.waitGr.Add(1)
-	go func() {
-		defer b.waitGr.Done()
-
-		<-b.ctx.Done()
-		if err := b.srv.Close(); err != nil {
-			log.Printf("could not close http server: %v", err)
-		}
+	if b.cfg.HTTP.Pprof {
+		protected.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
+		protected.Handle("/debug/pprof/cmdline", http.HandlerFunc(pprof.Cmdline))
+		protected.Handle("/debug/pprof/profile", http.HandlerFunc(pprof.Profile))
+		protected.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
+		protected.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
+	}
+	mux.Handle("/", b.cfg.HTTP.Authenticate(protected))
 
-		log.Printf("debug http server shut down")
-	}()
+	b.srv = httpsrv.New(b.cfg.HTTP, http.TimeoutHandler(mux, httpSrvTimeout, ""))
 }
@@ -0,0 +1,60 @@
+package logicalbackup
+
+import (
+	"testing"
+
+	"github.com/mkabilov/logical_backup/pkg/tablebackup"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/tablesmap"
+)
+
+// fakeTable is the table backup with the given flush lsn and the messages waiting for the delta file
+type fakeTable struct {
+	tablebackup.TableBackuper
+
+	flushLSN dbutils.LSN
+	pending  bool
+}
+
+func (t *fakeTable) FlushLSN() dbutils.LSN    { return t.flushLSN }
+func (t *fakeTable) HasPendingMessages() bool { return t.pending }
+
+func TestFlushLSN(t *testing.T) {
+	tests := []struct {
+		name   string
+		tables []*fakeTable
+		want   dbutils.LSN
+	}{
+		{"no tables", nil, dbutils.InvalidLSN},
+		{"idle saved tables", []*fakeTable{{flushLSN: 0x2000}, {flushLSN: 0x1000}}, 0x1000},
+		{"new table without messages", []*fakeTable{{flushLSN: 0x2000}, {}}, 0x2000},
+		{"new table with pending messages next to an idle saved table",
+			[]*fakeTable{{flushLSN: 0x2000}, {pending: true}}, dbutils.InvalidLSN},
+		{"saved table with pending messages", []*fakeTable{{flushLSN: 0x2000}, {flushLSN: 0x1800, pending: true}}, 0x1800},
+	}
+
+	for _, tt := range tests {
+		b := &logicalBackup{tables: tablesmap.New()}
+		for i, table := range tt.tables {
+			b.tables.Set(dbutils.OID(16384+i), table)
+		}
+
+		if lsn := b.flushLSN(); lsn != tt.want {
+			t.Errorf("%s: expected flush lsn %s, got %s", tt.name, tt.want, lsn)
+		}
+	}
+}
+
+func TestPendingFlushLSN(t *testing.T) {
+	b := &logicalBackup{tables: tablesmap.New()}
+	b.tables.Set(16384, &fakeTable{flushLSN: 0x1000})
+
+	if lsn, pending := b.pendingFlushLSN(); pending {
+		t.Errorf("expected the idle table not to count, got %s", lsn)
+	}
+
+	b.tables.Set(16385, &fakeTable{flushLSN: 0x2000, pending: true})
+	if lsn, pending := b.pendingFlushLSN(); !pending || lsn != 0x2000 {
+		t.Errorf("expected the flush lsn of the table with pending messages, got %s, %t", lsn, pending)
+	}
+}
@@ -102,6 +102,102 @@ func (b *logicalBackup) registerMetrics() error {
 			[]string{prom.TableOIDLabel, prom.TableNameLabel},
 			prom.MetricsGaugeVector,
 		},
+		{
+			prom.SlotActiveGauge,
+			"1 if the replication slot is in use",
+			nil,
+			prom.MetricsGauge,
+		},
+		{
+			prom.SlotLagBytesGauge,
+			"bytes of wal between the current wal lsn and the confirmed flush lsn of the slot",
+			nil,
+			prom.MetricsGauge,
+		},
+		{
+			prom.SlotRetainedBytesGauge,
+			"bytes of wal retained on the server by the restart lsn of the slot",
+			nil,
+			prom.MetricsGauge,
+		},
+		{
+			prom.SlotSafeWALSizeGauge,
+			"bytes of wal that can be written before the slot is in danger of losing wal, -1 if unlimited (PostgreSQL 13+)",
+			nil,
+			prom.MetricsGauge,
+		},
+		{
+			prom.SlotWALStatusGauge,
+			"1 for the current wal status of the slot (PostgreSQL 13+)",
+			[]string{prom.WALStatusLabel},
+			prom.MetricsGaugeVector,
+		},
+		{
+			prom.ServerWALLSNGauge,
+			"current wal lsn of the server",
+			nil,
+			prom.MetricsGauge,
+		},
+		{
+			prom.BasebackupDurationHistogram,
+			"duration of the basebackups",
+			nil,
+			prom.MetricsHistogram,
+		},
+		{
+			prom.BasebackupQueueGauge,
+			"number of tables queued for the basebackup",
+			nil,
+			prom.MetricsGauge,
+		},
+		{
+			prom.BasebackupDeferredGauge,
+			"number of tables waiting for the basebackup window",
+			nil,
+			prom.MetricsGauge,
+		},
+		{
+			prom.BasebackupInProgressGauge,
+			"number of basebackups in progress",
+			nil,
+			prom.MetricsGauge,
+		},
+		{
+			prom.BasebackupFailuresCounter,
+			"number of failed basebackups per reason",
+			[]string{prom.ReasonLabel},
+			prom.MetricsCounterVector,
+		},
+		{
+			prom.PerTableBasebackupSizeGauge,
+			"per table size of the last basebackup as stored",
+			[]string{prom.TableOIDLabel, prom.TableNameLabel},
+			prom.MetricsGaugeVector,
+		},
+		{
+			prom.PerTableBasebackupDurationGauge,
+			"per table duration of the last basebackup",
+			[]string{prom.TableOIDLabel, prom.TableNameLabel},
+			prom.MetricsGaugeVector,
+		},
+		{
+			prom.PerTableArchiverQueueGauge,
+			"per table number of files waiting to be archived",
+			[]string{prom.TableOIDLabel, prom.TableNameLabel},
+			prom.MetricsGaugeVector,
+		},
+		{
+			prom.ArchiveCopyDurationHistogram,
+			"time to copy the file to the archive",
+			nil,
+			prom.MetricsHistogram,
+		},
+		{
+			prom.DeltaFileSizeHistogram,
+			"size of the delta files written",
+			nil,
+			prom.MetricsHistogram,
+		},
 	}
 	for _, m := range registerMetrics {
 		if err := b.prom.RegisterMetricsItem(&m); err != nil {
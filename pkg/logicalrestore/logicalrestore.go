@@ -4,54 +4,80 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
-	"os"
+	"log/slog"
 	"path"
 	"sort"
+	"sync"
 
 	"github.com/jackc/pgx"
-	"gopkg.in/yaml.v2"
 
-	"github.com/mkabilov/logical_backup/pkg/basebackup/bbtable"
+	"github.com/mkabilov/logical_backup/pkg/basebackup/generations"
+	"github.com/mkabilov/logical_backup/pkg/catalog"
 	"github.com/mkabilov/logical_backup/pkg/deltas"
 	"github.com/mkabilov/logical_backup/pkg/logicalbackup"
 	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
 	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
 	"github.com/mkabilov/logical_backup/pkg/utils/deltafiles"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
 	"github.com/mkabilov/logical_backup/pkg/utils/namehistory"
 )
 
 type logicalRestore struct {
 	message.NamespacedName
 
-	curLSN   dbutils.LSN
-	startLSN dbutils.LSN
-	relInfo  message.Relation
+	curLSN    dbutils.LSN
+	startLSN  dbutils.LSN
+	targetLSN dbutils.LSN // restore up to this lsn, the latest state if invalid
+	genDir    string      // directory of the basebackup generation being restored
+	relInfo   message.Relation
+	tableDef  *message.TableDefinition
+	chunks    []string
+	codec     compression.Method
+	keyID     string // id of the key the dump is encrypted with
+	keyring   *encryption.Keyring
 
 	conn *pgx.Conn
 	tx   *pgx.Tx
 	cfg  pgx.ConnConfig
 	ctx  context.Context
 
-	baseDir  string
+	archive  storage.Storage
 	tableOID dbutils.OID
 
-	truncate bool
+	truncate     bool
+	createTable  bool
+	tableCreated bool
+	jobs         int
 }
 
 // New instantiates logical restore
-func New(ctx context.Context, tbl message.NamespacedName, dir string, truncate bool, cfg pgx.ConnConfig) *logicalRestore {
+func New(ctx context.Context, tbl message.NamespacedName, archive storage.Storage, targetLSN dbutils.LSN,
+	truncate, createTable bool, jobs int, keyring *encryption.Keyring, cfg pgx.ConnConfig) *logicalRestore {
+	if jobs < 1 {
+		jobs = 1
+	}
+
 	return &logicalRestore{
 		ctx:            ctx,
-		baseDir:        dir,
+		archive:        archive,
+		targetLSN:      targetLSN,
 		cfg:            cfg,
 		NamespacedName: tbl,
 		truncate:       truncate,
+		createTable:    createTable,
+		jobs:           jobs,
+		keyring:        keyring,
 	}
 }
 
+func (r *logicalRestore) log() *slog.Logger {
+	return logger.Table(r.tableOID, r.NamespacedName)
+}
+
 func (r *logicalRestore) connect() error {
 	conn, err := pgx.Connect(r.cfg)
 	if err != nil {
@@ -111,50 +137,65 @@ func (r *logicalRestore) rollback() error {
 	return nil
 }
 
+// loadInfo loads the info of the latest basebackup generation starting before the target lsn
 func (r *logicalRestore) loadInfo() error {
-	var info message.DumpInfo
-
-	infoFilename := path.Join(r.baseDir, utils.TableDir(r.tableOID), bbtable.BasebackupInfoFilename)
-
-	fp, err := os.OpenFile(infoFilename, os.O_RDONLY, os.ModePerm)
+	gens, err := generations.List(r.archive, utils.TableDir(r.tableOID))
 	if err != nil {
-		return fmt.Errorf("could not open file: %v", err)
+		return err
 	}
-	defer fp.Close()
 
-	if err := yaml.NewDecoder(fp).Decode(&info); err != nil {
+	gen, ok := generations.Covering(gens, r.targetLSN)
+	if !ok {
+		return fmt.Errorf("no basebackup found prior to the lsn %s", r.targetLSN)
+	}
+	r.genDir = gen.Dir
+
+	info, err := gen.LoadInfo(r.archive)
+	if err != nil {
 		return fmt.Errorf("could not load dump info: %v", err)
 	}
 
 	r.relInfo = info.Relation
+	r.tableDef = info.Definition
+	r.chunks = info.Chunks
+	r.codec = info.Compression
+	r.keyID = info.EncryptionKey
 	r.startLSN = info.StartLSN
 
 	return nil
 }
 
 func (r *logicalRestore) loadDump() error {
-	dumpFilename := path.Join(r.baseDir, utils.TableDir(r.tableOID), bbtable.BasebackupFilename)
+	if len(r.chunks) > 0 {
+		return r.loadChunks()
+	}
 
-	if _, err := os.Stat(dumpFilename); os.IsNotExist(err) {
-		log.Printf("dump file doesn't exist, skipping")
+	dumpFilename := path.Join(r.genDir, generations.DumpFilename)
+
+	fp, err := r.archive.Get(dumpFilename)
+	if err == storage.ErrNotExist {
+		r.log().Info("dump file doesn't exist, skipping")
 
 		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
 	}
+	defer fp.Close()
 
 	if err := r.begin(); err != nil {
 		return err
 	}
 
-	fp, err := os.OpenFile(dumpFilename, os.O_RDONLY, os.ModePerm)
+	dump, err := r.dumpReader(fp)
 	if err != nil {
-		return fmt.Errorf("could not open file: %v", err)
+		return err
 	}
-	defer fp.Close()
+	defer dump.Close()
 
-	if err := r.conn.CopyFromReader(fp, fmt.Sprintf("copy %s from stdin", r.Sanitize())); err != nil {
+	if err := r.conn.CopyFromReader(dump, fmt.Sprintf("copy %s from stdin", r.Sanitize())); err != nil {
 		return fmt.Errorf("could not copy: %v", err)
 	} else {
-		log.Printf("initial dump loaded")
+		r.log().Info("initial dump loaded")
 	}
 
 	if err := r.commit(); err != nil {
@@ -164,17 +205,161 @@ func (r *logicalRestore) loadDump() error {
 	return nil
 }
 
+// loadChunks loads the dump chunk files. The chunks are loaded in parallel into the empty table only, which is
+// truncated if any of the chunks fails to load, otherwise they are loaded one by one in a single transaction.
+func (r *logicalRestore) loadChunks() error {
+	var empty bool
+
+	if err := r.conn.QueryRow(fmt.Sprintf("select not exists(select 1 from %s)", r.Sanitize())).Scan(&empty); err != nil {
+		return fmt.Errorf("could not check if table is empty: %v", err)
+	}
+
+	if r.jobs == 1 || !empty {
+		return r.loadChunksInTx()
+	}
+
+	if err := r.loadChunksInParallel(); err != nil {
+		if err := r.truncateTable(); err != nil {
+			r.log().Error("could not truncate partially loaded table", "error", err)
+		}
+
+		return err
+	}
+	r.log().Info("initial dump loaded", "chunks", len(r.chunks), "jobs", r.jobs)
+
+	return nil
+}
+
+// loadChunksInTx loads the dump chunk files one by one within a single transaction
+func (r *logicalRestore) loadChunksInTx() error {
+	if err := r.begin(); err != nil {
+		return err
+	}
+
+	for _, filename := range r.chunks {
+		filename = path.Join(r.genDir, filename)
+		if err := r.loadChunk(r.conn, filename); err != nil {
+			r.rollback()
+			return fmt.Errorf("could not load %q: %v", filename, err)
+		}
+	}
+
+	if err := r.commit(); err != nil {
+		return err
+	}
+	r.log().Info("initial dump loaded", "chunks", len(r.chunks))
+
+	return nil
+}
+
+func (r *logicalRestore) loadChunksInParallel() error {
+	filenames := make(chan string, len(r.chunks))
+	for _, filename := range r.chunks {
+		filenames <- path.Join(r.genDir, filename)
+	}
+	close(filenames)
+
+	errCh := make(chan error, r.jobs)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < r.jobs && i < len(r.chunks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := r.chunkLoader(filenames); err != nil {
+				errCh <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		return err
+	}
+
+	return nil
+}
+
+func (r *logicalRestore) chunkLoader(filenames <-chan string) error {
+	conn, err := pgx.Connect(r.cfg)
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", err)
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			r.log().Error("could not close db connection", "error", err)
+		}
+	}()
+
+	for filename := range filenames {
+		if err := r.loadChunk(conn, filename); err != nil {
+			return fmt.Errorf("could not load %q: %v", filename, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *logicalRestore) loadChunk(conn *pgx.Conn, filename string) error {
+	fp, err := r.archive.Get(filename)
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	chunk, err := r.dumpReader(fp)
+	if err != nil {
+		return err
+	}
+	defer chunk.Close()
+
+	if err := conn.CopyFromReader(chunk, fmt.Sprintf("copy %s from stdin", r.Sanitize())); err != nil {
+		return fmt.Errorf("could not copy: %v", err)
+	}
+
+	return nil
+}
+
+// dumpReader returns reader of the dump file contents, decrypting and decompressing them if needed
+func (r *logicalRestore) dumpReader(fp io.Reader) (io.ReadCloser, error) {
+	var dump io.Reader = fp
+
+	if r.keyID != "" {
+		decrypted, err := r.keyring.NewReader(fp)
+		if err != nil {
+			return nil, fmt.Errorf("could not init decryption: %v", err)
+		}
+		dump = decrypted
+	}
+
+	decompressed, err := compression.NewReader(r.codec, dump)
+	if err != nil {
+		return nil, fmt.Errorf("could not init decompression: %v", err)
+	}
+
+	return decompressed, nil
+}
+
 func (r *logicalRestore) applySegmentFile(filename string) error {
-	deltaCollector := deltas.New(path.Join(r.baseDir, utils.TableDir(r.tableOID)), false)
-	if err := deltaCollector.Load(filename); err != nil {
+	fp, err := r.archive.Get(path.Join(utils.TableDir(r.tableOID), deltas.DirName, filename))
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
+	}
+	defer fp.Close()
+
+	deltaCollector := deltas.New("", false, compression.Config{}, r.keyring)
+	if err := deltaCollector.LoadFrom(filename, fp); err != nil {
 		return fmt.Errorf("could not load file: %v", err)
 	}
 
-	log.Printf("messages in the file: %v", deltaCollector.MessageCnt())
+	r.log().Debug("messages in the file", "file", filename, "messages", deltaCollector.MessageCnt())
 	for {
 		msg, err := deltaCollector.GetMessage()
 		if err == io.EOF {
 			break
+		} else if err != nil {
+			return err
 		}
 
 		if _, err := r.applyMessage(msg); err != nil {
@@ -199,7 +384,7 @@ func (r *logicalRestore) execSQL(sql string) error {
 
 func (r *logicalRestore) applyMessage(msg message.Message) (sql string, err error) {
 	if _, ok := msg.(message.Begin); !ok {
-		if r.curLSN.IsValid() && r.curLSN <= r.startLSN {
+		if r.curLSN.IsValid() && (r.curLSN <= r.startLSN || r.pastTarget()) {
 			return
 		}
 	}
@@ -207,7 +392,7 @@ func (r *logicalRestore) applyMessage(msg message.Message) (sql string, err erro
 	switch v := msg.(type) {
 	case message.Begin:
 		r.curLSN = v.FinalLSN
-		if r.curLSN <= r.startLSN {
+		if r.curLSN <= r.startLSN || r.pastTarget() {
 			return
 		}
 
@@ -243,28 +428,46 @@ func (r *logicalRestore) applyMessage(msg message.Message) (sql string, err erro
 	return
 }
 
+// pastTarget returns true if the current transaction commits after the target lsn
+func (r *logicalRestore) pastTarget() bool {
+	return r.targetLSN.IsValid() && r.curLSN > r.targetLSN
+}
+
 func (r *logicalRestore) applyDeltas() error {
-	deltaDir := path.Join(r.baseDir, utils.TableDir(r.tableOID), deltas.DirName)
+	deltaDir := path.Join(utils.TableDir(r.tableOID), deltas.DirName)
 
-	fileList, err := ioutil.ReadDir(deltaDir)
+	objects, err := r.archive.List(deltaDir)
 	if err != nil {
-		return fmt.Errorf("could not read directory: %v", err)
+		return fmt.Errorf("could not list delta files: %v", err)
 	}
 
 	deltaFiles := make(deltafiles.DeltaFiles, 0)
-	for _, v := range fileList {
-		deltaFiles = append(deltaFiles, v.Name())
+	for _, obj := range objects {
+		filename := path.Base(obj.Name)
+
+		lsn, err := utils.GetLSNFromDeltaFilename(filename)
+		if err != nil {
+			r.log().Warn("skipping unexpected file in the deltas directory", "file", obj.Name, "error", err)
+			continue
+		}
+
+		// files starting after the target contain no transactions to restore
+		if r.targetLSN.IsValid() && lsn > r.targetLSN {
+			continue
+		}
+
+		deltaFiles = append(deltaFiles, filename)
 	}
 
 	if len(deltaFiles) == 0 {
-		log.Printf("no delta files")
+		r.log().Info("no delta files")
 		return nil
 	}
 
 	sort.Sort(deltaFiles)
 
 	for _, filename := range deltaFiles {
-		log.Printf("applying delta: %v", filename)
+		r.log().Info("applying delta", "file", filename)
 		if err := r.applySegmentFile(filename); err != nil {
 			return fmt.Errorf("could not apply deltas from %q file: %v", filename, err)
 		}
@@ -273,13 +476,27 @@ func (r *logicalRestore) applyDeltas() error {
 	return nil
 }
 
+// setTableOID looks the table up in the catalog, falling back to the oid to name map for the archives without one
 func (r *logicalRestore) setTableOID() error {
-	tableNames := namehistory.New(path.Join(r.baseDir, logicalbackup.OidNameMapFile))
+	cat := catalog.New(r.archive, r.keyring)
+	if err := cat.Load(); err == nil {
+		t, ok := cat.Lookup(r.NamespacedName, r.targetLSN)
+		if !ok {
+			return fmt.Errorf("could not find table")
+		}
+		r.tableOID = t.OID
+
+		return nil
+	} else if err != storage.ErrNotExist {
+		return err
+	}
+
+	tableNames := namehistory.New(r.archive, logicalbackup.OidNameMapFile, r.keyring)
 	if err := tableNames.Load(); err != nil {
 		return err
 	}
 
-	oid, _ := tableNames.GetOID(r.NamespacedName, dbutils.InvalidLSN)
+	oid, _ := tableNames.GetOID(r.NamespacedName, r.targetLSN)
 	if oid == dbutils.InvalidOID {
 		return fmt.Errorf("could not find table")
 	}
@@ -308,14 +525,63 @@ func (r *logicalRestore) checkTableStruct() error {
 	rel.OID = r.tableOID // fake that we have same oid (in fact we might not)
 
 	if !r.relInfo.Equals(&rel) {
-		log.Printf("src table: %#v", r.relInfo)
-		log.Printf("dst table: %#v", rel)
+		r.log().Error("table structure differs", "src", fmt.Sprintf("%#v", r.relInfo), "dst", fmt.Sprintf("%#v", rel))
 		return fmt.Errorf("tables are different")
 	}
 
 	return nil
 }
 
+// createMissingTable creates the table using the definition stored in the basebackup info file
+func (r *logicalRestore) createMissingTable() error {
+	var exists bool
+
+	row := r.conn.QueryRow(fmt.Sprintf("select to_regclass(%s) is not null", dbutils.QuoteLiteral(r.Sanitize())))
+	if err := row.Scan(&exists); err != nil {
+		return fmt.Errorf("could not check if table exists: %v", err)
+	}
+
+	if exists {
+		return nil
+	}
+
+	if r.tableDef == nil {
+		return fmt.Errorf("basebackup info file contains no table definition")
+	}
+
+	if err := r.begin(); err != nil {
+		return err
+	}
+
+	for _, sql := range r.tableDef.SQL(r.NamespacedName) {
+		if err := r.execSQL(sql); err != nil {
+			r.rollback()
+			return err
+		}
+	}
+
+	if err := r.commit(); err != nil {
+		return err
+	}
+	r.tableCreated = true
+
+	return nil
+}
+
+// finishTable moves sequences of the created table past the restored values and makes its identity columns
+// generated always if they were
+func (r *logicalRestore) finishTable() error {
+	sqlCommands := append(r.tableDef.SequencesSQL(r.NamespacedName), r.tableDef.IdentitySQL(r.NamespacedName)...)
+
+	for _, sql := range sqlCommands {
+		if _, err := r.conn.Exec(sql); err != nil {
+			return fmt.Errorf("%v (%q)", err, sql)
+		}
+	}
+
+	return nil
+}
+
 func (r *logicalRestore) truncateTable() error {
 	if _, err := r.conn.Exec(fmt.Sprintf("truncate %s", r.Sanitize())); err != nil {
 		return err
@@ -339,10 +605,20 @@ func (r *logicalRestore) Restore() error {
 	}
 	defer func() {
 		if err := r.disconnect(); err != nil {
-			log.Printf("could not disconnect: %v", err)
+			r.log().Error("could not disconnect", "error", err)
 		}
 	}()
 
+	if r.createTable {
+		if err := r.createMissingTable(); err != nil {
+			return fmt.Errorf("could not create table: %v", err)
+		}
+
+		if r.tableCreated {
+			r.log().Info("table created")
+		}
+	}
+
 	if err := r.checkTableStruct(); err != nil {
 		return fmt.Errorf("table struct error: %v", err)
 	}
@@ -356,10 +632,10 @@ func (r *logicalRestore) Restore() error {
 			return fmt.Errorf("could not truncate table: %v", err)
 		}
 
-		log.Printf("table %s truncated", r)
+		r.log().Info("table truncated")
 	}
 
-	log.Printf("start lsn: %v", r.startLSN)
+	r.log().Info("restoring", "startLSN", r.startLSN.String(), "targetLSN", r.targetLSN.String())
 
 	if err := r.loadDump(); err != nil {
 		return fmt.Errorf("could not load dump: %v", err)
@@ -369,6 +645,12 @@ func (r *logicalRestore) Restore() error {
 		return fmt.Errorf("could not apply deltas: %v", err)
 	}
 
+	if r.tableCreated {
+		if err := r.finishTable(); err != nil {
+			return fmt.Errorf("could not finish table: %v", err)
+		}
+	}
+
 	if err := r.enableConstraints(); err != nil {
 		return fmt.Errorf("could not enable constraints: %v", err)
 	}
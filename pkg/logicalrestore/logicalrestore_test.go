@@ -0,0 +1,265 @@
+package logicalrestore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/yaml.v2"
+
+	"github.com/mkabilov/logical_backup/pkg/basebackup/generations"
+	"github.com/mkabilov/logical_backup/pkg/decoder"
+	"github.com/mkabilov/logical_backup/pkg/deltas"
+	"github.com/mkabilov/logical_backup/pkg/logicalbackup"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/namehistory"
+)
+
+const testSchema = "logical_backup_restore_test"
+
+// testConn connects to the database given by the libpq environment variables, the test is skipped if PGHOST is not set
+func testConn(t *testing.T) (*pgx.Conn, pgx.ConnConfig) {
+	if os.Getenv("PGHOST") == "" {
+		t.Skip("PGHOST is not set")
+	}
+
+	cfg, err := pgx.ParseEnvLibpq()
+	if err != nil {
+		t.Fatalf("could not parse libpq environment variables: %v", err)
+	}
+
+	conn, err := pgx.Connect(cfg)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+
+	return conn, cfg
+}
+
+func mustExec(t *testing.T, conn *pgx.Conn, sql string) {
+	t.Helper()
+
+	if _, err := conn.Exec(sql); err != nil {
+		t.Fatalf("could not execute %q: %v", sql, err)
+	}
+}
+
+// pgoutput encodes the messages of the logical replication protocol
+type pgoutput struct {
+	bytes.Buffer
+}
+
+func (p *pgoutput) uint8(v uint8)   { p.WriteByte(v) }
+func (p *pgoutput) uint16(v uint16) { binary.Write(p, binary.BigEndian, v) }
+func (p *pgoutput) uint32(v uint32) { binary.Write(p, binary.BigEndian, v) }
+func (p *pgoutput) uint64(v uint64) { binary.Write(p, binary.BigEndian, v) }
+
+func (p *pgoutput) tuple(values ...string) {
+	p.uint8('N')
+	p.uint16(uint16(len(values)))
+	for _, v := range values {
+		p.uint8('t')
+		p.uint32(uint32(len(v)))
+		p.WriteString(v)
+	}
+}
+
+func (p *pgoutput) message(t *testing.T) message.Message {
+	msg, err := decoder.Parse(p.Bytes())
+	if err != nil {
+		t.Fatalf("could not parse message: %v", err)
+	}
+
+	return msg
+}
+
+// transaction returns the messages of the transaction inserting and updating the rows of the table
+func transaction(t *testing.T, oid dbutils.OID, lsn dbutils.LSN, inserts, updates [][]string) []message.Message {
+	msgs := make([]message.Message, 0)
+
+	begin := &pgoutput{}
+	begin.uint8('B')
+	begin.uint64(uint64(lsn))
+	begin.uint64(0)
+	begin.uint32(1)
+	msgs = append(msgs, begin.message(t))
+
+	for _, row := range inserts {
+		ins := &pgoutput{}
+		ins.uint8('I')
+		ins.uint32(uint32(oid))
+		ins.tuple(row...)
+		msgs = append(msgs, ins.message(t))
+	}
+
+	for _, row := range updates {
+		upd := &pgoutput{}
+		upd.uint8('U')
+		upd.uint32(uint32(oid))
+		upd.tuple(row...)
+		msgs = append(msgs, upd.message(t))
+	}
+
+	commit := &pgoutput{}
+	commit.uint8('C')
+	commit.uint8(0)
+	commit.uint64(uint64(lsn))
+	commit.uint64(uint64(lsn) + 1)
+	commit.uint64(0)
+	msgs = append(msgs, commit.message(t))
+
+	return msgs
+}
+
+// TestRestoreCreateTable restores the basebackup and the deltas of the table with identity and generated columns
+// into the table created from the backed up definition
+func TestRestoreCreateTable(t *testing.T) {
+	conn, cfg := testConn(t)
+	defer conn.Close()
+
+	var version int
+	if err := conn.QueryRow("select current_setting('server_version_num')::int").Scan(&version); err != nil {
+		t.Fatalf("could not fetch server version: %v", err)
+	}
+
+	mustExec(t, conn, "drop schema if exists "+testSchema+" cascade")
+	mustExec(t, conn, "create schema "+testSchema)
+	defer mustExec(t, conn, "drop schema "+testSchema+" cascade")
+
+	name := message.NamespacedName{Namespace: testSchema, Name: "t"}
+	columns := []string{
+		"id bigint generated always as identity (start with 10 increment by 5) primary key",
+		"name text not null",
+	}
+	if version >= 120000 {
+		columns = append(columns, "name_len int generated always as (length(name)) stored")
+	}
+	mustExec(t, conn, "create table "+name.Sanitize()+" ("+strings.Join(columns, ", ")+")")
+
+	var oid dbutils.OID
+	if err := conn.QueryRow("select $1::regclass::oid", name.Sanitize()).Scan(&oid); err != nil {
+		t.Fatalf("could not fetch table oid: %v", err)
+	}
+
+	startLSN := dbutils.LSN(0x1000)
+	info := message.DumpInfo{StartLSN: startLSN, CreateDate: time.Now(), Definition: &message.TableDefinition{}}
+	if err := info.Relation.FetchByOID(conn, oid); err != nil {
+		t.Fatalf("could not fetch relation: %v", err)
+	}
+	if err := info.Definition.FetchByOID(conn, oid); err != nil {
+		t.Fatalf("could not fetch table definition: %v", err)
+	}
+	if len(info.Relation.Columns) != 2 {
+		t.Fatalf("expected the relation without the generated column, got %d columns", len(info.Relation.Columns))
+	}
+	mustExec(t, conn, "drop table "+name.Sanitize())
+
+	archiveDir := t.TempDir()
+	archive := storage.NewLocal(archiveDir, false)
+
+	tableDir := utils.TableDir(oid)
+	genDir := path.Join(tableDir, generations.Dir(startLSN))
+
+	dump := "10\tfoo\n15\tbar\n"
+	if err := archive.Put(path.Join(genDir, generations.DumpFilename), strings.NewReader(dump), int64(len(dump))); err != nil {
+		t.Fatalf("could not store dump: %v", err)
+	}
+
+	infoData, err := yaml.Marshal(info)
+	if err != nil {
+		t.Fatalf("could not encode info: %v", err)
+	}
+	err = archive.Put(path.Join(genDir, generations.InfoFilename), bytes.NewReader(infoData), int64(len(infoData)))
+	if err != nil {
+		t.Fatalf("could not store info: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(archiveDir, tableDir, deltas.DirName), 0750); err != nil {
+		t.Fatalf("could not create deltas dir: %v", err)
+	}
+	delta := deltas.New(filepath.Join(archiveDir, tableDir), false, compression.Config{}, nil)
+	for _, msg := range transaction(t, oid, startLSN+0x100, [][]string{{"20", "bazz"}}, [][]string{{"10", "quux"}}) {
+		delta.AddMessage(msg)
+	}
+	if _, _, _, err := delta.Save(); err != nil {
+		t.Fatalf("could not save deltas: %v", err)
+	}
+
+	names := namehistory.New(archive, logicalbackup.OidNameMapFile, nil)
+	names.SetName(oid, startLSN, name)
+	if err := names.Save(); err != nil {
+		t.Fatalf("could not save oid to name map: %v", err)
+	}
+
+	r := New(context.Background(), name, archive, dbutils.InvalidLSN, false, true, 1, nil, cfg)
+	if err := r.Restore(); err != nil {
+		t.Fatalf("could not restore: %v", err)
+	}
+
+	var identity string
+	err = conn.QueryRow("select attidentity::text from pg_attribute where attrelid = $1::regclass and attname = 'id'",
+		name.Sanitize()).Scan(&identity)
+	if err != nil {
+		t.Fatalf("could not fetch identity: %v", err)
+	}
+	if identity != "a" {
+		t.Errorf("expected id to be generated always, got %q", identity)
+	}
+
+	var nextID int64
+	if err := conn.QueryRow("insert into " + name.Sanitize() + " (name) values ('x') returning id").Scan(&nextID); err != nil {
+		t.Fatalf("could not insert: %v", err)
+	}
+	if nextID != 25 {
+		t.Errorf("expected the identity sequence to continue with 25, got %d", nextID)
+	}
+
+	rows, err := conn.Query("select id, name from " + name.Sanitize() + " order by id")
+	if err != nil {
+		t.Fatalf("could not query restored table: %v", err)
+	}
+	defer rows.Close()
+
+	got := make([]string, 0)
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			t.Fatalf("could not scan: %v", err)
+		}
+		got = append(got, fmt.Sprintf("%d:%s", id, name))
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("could not read rows: %v", err)
+	}
+
+	expected := []string{"10:quux", "15:bar", "20:bazz", "25:x"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("unexpected rows: %v, expected: %v", got, expected)
+	}
+
+	if version >= 120000 {
+		var nameLen int
+		err := conn.QueryRow("select name_len from " + name.Sanitize() + " where id = 10").Scan(&nameLen)
+		if err != nil {
+			t.Fatalf("could not query generated column: %v", err)
+		}
+		if nameLen != 4 {
+			t.Errorf("expected generated column to be 4, got %d", nameLen)
+		}
+	}
+}
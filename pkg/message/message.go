@@ -7,6 +7,7 @@ import (
 
 	"github.com/jackc/pgx"
 
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
 )
 
@@ -59,10 +60,15 @@ var (
 )
 
 type DumpInfo struct {
-	StartLSN       dbutils.LSN   `yaml:"StartLSN"`
-	CreateDate     time.Time     `yaml:"CreateDate"`
-	Relation       Relation      `yaml:"Relation"`
-	BackupDuration time.Duration `yaml:"BackupDuration"`
+	StartLSN       dbutils.LSN        `yaml:"StartLSN"`
+	CreateDate     time.Time          `yaml:"CreateDate"`
+	Relation       Relation           `yaml:"Relation"`
+	Definition     *TableDefinition   `yaml:"Definition,omitempty"`    // absent in the info files of the older versions
+	Chunks         []string           `yaml:"Chunks,omitempty"`        // dump chunk files, if the table was dumped in parallel
+	Compression    compression.Method `yaml:"Compression,omitempty"`   // absent means uncompressed dump
+	EncryptionKey  string             `yaml:"EncryptionKey,omitempty"` // id of the key the dump is encrypted with
+	BackupDuration time.Duration      `yaml:"BackupDuration"`
+	Size           int64              `yaml:"Size,omitempty"` // size of the dump files as stored, absent in the older versions
 }
 
 type Message interface {
@@ -350,6 +356,7 @@ func (tr Truncate) SQL() string {
 	return ""
 }
 
+// SQL returns the insert statement, the values of the identity columns override the generated ones
 func (ins Insert) SQL(rel Relation) string {
 	values := make([]string, 0)
 	names := make([]string, 0)
@@ -361,7 +368,7 @@ func (ins Insert) SQL(rel Relation) string {
 		}
 	}
 
-	return fmt.Sprintf("insert into %s (%s) values (%s);",
+	return fmt.Sprintf("insert into %s (%s) overriding system value values (%s);",
 		rel.Sanitize(),
 		strings.Join(names, ", "),
 		strings.Join(values, ", "))
@@ -531,6 +538,15 @@ func (t TupleKind) String() string {
 	}
 }
 
+// ParseNamespacedName parses the name of the form schema.table, the schema is public if omitted
+func ParseNamespacedName(s string) NamespacedName {
+	if parts := strings.SplitN(s, ".", 2); len(parts) == 2 {
+		return NamespacedName{Namespace: parts[0], Name: parts[1]}
+	}
+
+	return NamespacedName{Namespace: "public", Name: s}
+}
+
 func (n NamespacedName) String() string {
 	if n.Namespace == "public" {
 		return n.Name
@@ -565,6 +581,17 @@ func (rel *Relation) fetchColumns(conn queryRunner) error {
 		return fmt.Errorf("table has no oid")
 	}
 
+	version, err := serverVersion(conn)
+	if err != nil {
+		return err
+	}
+
+	// pgoutput does not send the generated columns
+	generated := ""
+	if version >= 120000 {
+		generated = "AND a.attgenerated = ''"
+	}
+
 	// query taken from fetch_remote_table_info (src/backend/replication/logical/tablesync.c)
 	query := fmt.Sprintf(`
 	  SELECT a.attname,
@@ -576,8 +603,9 @@ func (rel *Relation) fetchColumns(conn queryRunner) error {
 	       ON (i.indexrelid = pg_get_replica_identity_index(%[1]d))
 	  WHERE a.attnum > 0::pg_catalog.int2
 	  AND NOT a.attisdropped
+	  %[2]s
 	  AND a.attrelid = %[1]d
-      ORDER BY a.attnum`, rel.OID)
+      ORDER BY a.attnum`, rel.OID, generated)
 
 	rows, err := conn.Query(query)
 	if err != nil {
@@ -0,0 +1,531 @@
+package message
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+const (
+	persistenceUnlogged = "u"
+
+	identityAlways    = "a"
+	identityByDefault = "d"
+
+	generatedStored = "s"
+
+	constraintForeignKey = "f"
+	constraintPrimaryKey = "p"
+	constraintUnique     = "u"
+	constraintExclusion  = "x"
+)
+
+// TableDefinition describes the complete definition of the table, as opposed to the Relation which contains only
+// the information sent by pgoutput.
+type TableDefinition struct {
+	Persistence string                 `yaml:"Persistence"`
+	Comment     string                 `yaml:"Comment,omitempty"`
+	Columns     []ColumnDefinition     `yaml:"Columns"`
+	Constraints []ConstraintDefinition `yaml:"Constraints,omitempty"`
+	Indexes     []IndexDefinition      `yaml:"Indexes,omitempty"`
+	Sequences   []SequenceDefinition   `yaml:"Sequences,omitempty"`
+}
+
+// ColumnDefinition describes the column of the table
+type ColumnDefinition struct {
+	Name      string `yaml:"Name"`
+	Type      string `yaml:"Type"` // output of the format_type()
+	NotNull   bool   `yaml:"NotNull"`
+	Default   string `yaml:"Default,omitempty"`   // default expression
+	Identity  string `yaml:"Identity,omitempty"`  // pg_attribute.attidentity
+	Generated string `yaml:"Generated,omitempty"` // pg_attribute.attgenerated, the default is the generation expression
+	Collation string `yaml:"Collation,omitempty"` // only set if differs from the default collation of the type
+	Comment   string `yaml:"Comment,omitempty"`
+}
+
+// ConstraintDefinition describes table constraint, except for the not null ones
+type ConstraintDefinition struct {
+	Name       string `yaml:"Name"`
+	Type       string `yaml:"Type"` // pg_constraint.contype
+	Definition string `yaml:"Definition"`
+}
+
+// IndexDefinition describes index which does not belong to any constraint
+type IndexDefinition struct {
+	Name       string `yaml:"Name"`
+	Definition string `yaml:"Definition"`       // output of the pg_get_indexdef() naming the source table and index
+	Unique     bool   `yaml:"Unique,omitempty"` // pg_index.indisunique
+	Using      string `yaml:"Using,omitempty"`  // the definition following the table name: method, columns, predicate
+}
+
+// SequenceDefinition describes sequence owned by the column of the table, i.e. serial, or the identity sequence
+type SequenceDefinition struct {
+	Name     string `yaml:"Name"` // qualified and quoted name of the sequence in the source database
+	Column   string `yaml:"Column"`
+	Identity bool   `yaml:"Identity,omitempty"` // created together with the identity column
+
+	// parameters of the sequence, absent in the info files of the older versions
+	Type      string `yaml:"Type,omitempty"`
+	Start     int64  `yaml:"Start,omitempty"`
+	Increment int64  `yaml:"Increment,omitempty"`
+	MinValue  int64  `yaml:"MinValue,omitempty"`
+	MaxValue  int64  `yaml:"MaxValue,omitempty"`
+	Cache     int64  `yaml:"Cache,omitempty"`
+	Cycle     bool   `yaml:"Cycle,omitempty"`
+}
+
+// options returns the options of the sequence as in create sequence
+func (seq SequenceDefinition) options() string {
+	if seq.Increment == 0 {
+		return ""
+	}
+
+	options := make([]string, 0)
+	if seq.Type != "" && !seq.Identity {
+		options = append(options, "as "+seq.Type)
+	}
+	options = append(options,
+		fmt.Sprintf("increment by %d", seq.Increment),
+		fmt.Sprintf("minvalue %d", seq.MinValue),
+		fmt.Sprintf("maxvalue %d", seq.MaxValue),
+		fmt.Sprintf("start with %d", seq.Start),
+		fmt.Sprintf("cache %d", seq.Cache))
+	if seq.Cycle {
+		options = append(options, "cycle")
+	} else {
+		options = append(options, "no cycle")
+	}
+
+	return strings.Join(options, " ")
+}
+
+// serverVersion returns the server_version_num of the database
+func serverVersion(conn queryRunner) (int, error) {
+	var version int
+
+	if err := conn.QueryRow("select current_setting('server_version_num')::int").Scan(&version); err != nil {
+		return 0, fmt.Errorf("could not fetch server version: %v", err)
+	}
+
+	return version, nil
+}
+
+// FetchByOID fetches complete table definition from the database by oid
+func (def *TableDefinition) FetchByOID(conn queryRunner, oid dbutils.OID) error {
+	row := conn.QueryRow(fmt.Sprintf(`
+		select relpersistence::text, coalesce(obj_description(oid, 'pg_class'), '')
+		from pg_class
+		where oid = %d`, oid))
+	if err := row.Scan(&def.Persistence, &def.Comment); err != nil {
+		return fmt.Errorf("could not fetch table info: %v", err)
+	}
+
+	if err := def.fetchColumns(conn, oid); err != nil {
+		return fmt.Errorf("could not fetch columns: %v", err)
+	}
+
+	if err := def.fetchConstraints(conn, oid); err != nil {
+		return fmt.Errorf("could not fetch constraints: %v", err)
+	}
+
+	if err := def.fetchIndexes(conn, oid); err != nil {
+		return fmt.Errorf("could not fetch indexes: %v", err)
+	}
+
+	if err := def.fetchSequences(conn, oid); err != nil {
+		return fmt.Errorf("could not fetch sequences: %v", err)
+	}
+
+	return nil
+}
+
+func (def *TableDefinition) fetchColumns(conn queryRunner, oid dbutils.OID) error {
+	var columns []ColumnDefinition
+
+	version, err := serverVersion(conn)
+	if err != nil {
+		return err
+	}
+
+	// generated columns appeared in 12
+	generated := "''"
+	if version >= 120000 {
+		generated = "a.attgenerated::text"
+	}
+
+	rows, err := conn.Query(fmt.Sprintf(`
+		select a.attname,
+		       format_type(a.atttypid, a.atttypmod),
+		       a.attnotnull,
+		       coalesce(pg_get_expr(d.adbin, d.adrelid), ''),
+		       a.attidentity::text,
+		       %s,
+		       coalesce(case when a.attcollation <> t.typcollation
+		                     then quote_ident(cn.nspname) || '.' || quote_ident(co.collname) end, ''),
+		       coalesce(col_description(a.attrelid, a.attnum), '')
+		from pg_attribute a
+		       join pg_type t on t.oid = a.atttypid
+		       left join pg_attrdef d on (d.adrelid = a.attrelid and d.adnum = a.attnum)
+		       left join pg_collation co on co.oid = a.attcollation
+		       left join pg_namespace cn on cn.oid = co.collnamespace
+		where a.attrelid = %d
+		  and a.attnum > 0
+		  and not a.attisdropped
+		order by a.attnum`, generated, oid))
+	if err != nil {
+		return fmt.Errorf("could not execute query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var col ColumnDefinition
+
+		err := rows.Scan(&col.Name, &col.Type, &col.NotNull, &col.Default, &col.Identity, &col.Generated, &col.Collation,
+			&col.Comment)
+		if err != nil {
+			return fmt.Errorf("could not scan: %v", err)
+		}
+
+		columns = append(columns, col)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	def.Columns = columns
+
+	return nil
+}
+
+func (def *TableDefinition) fetchConstraints(conn queryRunner, oid dbutils.OID) error {
+	var constraints []ConstraintDefinition
+
+	// not null constraints are part of the column definition
+	rows, err := conn.Query(fmt.Sprintf(`
+		select conname, contype::text, pg_get_constraintdef(oid)
+		from pg_constraint
+		where conrelid = %d
+		  and contype <> 'n'
+		order by contype <> 'p', conname`, oid))
+	if err != nil {
+		return fmt.Errorf("could not execute query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var con ConstraintDefinition
+
+		if err := rows.Scan(&con.Name, &con.Type, &con.Definition); err != nil {
+			return fmt.Errorf("could not scan: %v", err)
+		}
+
+		constraints = append(constraints, con)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	def.Constraints = constraints
+
+	return nil
+}
+
+func (def *TableDefinition) fetchIndexes(conn queryRunner, oid dbutils.OID) error {
+	var indexes []IndexDefinition
+
+	// indexes backing the constraints are created together with the constraints
+	rows, err := conn.Query(fmt.Sprintf(`
+		select c.relname, pg_get_indexdef(i.indexrelid), i.indisunique, quote_ident(c.relname),
+		       quote_ident(n.nspname) || '.' || quote_ident(t.relname), quote_ident(t.relname)
+		from pg_index i
+		       join pg_class c on c.oid = i.indexrelid
+		       join pg_class t on t.oid = i.indrelid
+		       join pg_namespace n on n.oid = t.relnamespace
+		where i.indrelid = %d
+		  and not exists(select 1 from pg_constraint con where con.conindid = i.indexrelid and con.contype in ('p', 'u', 'x'))
+		order by c.relname`, oid))
+	if err != nil {
+		return fmt.Errorf("could not execute query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			idx                                IndexDefinition
+			quotedName, qualified, unqualified string
+		)
+
+		err := rows.Scan(&idx.Name, &idx.Definition, &idx.Unique, &quotedName, &qualified, &unqualified)
+		if err != nil {
+			return fmt.Errorf("could not scan: %v", err)
+		}
+		idx.Using = indexUsing(idx.Definition, quotedName, idx.Unique, qualified, unqualified)
+
+		indexes = append(indexes, idx)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	def.Indexes = indexes
+
+	return nil
+}
+
+func (def *TableDefinition) fetchSequences(conn queryRunner, oid dbutils.OID) error {
+	var sequences []SequenceDefinition
+
+	// identity sequences have 'i' dependency type, the owned ones 'a'
+	rows, err := conn.Query(fmt.Sprintf(`
+		select quote_ident(n.nspname) || '.' || quote_ident(s.relname), a.attname, d.deptype = 'i',
+		       format_type(ps.seqtypid, null), ps.seqstart, ps.seqincrement, ps.seqmin, ps.seqmax, ps.seqcache,
+		       ps.seqcycle
+		from pg_depend d
+		       join pg_class s on (s.oid = d.objid and s.relkind = 'S')
+		       join pg_sequence ps on ps.seqrelid = s.oid
+		       join pg_namespace n on n.oid = s.relnamespace
+		       join pg_attribute a on (a.attrelid = d.refobjid and a.attnum = d.refobjsubid)
+		where d.refobjid = %d
+		  and d.classid = 'pg_class'::regclass
+		  and d.refclassid = 'pg_class'::regclass
+		  and d.deptype in ('a', 'i')
+		order by a.attnum`, oid))
+	if err != nil {
+		return fmt.Errorf("could not execute query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var seq SequenceDefinition
+
+		err := rows.Scan(&seq.Name, &seq.Column, &seq.Identity, &seq.Type, &seq.Start, &seq.Increment, &seq.MinValue,
+			&seq.MaxValue, &seq.Cache, &seq.Cycle)
+		if err != nil {
+			return fmt.Errorf("could not scan: %v", err)
+		}
+
+		sequences = append(sequences, seq)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	def.Sequences = sequences
+
+	return nil
+}
+
+// indexUsing cuts the output of the pg_get_indexdef() down to the part following the table name, i.e.
+// USING btree (id) WHERE ..., empty if the definition is not of the expected form. The table is either schema
+// qualified or not depending on the search_path of the server version.
+func indexUsing(definition, index string, unique bool, tables ...string) string {
+	prefix := "CREATE INDEX "
+	if unique {
+		prefix = "CREATE UNIQUE INDEX "
+	}
+	prefix += index + " ON "
+
+	if !strings.HasPrefix(definition, prefix) {
+		return ""
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(definition, prefix), "ONLY ")
+
+	for _, table := range tables {
+		if strings.HasPrefix(rest, table+" USING ") {
+			return strings.TrimPrefix(rest, table+" ")
+		}
+	}
+
+	return ""
+}
+
+// sequenceName returns the name of the owned sequence for the table with the given name, as serial would name it:
+// the sequence of the source table might exist in the database the table is restored to
+func sequenceName(name NamespacedName, seq SequenceDefinition) string {
+	return pgx.Identifier{name.Namespace, name.Name + "_" + seq.Column + "_seq"}.Sanitize()
+}
+
+// ownedSequence returns the owned, not identity sequence of the column
+func (def TableDefinition) ownedSequence(column string) (SequenceDefinition, bool) {
+	for _, seq := range def.Sequences {
+		if !seq.Identity && seq.Column == column {
+			return seq, true
+		}
+	}
+
+	return SequenceDefinition{}, false
+}
+
+// identitySequence returns the sequence of the identity column
+func (def TableDefinition) identitySequence(column string) (SequenceDefinition, bool) {
+	for _, seq := range def.Sequences {
+		if seq.Identity && seq.Column == column {
+			return seq, true
+		}
+	}
+
+	return SequenceDefinition{}, false
+}
+
+// SQL returns the list of statements to create the table with the given name.
+// Foreign keys are omitted: the restore acts on each table independently.
+// Identity columns are created generated by default to accept the restored values, see IdentitySQL.
+// The owned sequences, the indexes and the constraints backed by them are named after the given table, not the source
+// one.
+func (def TableDefinition) SQL(name NamespacedName) []string {
+	sqlCommands := make([]string, 0)
+	tableName := name.Sanitize()
+
+	for _, seq := range def.Sequences {
+		if seq.Identity {
+			continue
+		}
+
+		createSequence := "create sequence if not exists " + sequenceName(name, seq)
+		if options := seq.options(); options != "" {
+			createSequence += " " + options
+		}
+		sqlCommands = append(sqlCommands, createSequence+";")
+	}
+
+	columns := make([]string, 0)
+	for _, col := range def.Columns {
+		colDef := []string{pgx.Identifier{col.Name}.Sanitize(), col.Type}
+
+		if col.Collation != "" {
+			colDef = append(colDef, "collate "+col.Collation)
+		}
+
+		if col.Identity == identityAlways || col.Identity == identityByDefault {
+			identity := "generated by default as identity"
+			if seq, ok := def.identitySequence(col.Name); ok && seq.options() != "" {
+				identity += " (" + seq.options() + ")"
+			}
+			colDef = append(colDef, identity)
+		}
+
+		if col.Generated == generatedStored {
+			colDef = append(colDef, fmt.Sprintf("generated always as (%s) stored", col.Default))
+		} else if seq, ok := def.ownedSequence(col.Name); ok && strings.HasPrefix(col.Default, "nextval(") {
+			colDef = append(colDef, fmt.Sprintf("default nextval(%s::regclass)",
+				dbutils.QuoteLiteral(sequenceName(name, seq))))
+		} else if col.Default != "" {
+			colDef = append(colDef, "default "+col.Default)
+		}
+
+		if col.NotNull {
+			colDef = append(colDef, "not null")
+		}
+
+		columns = append(columns, strings.Join(colDef, " "))
+	}
+
+	createTable := "create table"
+	if def.Persistence == persistenceUnlogged {
+		createTable = "create unlogged table"
+	}
+	sqlCommands = append(sqlCommands, fmt.Sprintf("%s %s (%s);", createTable, tableName, strings.Join(columns, ", ")))
+
+	for _, con := range def.Constraints {
+		switch con.Type {
+		case constraintForeignKey:
+			continue
+		case constraintPrimaryKey, constraintUnique, constraintExclusion:
+			// the index of the constraint is named after the table by the server, the index of the source table
+			// might exist in the same schema
+			sqlCommands = append(sqlCommands, fmt.Sprintf("alter table %s add %s;", tableName, con.Definition))
+			continue
+		}
+
+		sqlCommands = append(sqlCommands, fmt.Sprintf("alter table %s add constraint %s %s;",
+			tableName, pgx.Identifier{con.Name}.Sanitize(), con.Definition))
+	}
+
+	for _, idx := range def.Indexes {
+		if idx.Using == "" {
+			// the info files of the older versions have only the statement creating the index on the source table
+			sqlCommands = append(sqlCommands, idx.Definition+";")
+			continue
+		}
+
+		// the server names the index after the table
+		createIndex := "create index on"
+		if idx.Unique {
+			createIndex = "create unique index on"
+		}
+		sqlCommands = append(sqlCommands, fmt.Sprintf("%s %s %s;", createIndex, tableName, idx.Using))
+	}
+
+	for _, seq := range def.Sequences {
+		if seq.Identity {
+			continue
+		}
+
+		sqlCommands = append(sqlCommands, fmt.Sprintf("alter sequence %s owned by %s.%s;",
+			sequenceName(name, seq), tableName, pgx.Identifier{seq.Column}.Sanitize()))
+	}
+
+	if def.Comment != "" {
+		sqlCommands = append(sqlCommands, fmt.Sprintf("comment on table %s is %s;",
+			tableName, dbutils.QuoteLiteral(def.Comment)))
+	}
+
+	for _, col := range def.Columns {
+		if col.Comment == "" {
+			continue
+		}
+
+		sqlCommands = append(sqlCommands, fmt.Sprintf("comment on column %s.%s is %s;",
+			tableName, pgx.Identifier{col.Name}.Sanitize(), dbutils.QuoteLiteral(col.Comment)))
+	}
+
+	return sqlCommands
+}
+
+// SequencesSQL returns the list of statements to move owned and identity sequences past the values stored in the table
+func (def TableDefinition) SequencesSQL(name NamespacedName) []string {
+	sqlCommands := make([]string, 0)
+
+	for _, seq := range def.Sequences {
+		colName := pgx.Identifier{seq.Column}.Sanitize()
+
+		seqName := dbutils.QuoteLiteral(sequenceName(name, seq))
+		if seq.Identity {
+			// the identity sequence of the created table is named anew
+			seqName = fmt.Sprintf("pg_get_serial_sequence(%s, %s)",
+				dbutils.QuoteLiteral(name.Sanitize()), dbutils.QuoteLiteral(seq.Column))
+		}
+
+		last, start := "max", int64(1)
+		if seq.Increment < 0 {
+			last = "min"
+		}
+		if seq.Increment != 0 {
+			start = seq.Start
+		}
+
+		sqlCommands = append(sqlCommands, fmt.Sprintf("select setval(%s, coalesce(%s(%s), %d), %s(%s) is not null) from %s;",
+			seqName, last, colName, start, last, colName, name.Sanitize()))
+	}
+
+	return sqlCommands
+}
+
+// IdentitySQL returns the list of statements making the identity columns generated always once the data is restored
+func (def TableDefinition) IdentitySQL(name NamespacedName) []string {
+	sqlCommands := make([]string, 0)
+
+	for _, col := range def.Columns {
+		if col.Identity != identityAlways {
+			continue
+		}
+
+		sqlCommands = append(sqlCommands, fmt.Sprintf("alter table %s alter column %s set generated always;",
+			name.Sanitize(), pgx.Identifier{col.Name}.Sanitize()))
+	}
+
+	return sqlCommands
+}
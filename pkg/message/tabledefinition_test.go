@@ -0,0 +1,146 @@
+package message
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTableDefinitionSQL(t *testing.T) {
+	def := TableDefinition{
+		Columns: []ColumnDefinition{
+			{Name: "id", Type: "bigint", NotNull: true, Identity: identityAlways},
+			{Name: "name", Type: "text"},
+			{Name: "name_len", Type: "integer", Default: "length(name)", Generated: generatedStored},
+			{Name: "n", Type: "integer", NotNull: true, Default: "nextval('public.t_n_seq'::regclass)"},
+		},
+		Sequences: []SequenceDefinition{
+			{Name: "public.t_id_seq", Column: "id", Identity: true, Type: "bigint", Start: 10, Increment: 5,
+				MinValue: 1, MaxValue: 1000, Cache: 1},
+			{Name: "public.t_n_seq", Column: "n", Type: "integer", Start: 1, Increment: 1, MinValue: 1,
+				MaxValue: 2147483647, Cache: 1},
+		},
+	}
+	name := NamespacedName{Namespace: "public", Name: "t"}
+
+	expected := []string{
+		`create sequence if not exists "public"."t_n_seq" as integer increment by 1 minvalue 1 maxvalue 2147483647 ` +
+			"start with 1 cache 1 no cycle;",
+		`create table "public"."t" (` +
+			`"id" bigint generated by default as identity (increment by 5 minvalue 1 maxvalue 1000 start with 10 ` +
+			`cache 1 no cycle) not null, ` +
+			`"name" text, ` +
+			`"name_len" integer generated always as (length(name)) stored, ` +
+			`"n" integer default nextval('"public"."t_n_seq"'::regclass) not null);`,
+		`alter sequence "public"."t_n_seq" owned by "public"."t"."n";`,
+	}
+	if sql := def.SQL(name); !reflect.DeepEqual(sql, expected) {
+		t.Errorf("unexpected create table sql:\n%s\nexpected:\n%s", strings.Join(sql, "\n"), strings.Join(expected, "\n"))
+	}
+
+	expected = []string{
+		`select setval(pg_get_serial_sequence('"public"."t"', 'id'), coalesce(max("id"), 10), max("id") is not null) ` +
+			`from "public"."t";`,
+		`select setval('"public"."t_n_seq"', coalesce(max("n"), 1), max("n") is not null) from "public"."t";`,
+	}
+	if sql := def.SequencesSQL(name); !reflect.DeepEqual(sql, expected) {
+		t.Errorf("unexpected sequences sql:\n%s\nexpected:\n%s", strings.Join(sql, "\n"), strings.Join(expected, "\n"))
+	}
+
+	expected = []string{`alter table "public"."t" alter column "id" set generated always;`}
+	if sql := def.IdentitySQL(name); !reflect.DeepEqual(sql, expected) {
+		t.Errorf("unexpected identity sql:\n%s\nexpected:\n%s", strings.Join(sql, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestTableDefinitionSQLWithoutSequenceOptions(t *testing.T) {
+	// info files of the older versions have no sequence parameters
+	def := TableDefinition{
+		Columns: []ColumnDefinition{
+			{Name: "id", Type: "integer", NotNull: true, Default: "nextval('public.t_id_seq'::regclass)"},
+		},
+		Sequences: []SequenceDefinition{{Name: "public.t_id_seq", Column: "id"}},
+	}
+
+	sql := def.SQL(NamespacedName{Namespace: "public", Name: "t"})
+	if sql[0] != `create sequence if not exists "public"."t_id_seq";` {
+		t.Errorf("unexpected create sequence sql: %s", sql[0])
+	}
+}
+
+func TestTableDefinitionSQLRenamed(t *testing.T) {
+	// the table public.t restored as archive.t_restored next to the source table
+	def := TableDefinition{
+		Columns: []ColumnDefinition{
+			{Name: "id", Type: "integer", NotNull: true, Default: "nextval('t_id_seq'::regclass)"},
+			{Name: "email", Type: "text"},
+		},
+		Constraints: []ConstraintDefinition{
+			{Name: "t_pkey", Type: constraintPrimaryKey, Definition: "PRIMARY KEY (id)"},
+			{Name: "t_id_check", Type: "c", Definition: "CHECK ((id > 0))"},
+		},
+		Indexes: []IndexDefinition{
+			{
+				Name:       "t_email_idx",
+				Definition: "CREATE UNIQUE INDEX t_email_idx ON public.t USING btree (lower(email)) WHERE (email IS NOT NULL)",
+				Unique:     true,
+				Using:      "USING btree (lower(email)) WHERE (email IS NOT NULL)",
+			},
+			{Name: "t_old_idx", Definition: "CREATE INDEX t_old_idx ON public.t USING btree (email)"},
+		},
+		Sequences: []SequenceDefinition{{Name: "public.t_id_seq", Column: "id"}},
+	}
+
+	expected := []string{
+		`create sequence if not exists "archive"."t_restored_id_seq";`,
+		`create table "archive"."t_restored" ("id" integer default nextval('"archive"."t_restored_id_seq"'::regclass) ` +
+			`not null, "email" text);`,
+		`alter table "archive"."t_restored" add PRIMARY KEY (id);`,
+		`alter table "archive"."t_restored" add constraint "t_id_check" CHECK ((id > 0));`,
+		`create unique index on "archive"."t_restored" USING btree (lower(email)) WHERE (email IS NOT NULL);`,
+		// the info files of the older versions
+		"CREATE INDEX t_old_idx ON public.t USING btree (email);",
+		`alter sequence "archive"."t_restored_id_seq" owned by "archive"."t_restored"."id";`,
+	}
+	if sql := def.SQL(NamespacedName{Namespace: "archive", Name: "t_restored"}); !reflect.DeepEqual(sql, expected) {
+		t.Errorf("unexpected create table sql:\n%s\nexpected:\n%s", strings.Join(sql, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestIndexUsing(t *testing.T) {
+	tests := []struct {
+		definition string
+		index      string
+		unique     bool
+		expected   string
+	}{
+		{"CREATE INDEX t_idx ON public.t USING btree (id)", "t_idx", false, "USING btree (id)"},
+		{"CREATE INDEX t_idx ON t USING btree (id)", "t_idx", false, "USING btree (id)"},
+		{"CREATE UNIQUE INDEX \"T idx\" ON ONLY public.t USING btree (id DESC) INCLUDE (v) WHERE (id > 0)", `"T idx"`,
+			true, "USING btree (id DESC) INCLUDE (v) WHERE (id > 0)"},
+		{"CREATE UNIQUE INDEX t_idx ON public.t USING btree (id)", "t_idx", false, ""},
+		{"CREATE INDEX t_idx ON public.other USING btree (id)", "t_idx", false, ""},
+	}
+
+	for _, tt := range tests {
+		if using := indexUsing(tt.definition, tt.index, tt.unique, "public.t", "t"); using != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.definition, tt.expected, using)
+		}
+	}
+}
+
+func TestInsertSQL(t *testing.T) {
+	rel := Relation{
+		NamespacedName: NamespacedName{Namespace: "public", Name: "t"},
+		Columns:        []Column{{Name: "id", IsKey: true}, {Name: "name"}},
+	}
+	ins := Insert{NewRow: []TupleData{
+		{Kind: TupleText, Value: []byte("1")},
+		{Kind: TupleNull},
+	}}
+
+	expected := `insert into "public"."t" ("id", "name") overriding system value values ('1', null);`
+	if sql := ins.SQL(rel); sql != expected {
+		t.Errorf("unexpected insert sql: %s, expected: %s", sql, expected)
+	}
+}
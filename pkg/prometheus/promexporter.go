@@ -1,11 +1,8 @@
 package promexporter
 
 import (
-	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"sync"
 
 	prom "github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -34,7 +31,27 @@ const (
 	PerTableLastBackupEndTimestamp      = "backup_last_backup_end_timestamp_per_table"
 	PerTableMessageSinceLastBackupGauge = "backup_messages_since_last_basebackup_per_table"
 
+	SlotActiveGauge        = "slot_active"
+	SlotLagBytesGauge      = "slot_lag_bytes"
+	SlotRetainedBytesGauge = "slot_retained_wal_bytes"
+	SlotSafeWALSizeGauge   = "slot_safe_wal_size_bytes"
+	SlotWALStatusGauge     = "slot_wal_status"
+	ServerWALLSNGauge      = "server_wal_lsn"
+
+	BasebackupDurationHistogram     = "basebackup_duration_seconds"
+	BasebackupQueueGauge            = "basebackup_queued"
+	BasebackupInProgressGauge       = "basebackup_in_progress"
+	BasebackupDeferredGauge         = "basebackup_deferred"
+	BasebackupFailuresCounter       = "basebackup_failures_total"
+	PerTableBasebackupSizeGauge     = "basebackup_size_bytes_per_table"
+	PerTableBasebackupDurationGauge = "basebackup_duration_seconds_per_table"
+	PerTableArchiverQueueGauge      = "archiver_queued_files_per_table"
+	ArchiveCopyDurationHistogram    = "archiver_copy_duration_seconds"
+	DeltaFileSizeHistogram          = "backup_delta_file_size_bytes"
+
 	MessageTypeLabel = "message_type"
+	WALStatusLabel   = "wal_status"
+	ReasonLabel      = "reason"
 	TableNameLabel   = "table_name"
 	TableOIDLabel    = "table_oid"
 
@@ -42,8 +59,17 @@ const (
 	MetricsCounterVector
 	MetricsGauge
 	MetricsGaugeVector
+	MetricsHistogram
+	MetricsHistogramVector
 )
 
+// histogramBuckets are the buckets of the histograms, the ones not listed get the default buckets
+var histogramBuckets = map[string][]float64{
+	BasebackupDurationHistogram:  prom.ExponentialBuckets(1, 4, 10),    // 1s to 3d
+	ArchiveCopyDurationHistogram: prom.ExponentialBuckets(0.01, 4, 10), // 10ms to 43m
+	DeltaFileSizeHistogram:       prom.ExponentialBuckets(1024, 4, 10), // 1KB to 256MB
+}
+
 type MetricsToRegister struct {
 	Name   string
 	Help   string
@@ -53,7 +79,6 @@ type MetricsToRegister struct {
 
 type PrometheusExporter struct {
 	metrics map[string]interface{}
-	port    int
 }
 
 type PromInterface interface {
@@ -61,13 +86,14 @@ type PromInterface interface {
 	Inc(name string, labelValues []string) error
 	Add(name string, addition float64, labelValues []string) error
 	Set(name string, value float64, labelValues []string) error
+	Observe(name string, value float64, labelValues []string) error
 	Reset(name string, labelValues []string) error
 	SetToCurrentTime(name string, labelValues []string) error
-	Run(ctx context.Context, wait *sync.WaitGroup)
+	Handler() http.Handler
 }
 
-func New(port int) *PrometheusExporter {
-	return &PrometheusExporter{metrics: make(map[string]interface{}), port: port}
+func New() *PrometheusExporter {
+	return &PrometheusExporter{metrics: make(map[string]interface{})}
 }
 
 func (pe *PrometheusExporter) errorIfExists(name, typeName string) error {
@@ -89,6 +115,10 @@ func (pe *PrometheusExporter) RegisterMetricsItem(item *MetricsToRegister) error
 		return pe.registerGauge(item.Name, item.Help)
 	case MetricsGaugeVector:
 		return pe.registerGaugeVector(item.Name, item.Help, item.Labels)
+	case MetricsHistogram:
+		return pe.registerHistogram(item.Name, item.Help)
+	case MetricsHistogramVector:
+		return pe.registerHistogramVector(item.Name, item.Help, item.Labels)
 	default:
 		return fmt.Errorf("unknonw metrics type code to register: %d for item %q", item.Kind, item.Name)
 	}
@@ -136,6 +166,28 @@ func (pe *PrometheusExporter) registerGaugeVector(name, help string, labelNames
 	return nil
 }
 
+func (pe *PrometheusExporter) registerHistogram(name, help string) error {
+	if err := pe.errorIfExists(name, "histogram"); err != nil {
+		return err
+	}
+
+	pe.metrics[name] = promauto.NewHistogram(prom.HistogramOpts{Name: name, Namespace: prometheusNamespace, Help: help,
+		Buckets: histogramBuckets[name]})
+
+	return nil
+}
+
+func (pe *PrometheusExporter) registerHistogramVector(name, help string, labelNames []string) error {
+	if err := pe.errorIfExists(name, "histogram vector"); err != nil {
+		return err
+	}
+
+	pe.metrics[name] = promauto.NewHistogramVec(prom.HistogramOpts{Name: name, Namespace: prometheusNamespace,
+		Help: help, Buckets: histogramBuckets[name]}, labelNames)
+
+	return nil
+}
+
 func (pe *PrometheusExporter) Inc(name string, labelValues []string) error {
 	switch t := pe.metrics[name].(type) {
 	case prom.Counter:
@@ -179,6 +231,19 @@ func (pe *PrometheusExporter) Set(name string, value float64, labelValues []stri
 	return nil
 }
 
+func (pe *PrometheusExporter) Observe(name string, value float64, labelValues []string) error {
+	switch t := pe.metrics[name].(type) {
+	case prom.Histogram:
+		t.Observe(value)
+	case *prom.HistogramVec:
+		t.WithLabelValues(labelValues...).Observe(value)
+	default:
+		return fmt.Errorf("type %T doesn't support Observe", t)
+	}
+
+	return nil
+}
+
 func (pe *PrometheusExporter) Reset(name string, labelValues []string) error {
 	return pe.Set(name, 0, labelValues)
 }
@@ -196,27 +261,8 @@ func (pe *PrometheusExporter) SetToCurrentTime(name string, labelValues []string
 	return nil
 }
 
-func (pe *PrometheusExporter) Run(ctx context.Context, wait *sync.WaitGroup) {
-	defer wait.Done()
-
-	srv := &http.Server{Addr: fmt.Sprintf(":%d", pe.port)}
-
-	wait.Add(1)
-	go func() {
-		defer wait.Done()
-		<-ctx.Done()
-		if err := srv.Close(); err != nil {
-			log.Printf("error while closing prometheus connections: %v", err)
-		}
-
-		log.Printf("prometheus http server shut down")
-	}()
-
+// Handler serves the metrics
+func (pe *PrometheusExporter) Handler() http.Handler {
 	// TODO: avoid exposting noisy metrics about the prometheus itself
-	http.Handle("/", http.RedirectHandler("/metrics", http.StatusMovedPermanently))
-	http.Handle("/metrics", promhttp.Handler())
-
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Printf("prometheus exporter routine closed with error %v", err)
-	}
+	return promhttp.Handler()
 }
@@ -0,0 +1,164 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField describes the allowed values of the cron field
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // both 0 and 7 are sunday
+}
+
+// Cron is the five field cron expression: minute, hour, day of month, month and day of week, each field is either *,
+// a number, a range or a comma separated list of those with an optional /step
+type Cron struct {
+	expr string
+	sets [5]uint64 // bit per allowed value of the field
+
+	domAny, dowAny bool
+}
+
+// ParseCron parses the cron expression
+func ParseCron(expr string) (Cron, error) {
+	c := Cron{expr: expr}
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return Cron{}, fmt.Errorf("expected %d fields, got %d", len(cronFields), len(fields))
+	}
+
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return Cron{}, fmt.Errorf("invalid %s %q: %v", cronFields[i].name, f, err)
+		}
+		c.sets[i] = set
+	}
+
+	// sunday is either 0 or 7
+	if c.sets[4]&(1<<7) != 0 {
+		c.sets[4] |= 1
+	}
+
+	c.domAny = fields[2] == "*"
+	c.dowAny = fields[4] == "*"
+
+	return c, nil
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part[i+1:])
+			}
+			step = s
+			part = part[:i]
+		}
+
+		lo, hi := f.min, f.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid value %q", bounds[0])
+			}
+
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				// 5/15 means from 5 through the max every 15
+				hi = f.max
+			}
+		}
+
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("values must be within %d-%d", f.min, f.max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (c *Cron) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	if s == "" {
+		*c = Cron{}
+		return nil
+	}
+
+	parsed, err := ParseCron(s)
+	if err != nil {
+		return fmt.Errorf("invalid cron expression %q: %v", s, err)
+	}
+	*c = parsed
+
+	return nil
+}
+
+// IsZero returns true if the expression is not set
+func (c Cron) IsZero() bool {
+	return c.expr == ""
+}
+
+// String implements Stringer
+func (c Cron) String() string {
+	return c.expr
+}
+
+// Match returns true if the expression fires at the minute of the time
+func (c Cron) Match(t time.Time) bool {
+	if c.IsZero() {
+		return false
+	}
+
+	has := func(field int, v int) bool {
+		return c.sets[field]&(1<<uint(v)) != 0
+	}
+
+	if !has(0, t.Minute()) || !has(1, t.Hour()) || !has(3, int(t.Month())) {
+		return false
+	}
+
+	// as in cron, if both days are restricted either of them matching is enough
+	dom, dow := has(2, t.Day()), has(4, int(t.Weekday()))
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
@@ -0,0 +1,102 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func mustCron(t *testing.T, expr string) Cron {
+	c, err := ParseCron(expr)
+	if err != nil {
+		t.Fatalf("could not parse cron %q: %v", expr, err)
+	}
+
+	return c
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q: expected error", expr)
+		}
+	}
+}
+
+func TestCronMatch(t *testing.T) {
+	// 2024-03-01 is friday
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2024, month, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(3, 1, 13, 7), true},
+		{"30 2 * * *", at(3, 1, 2, 30), true},
+		{"30 2 * * *", at(3, 1, 2, 31), false},
+		{"30 2 * * *", at(3, 1, 3, 30), false},
+
+		// steps
+		{"*/15 * * * *", at(3, 1, 0, 45), true},
+		{"*/15 * * * *", at(3, 1, 0, 46), false},
+		{"5/20 * * * *", at(3, 1, 0, 45), true},
+		{"5/20 * * * *", at(3, 1, 0, 40), false},
+		{"10-30/10 * * * *", at(3, 1, 0, 20), true},
+		{"10-30/10 * * * *", at(3, 1, 0, 40), false},
+
+		// ranges and lists
+		{"0 1-3 * * *", at(3, 1, 2, 0), true},
+		{"0 1-3 * * *", at(3, 1, 4, 0), false},
+		{"0 1,5,7-8 * * *", at(3, 1, 5, 0), true},
+		{"0 1,5,7-8 * * *", at(3, 1, 8, 0), true},
+		{"0 1,5,7-8 * * *", at(3, 1, 6, 0), false},
+		{"0 0 * 2-4 *", at(3, 1, 0, 0), true},
+		{"0 0 * 2-4 *", at(5, 1, 0, 0), false},
+
+		// both 0 and 7 are sunday, 2024-03-03 is sunday
+		{"0 0 * * 0", at(3, 3, 0, 0), true},
+		{"0 0 * * 7", at(3, 3, 0, 0), true},
+		{"0 0 * * 5-7", at(3, 3, 0, 0), true},
+		{"0 0 * * 7", at(3, 2, 0, 0), false},
+		{"0 0 * * 1-5", at(3, 1, 0, 0), true},
+		{"0 0 * * 1-5", at(3, 2, 0, 0), false},
+
+		// the restricted day of month or day of week alone must match
+		{"0 0 15 * *", at(3, 15, 0, 0), true},
+		{"0 0 15 * *", at(3, 3, 0, 0), false},
+		{"0 0 * * 0", at(3, 15, 0, 0), false},
+
+		// either of them if both are restricted
+		{"0 0 15 * 0", at(3, 15, 0, 0), true},
+		{"0 0 15 * 0", at(3, 3, 0, 0), true},
+		{"0 0 15 * 0", at(3, 4, 0, 0), false},
+	}
+
+	for _, tt := range tests {
+		if got := mustCron(t, tt.expr).Match(tt.t); got != tt.want {
+			t.Errorf("%q at %s: expected %t, got %t", tt.expr, tt.t.Format("Mon Jan 2 15:04"), tt.want, got)
+		}
+	}
+
+	if (Cron{}).Match(at(3, 1, 0, 0)) {
+		t.Errorf("expected the empty expression never to match")
+	}
+}
@@ -0,0 +1,226 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/message"
+)
+
+// maxMissedMinutes limits how far back Due looks for the minutes the cron expression fired at
+const maxMissedMinutes = 24 * 60
+
+// Window is the time of day range, the end is exclusive, the window wraps around midnight if the end is before
+// the start, i.e. 22:00-04:00
+type Window struct {
+	start, end time.Duration // since midnight
+}
+
+// ParseWindow parses the range of the form HH:MM-HH:MM
+func ParseWindow(s string) (Window, error) {
+	var w Window
+
+	// the en dash of the copy-pasted ranges is accepted as well
+	bounds := strings.Split(strings.Replace(s, "\u2013", "-", -1), "-")
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+
+	for i, dst := range []*time.Duration{&w.start, &w.end} {
+		t, err := time.Parse("15:04", strings.TrimSpace(bounds[i]))
+		if err != nil {
+			return w, fmt.Errorf("invalid time %q", bounds[i])
+		}
+		*dst = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	if w.start == w.end {
+		return w, fmt.Errorf("start and end are the same")
+	}
+
+	return w, nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (w *Window) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parsed, err := ParseWindow(s)
+	if err != nil {
+		return fmt.Errorf("invalid window %q: %v", s, err)
+	}
+	*w = parsed
+
+	return nil
+}
+
+// String implements Stringer
+func (w Window) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+
+	return format(w.start) + "-" + format(w.end)
+}
+
+// Contains returns true if the time of day falls within the window
+func (w Window) Contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	if w.start < w.end {
+		return d >= w.start && d < w.end
+	}
+
+	return d >= w.start || d < w.end
+}
+
+// Table overrides the schedule for the table
+type Table struct {
+	Windows []Window `yaml:"windows"` // replace the global windows if set
+	Cron    Cron     `yaml:"cron"`    // replaces the global cron expression if set
+}
+
+// Config describes when the basebackups may run and when they are queued regardless of the changes
+type Config struct {
+	Timezone string           `yaml:"timezone"` // of the windows and the cron expressions, the local one by default
+	Windows  []Window         `yaml:"windows"`  // basebackups start only within the windows, anytime if none set
+	Cron     Cron             `yaml:"cron"`     // queue every table for the basebackup when the expression fires
+	Tables   map[string]Table `yaml:"tables"`   // by the table name, i.e. public.orders, the schema is public if omitted
+
+	location *time.Location
+}
+
+// Validate checks the settings and loads the timezone
+func (c *Config) Validate() error {
+	c.location = time.Local
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone: %v", err)
+		}
+		c.location = loc
+	}
+
+	tables := make(map[string]Table, len(c.Tables))
+	for name, t := range c.Tables {
+		key := tableKey(name)
+		if _, ok := tables[key]; ok {
+			return fmt.Errorf("table %q is listed more than once", name)
+		}
+		tables[key] = t
+	}
+	c.Tables = tables
+
+	return nil
+}
+
+// IsSet returns true if any window or cron expression is configured
+func (c Config) IsSet() bool {
+	if len(c.Windows) > 0 || !c.Cron.IsZero() {
+		return true
+	}
+
+	for _, t := range c.Tables {
+		if len(t.Windows) > 0 || !t.Cron.IsZero() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tableKey returns the name the way the tables are named in the backup, i.e. without the public schema
+func tableKey(name string) string {
+	return message.ParseNamespacedName(name).String()
+}
+
+func (c Config) in(t time.Time) time.Time {
+	if c.location == nil {
+		return t
+	}
+
+	return t.In(c.location)
+}
+
+func (c Config) windows(table string) []Window {
+	if t, ok := c.Tables[tableKey(table)]; ok && len(t.Windows) > 0 {
+		return t.Windows
+	}
+
+	return c.Windows
+}
+
+func (c Config) cron(table string) Cron {
+	if t, ok := c.Tables[tableKey(table)]; ok && !t.Cron.IsZero() {
+		return t.Cron
+	}
+
+	return c.Cron
+}
+
+// Allowed returns true if the basebackup of the table may start at the given time
+func (c Config) Allowed(table string, t time.Time) bool {
+	windows := c.windows(table)
+	if len(windows) == 0 {
+		return true
+	}
+
+	t = c.in(t)
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Due returns true if the cron expression of the table fired after the from time up to the to time inclusive
+func (c Config) Due(table string, from, to time.Time) bool {
+	cron := c.cron(table)
+	if cron.IsZero() {
+		return false
+	}
+
+	from, to = c.in(from).Truncate(time.Minute), c.in(to)
+	if to.Sub(from) > maxMissedMinutes*time.Minute {
+		from = to.Add(-maxMissedMinutes * time.Minute).Truncate(time.Minute)
+	}
+
+	for m := from.Add(time.Minute); !m.After(to); m = m.Add(time.Minute) {
+		if cron.Match(m) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String implements Stringer
+func (c Config) String() string {
+	windows := make([]string, 0, len(c.Windows))
+	for _, w := range c.Windows {
+		windows = append(windows, w.String())
+	}
+	if len(windows) == 0 {
+		windows = append(windows, "any time")
+	}
+
+	cron := c.Cron.String()
+	if cron == "" {
+		cron = "none"
+	}
+
+	tz := c.Timezone
+	if tz == "" {
+		tz = "local"
+	}
+
+	return fmt.Sprintf("windows: %s cron: %s timezone: %s table overrides: %d",
+		strings.Join(windows, ","), cron, tz, len(c.Tables))
+}
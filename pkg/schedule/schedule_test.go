@@ -0,0 +1,184 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		window string
+		err    bool
+		want   string
+	}{
+		{"01:00-05:00", false, "01:00-05:00"},
+		{" 22:00 - 04:30 ", false, "22:00-04:30"},
+		{"01:00–05:00", false, "01:00-05:00"}, // en dash
+		{"00:00-23:59", false, "00:00-23:59"},
+		{"01:00-01:00", true, ""},
+		{"01:00", true, ""},
+		{"01:00-02:00-03:00", true, ""},
+		{"1am-5am", true, ""},
+		{"24:00-01:00", true, ""},
+		{"01:60-02:00", true, ""},
+	}
+
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.window)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %s", tt.window, w)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.window, err)
+		} else if w.String() != tt.want {
+			t.Errorf("%q: expected %s, got %s", tt.window, tt.want, w)
+		}
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	at := func(hour, min, sec int) time.Time {
+		return time.Date(2024, 3, 1, hour, min, sec, 0, time.UTC)
+	}
+
+	tests := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"01:00-05:00", at(1, 0, 0), true},
+		{"01:00-05:00", at(4, 59, 59), true},
+		{"01:00-05:00", at(5, 0, 0), false}, // the end is exclusive
+		{"01:00-05:00", at(0, 59, 59), false},
+		{"22:00-04:00", at(23, 30, 0), true}, // wraps around midnight
+		{"22:00-04:00", at(0, 0, 0), true},
+		{"22:00-04:00", at(3, 59, 0), true},
+		{"22:00-04:00", at(4, 0, 0), false},
+		{"22:00-04:00", at(12, 0, 0), false},
+		{"22:00-04:00", at(21, 59, 59), false},
+	}
+
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.window)
+		if err != nil {
+			t.Fatalf("%q: could not parse: %v", tt.window, err)
+		}
+
+		if got := w.Contains(tt.t); got != tt.want {
+			t.Errorf("%s contains %s: expected %t, got %t", tt.window, tt.t.Format("15:04:05"), tt.want, got)
+		}
+	}
+}
+
+func testConfig(t *testing.T, c Config) Config {
+	if err := c.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	return c
+}
+
+func mustWindow(t *testing.T, s string) Window {
+	w, err := ParseWindow(s)
+	if err != nil {
+		t.Fatalf("could not parse window %q: %v", s, err)
+	}
+
+	return w
+}
+
+func TestAllowed(t *testing.T) {
+	c := testConfig(t, Config{
+		Timezone: "UTC",
+		Windows:  []Window{mustWindow(t, "01:00-05:00"), mustWindow(t, "22:00-23:00")},
+		Tables: map[string]Table{
+			"orders":     {Windows: []Window{mustWindow(t, "12:00-13:00")}},
+			"public.log": {Cron: mustCron(t, "0 * * * *")}, // keeps the global windows
+		},
+	})
+
+	noon := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	night := time.Date(2024, 3, 1, 2, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		table string
+		t     time.Time
+		want  bool
+	}{
+		{"public.users", night, true},
+		{"public.users", noon, false},
+		{"public.orders", noon, true},
+		{"public.orders", night, false},
+		{"log", night, true},
+		{"log", noon, false},
+	}
+
+	for _, tt := range tests {
+		if got := c.Allowed(tt.table, tt.t); got != tt.want {
+			t.Errorf("%s at %s: expected %t, got %t", tt.table, tt.t.Format("15:04"), tt.want, got)
+		}
+	}
+
+	if !testConfig(t, Config{}).Allowed("public.users", noon) {
+		t.Errorf("expected any time to be allowed without windows")
+	}
+}
+
+func TestAllowedTimezone(t *testing.T) {
+	c := testConfig(t, Config{Timezone: "Europe/Berlin", Windows: []Window{mustWindow(t, "01:00-05:00")}})
+
+	// 01:30 in Berlin in winter
+	if !c.Allowed("t", time.Date(2024, 1, 15, 0, 30, 0, 0, time.UTC)) {
+		t.Errorf("expected the window to be in the configured timezone")
+	}
+	if c.Allowed("t", time.Date(2024, 1, 15, 4, 30, 0, 0, time.UTC)) {
+		t.Errorf("expected 05:30 in the configured timezone to be outside of the window")
+	}
+}
+
+func TestDue(t *testing.T) {
+	c := testConfig(t, Config{
+		Timezone: "UTC",
+		Cron:     mustCron(t, "30 2 * * *"),
+		Tables: map[string]Table{
+			"orders":  {Cron: mustCron(t, "*/15 * * * *")},
+			"monthly": {Cron: mustCron(t, "30 2 1 * *")},
+		},
+	})
+	at := func(day, hour, min, sec int) time.Time {
+		return time.Date(2024, 3, day, hour, min, sec, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name     string
+		table    string
+		from, to time.Time
+		want     bool
+	}{
+		{"fires within the tick", "t", at(1, 2, 29, 50), at(1, 2, 30, 5), true},
+		{"fired at the start of the previous tick", "t", at(1, 2, 30, 0), at(1, 2, 30, 40), false},
+		{"fires at the end inclusive", "t", at(1, 2, 29, 0), at(1, 2, 30, 0), true},
+		{"not yet", "t", at(1, 2, 0, 0), at(1, 2, 29, 59), false},
+		{"missed minutes after a pause", "t", at(1, 1, 0, 0), at(1, 3, 0, 0), true},
+		{"missed day", "t", at(1, 3, 0, 0), at(2, 3, 0, 0), true},
+		{"missed day of month", "monthly", at(1, 2, 0, 0), at(2, 1, 0, 0), true},
+		{"only the last day of a longer pause is checked", "monthly", at(1, 2, 0, 0), at(3, 2, 0, 0), false},
+		{"table override", "public.orders", at(1, 2, 14, 30), at(1, 2, 15, 10), true},
+		{"table override replaces the global cron", "orders", at(1, 2, 29, 50), at(1, 2, 30, 5), true},
+		{"table override between the firings", "orders", at(1, 2, 16, 0), at(1, 2, 29, 0), false},
+	}
+
+	for _, tt := range tests {
+		if got := c.Due(tt.table, tt.from, tt.to); got != tt.want {
+			t.Errorf("%s: expected %t, got %t", tt.name, tt.want, got)
+		}
+	}
+
+	if testConfig(t, Config{}).Due("t", at(1, 0, 0, 0), at(2, 0, 0, 0)) {
+		t.Errorf("expected nothing due without the cron expression")
+	}
+}
@@ -0,0 +1,184 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/cdc"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
+)
+
+const (
+	minRetryInterval = time.Second
+	maxRetryInterval = time.Minute
+)
+
+// Fanout collects the change events of the transaction and delivers the committed transaction to every sink. Each
+// sink has its own queue and retries the delivery until it succeeds, the transactions not delivered yet hold the
+// confirmed lsn of the slot back, see PendingLSN.
+type Fanout struct {
+	ctx      context.Context
+	exporter *cdc.Exporter
+	buf      *bytes.Buffer
+	txLSN    dbutils.LSN
+	workers  []*worker
+}
+
+type worker struct {
+	sink  Sink
+	queue chan Transaction
+
+	mu      sync.Mutex
+	pending []dbutils.LSN // final lsns of the queued transactions, the oldest first
+}
+
+// NewFanout instantiates the sinks
+func NewFanout(ctx context.Context, cfgs []Config) (*Fanout, error) {
+	buf := &bytes.Buffer{}
+	f := &Fanout{
+		ctx:      ctx,
+		exporter: cdc.New(buf),
+		buf:      buf,
+		workers:  make([]*worker, 0, len(cfgs)),
+	}
+
+	for _, cfg := range cfgs {
+		s, err := New(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("could not init sink %s: %v", cfg, err)
+		}
+
+		f.workers = append(f.workers, &worker{
+			sink:    s,
+			queue:   make(chan Transaction, cfg.QueueSize),
+			pending: make([]dbutils.LSN, 0),
+		})
+	}
+
+	return f, nil
+}
+
+// Run starts the delivery to the sinks
+func (f *Fanout) Run(wg *sync.WaitGroup) {
+	for _, w := range f.workers {
+		wg.Add(1)
+		go w.run(f.ctx, wg)
+	}
+}
+
+// HandleMessage adds the change events of the message to the current transaction
+func (f *Fanout) HandleMessage(msg message.Message) error {
+	if begin, ok := msg.(message.Begin); ok {
+		f.buf.Reset()
+		f.txLSN = begin.FinalLSN
+	}
+
+	return f.exporter.HandleMessage(msg)
+}
+
+// Commit queues the current transaction to every sink, blocks while the queue of a sink is full
+func (f *Fanout) Commit() error {
+	if f.buf.Len() == 0 {
+		return nil
+	}
+
+	tx := Transaction{
+		LSN:    f.txLSN,
+		Events: make([]byte, f.buf.Len()),
+	}
+	copy(tx.Events, f.buf.Bytes())
+	f.buf.Reset()
+
+	for _, w := range f.workers {
+		w.mu.Lock()
+		w.pending = append(w.pending, tx.LSN)
+		w.mu.Unlock()
+
+		select {
+		case w.queue <- tx:
+		case <-f.ctx.Done():
+			return f.ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// PendingLSN returns the final lsn of the oldest transaction not delivered to some of the sinks
+func (f *Fanout) PendingLSN() (dbutils.LSN, bool) {
+	lsn := dbutils.InvalidLSN
+
+	for _, w := range f.workers {
+		w.mu.Lock()
+		if len(w.pending) > 0 && (!lsn.IsValid() || w.pending[0] < lsn) {
+			lsn = w.pending[0]
+		}
+		w.mu.Unlock()
+	}
+
+	return lsn, lsn.IsValid()
+}
+
+// ConfirmableLSN returns the lsn the slot can be confirmed up to given the flush lsn of the backup: the transactions
+// not delivered to some of the sinks are to be received again after the restart
+func (f *Fanout) ConfirmableLSN(flushLSN dbutils.LSN) dbutils.LSN {
+	if pendingLSN, ok := f.PendingLSN(); ok && flushLSN >= pendingLSN {
+		return pendingLSN - 1
+	}
+
+	return flushLSN
+}
+
+func (w *worker) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() {
+		if err := w.sink.Close(); err != nil {
+			slog.Warn("could not close sink", "sink", w.sink, "error", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tx := <-w.queue:
+			if !w.deliver(ctx, tx) {
+				return
+			}
+
+			w.mu.Lock()
+			w.pending = w.pending[1:]
+			w.mu.Unlock()
+		}
+	}
+}
+
+// deliver retries the delivery until it succeeds, returns false if the context is done first
+func (w *worker) deliver(ctx context.Context, tx Transaction) bool {
+	interval := minRetryInterval
+
+	for {
+		err := w.sink.Deliver(tx)
+		if err == nil {
+			return true
+		}
+		slog.Warn("could not deliver transaction to sink", logger.LSN, tx.LSN, "sink", w.sink, "retryIn", interval,
+			"error", err)
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > maxRetryInterval {
+			interval = maxRetryInterval
+		}
+	}
+}
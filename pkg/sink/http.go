@@ -0,0 +1,60 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const contentType = "application/x-ndjson"
+
+// webhook posts the events of the transaction, the 2xx response acknowledges the transaction
+type webhook struct {
+	cfg    Config
+	client *http.Client
+}
+
+func newHTTP(cfg Config) *webhook {
+	return &webhook{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+	}
+}
+
+// Deliver implements Sink
+func (w *webhook) Deliver(tx Transaction) error {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.Address, bytes.NewReader(tx.Events))
+	if err != nil {
+		return fmt.Errorf("could not create request: %v", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Lsn", tx.LSN.String())
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not post: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// drain the body to reuse the connection
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+// Close implements Sink
+func (w *webhook) Close() error {
+	return nil
+}
+
+// String implements Stringer
+func (w *webhook) String() string {
+	return w.cfg.String()
+}
@@ -0,0 +1,60 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// pipe writes the events of the transaction followed by the empty line to the named pipe; the pipe has no way to
+// acknowledge, so the transaction counts as delivered once written. The delivery fails while there is no reader.
+type pipe struct {
+	cfg Config
+	fp  *os.File
+}
+
+func newPipe(cfg Config) *pipe {
+	return &pipe{cfg: cfg}
+}
+
+// Deliver implements Sink, the pipe is reopened on the next delivery after a failure, i.e. when the reader is gone
+func (p *pipe) Deliver(tx Transaction) error {
+	if p.fp == nil {
+		// non-blocking open fails instead of waiting for the reader
+		fp, err := os.OpenFile(p.cfg.Address, os.O_WRONLY|syscall.O_NONBLOCK, os.ModeNamedPipe)
+		if err != nil {
+			return fmt.Errorf("could not open pipe: %v", err)
+		}
+		p.fp = fp
+	}
+
+	if err := p.fp.SetWriteDeadline(time.Now().Add(time.Duration(p.cfg.Timeout))); err != nil {
+		p.Close()
+		return fmt.Errorf("could not set deadline: %v", err)
+	}
+
+	if _, err := p.fp.Write(frame(tx)); err != nil {
+		p.Close()
+		return fmt.Errorf("could not write: %v", err)
+	}
+
+	return nil
+}
+
+// Close implements Sink
+func (p *pipe) Close() error {
+	if p.fp == nil {
+		return nil
+	}
+
+	err := p.fp.Close()
+	p.fp = nil
+
+	return err
+}
+
+// String implements Stringer
+func (p *pipe) String() string {
+	return p.cfg.String()
+}
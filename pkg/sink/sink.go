@@ -0,0 +1,103 @@
+package sink
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+const (
+	// TypeUnix represents the unix domain socket the transactions are written to
+	TypeUnix = "unix"
+	// TypeHTTP represents the webhook the transactions are posted to
+	TypeHTTP = "http"
+	// TypePipe represents the named pipe the transactions are written to
+	TypePipe = "pipe"
+
+	defaultTimeout   = 30 * time.Second
+	defaultQueueSize = 1024
+)
+
+// Transaction is the committed transaction to deliver
+type Transaction struct {
+	LSN    dbutils.LSN // final lsn of the transaction
+	Events []byte      // change events of the transaction as JSON Lines, see the cdc package
+}
+
+// Sink is the destination of the committed transactions
+type Sink interface {
+	// Deliver returns once the destination acknowledged the transaction
+	Deliver(tx Transaction) error
+	Close() error
+	String() string
+}
+
+// Config describes the sink
+type Config struct {
+	Type      string         `yaml:"type"`      // unix, http or pipe
+	Address   string         `yaml:"address"`   // path of the socket or the pipe, or the url of the webhook
+	Timeout   utils.Duration `yaml:"timeout"`   // time to wait for the acknowledgement
+	QueueSize int            `yaml:"queueSize"` // transactions waiting for the delivery before the backup blocks
+}
+
+// Validate checks the sink settings and sets the defaults
+func (c *Config) Validate() error {
+	if c.Address == "" {
+		return fmt.Errorf("address is not set")
+	}
+
+	switch c.Type {
+	case TypeUnix, TypePipe:
+	case TypeHTTP:
+		if u, err := url.Parse(c.Address); err != nil {
+			return fmt.Errorf("invalid url: %v", err)
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("url must be http or https")
+		}
+	default:
+		return fmt.Errorf("unknown sink type: %q", c.Type)
+	}
+
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	} else if c.Timeout == 0 {
+		c.Timeout = utils.Duration(defaultTimeout)
+	}
+
+	if c.QueueSize < 0 {
+		return fmt.Errorf("queueSize must not be negative")
+	} else if c.QueueSize == 0 {
+		c.QueueSize = defaultQueueSize
+	}
+
+	return nil
+}
+
+// String implements Stringer
+func (c Config) String() string {
+	return fmt.Sprintf("%s:%s", c.Type, c.Address)
+}
+
+// New instantiates the sink
+func New(cfg Config) (Sink, error) {
+	switch cfg.Type {
+	case TypeUnix:
+		return newUnix(cfg), nil
+	case TypeHTTP:
+		return newHTTP(cfg), nil
+	case TypePipe:
+		return newPipe(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown sink type: %q", cfg.Type)
+	}
+}
+
+// frame returns the events of the transaction followed by the empty line marking the end of the transaction
+func frame(tx Transaction) []byte {
+	buf := make([]byte, 0, len(tx.Events)+1)
+
+	return append(append(buf, tx.Events...), '\n')
+}
@@ -0,0 +1,254 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+const (
+	testOID     dbutils.OID = 16384
+	testTimeout             = 5 * time.Second
+)
+
+var testTx = Transaction{LSN: 0x1100, Events: []byte(`{"op":"c"}` + "\n")}
+
+func testConfig(t *testing.T, typ, address string) Config {
+	cfg := Config{Type: typ, Address: address, Timeout: utils.Duration(time.Second)}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+
+	return cfg
+}
+
+// commitTx passes the transaction inserting a row to the fanout
+func commitTx(t *testing.T, f *Fanout, lsn dbutils.LSN) {
+	msgs := []message.Message{
+		message.Begin{FinalLSN: lsn, XID: 1},
+		message.Insert{RelationOID: testOID, NewRow: []message.TupleData{{Kind: message.TupleText, Value: []byte("1")}}},
+		message.Commit{LSN: lsn, TransactionLSN: lsn + 1},
+	}
+
+	for _, msg := range msgs {
+		if err := f.HandleMessage(msg); err != nil {
+			t.Fatalf("could not handle message: %v", err)
+		}
+	}
+
+	if err := f.Commit(); err != nil {
+		t.Fatalf("could not commit: %v", err)
+	}
+}
+
+// waitFor polls the condition until it holds or the timeout expires
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(testTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestFanoutWebhook(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		bodies   []string
+	)
+	release := make(chan struct{})
+	releaseOnce := sync.Once{}
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mu.Lock()
+		requests++
+		attempt := requests
+		bodies = append(bodies, r.Header.Get("X-Lsn")+" "+string(body))
+		mu.Unlock()
+
+		// the first delivery fails, the retry waits for the test to acknowledge it
+		if attempt == 1 {
+			http.Error(w, "not yet", http.StatusServiceUnavailable)
+			return
+		}
+		<-release
+	}))
+	defer srv.Close()
+	defer unblock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	f, err := NewFanout(ctx, []Config{testConfig(t, TypeHTTP, srv.URL)})
+	if err != nil {
+		t.Fatalf("could not create fanout: %v", err)
+	}
+	f.exporter.SetRelation(message.Relation{
+		OID:            testOID,
+		NamespacedName: message.NamespacedName{Namespace: "public", Name: "t"},
+		Columns:        []message.Column{{Name: "id", IsKey: true}},
+	})
+
+	wg := &sync.WaitGroup{}
+	f.Run(wg)
+	defer wg.Wait()
+	defer cancel()
+
+	if lsn := f.ConfirmableLSN(0x1000); lsn != 0x1000 {
+		t.Errorf("expected the flush lsn to be confirmable without pending transactions, got %s", lsn)
+	}
+
+	commitTx(t, f, 0x1100)
+
+	if lsn, ok := f.PendingLSN(); !ok || lsn != 0x1100 {
+		t.Fatalf("expected the transaction to be pending, got %s, %t", lsn, ok)
+	}
+
+	retried := waitFor(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return requests == 2
+	})
+	if !retried {
+		t.Fatalf("expected the delivery to be retried")
+	}
+
+	// the retry is in flight, the slot must not be confirmed past the transaction
+	if lsn := f.ConfirmableLSN(0x1200); lsn != 0x10FF {
+		t.Errorf("expected the confirmable lsn to be held back before the pending transaction, got %s", lsn)
+	}
+	if lsn := f.ConfirmableLSN(0x1000); lsn != 0x1000 {
+		t.Errorf("expected the flush lsn prior to the pending transaction to be confirmable, got %s", lsn)
+	}
+
+	unblock()
+
+	if !waitFor(func() bool { _, ok := f.PendingLSN(); return !ok }) {
+		t.Fatalf("expected the transaction to be acknowledged")
+	}
+	if lsn := f.ConfirmableLSN(0x1200); lsn != 0x1200 {
+		t.Errorf("expected the flush lsn to be confirmable after the acknowledgement, got %s", lsn)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, body := range bodies {
+		if !strings.HasPrefix(body, "0/1100 ") || !strings.Contains(body, `"op":"c"`) {
+			t.Errorf("unexpected request: %q", body)
+		}
+	}
+}
+
+func TestUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "sink.sock")
+	s := newUnix(testConfig(t, TypeUnix, socket))
+	defer s.Close()
+
+	if err := s.Deliver(testTx); err == nil {
+		t.Fatalf("expected the delivery to fail without the listener")
+	}
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer l.Close()
+
+	received := make(chan string, 2)
+	go func() {
+		for ack := false; ; ack = true {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			// read the transaction up to the empty line, the first connection is dropped without acknowledging it
+			r := bufio.NewReader(conn)
+			lines := make([]string, 0)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil || line == "\n" {
+					break
+				}
+				lines = append(lines, line)
+			}
+			received <- strings.Join(lines, "")
+
+			if ack {
+				conn.Write([]byte("ok\n"))
+			}
+			conn.Close()
+		}
+	}()
+
+	if err := s.Deliver(testTx); err == nil {
+		t.Fatalf("expected the delivery without the acknowledgement to fail")
+	}
+	if err := s.Deliver(testTx); err != nil {
+		t.Fatalf("could not deliver: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if events := <-received; events != string(testTx.Events) {
+			t.Errorf("unexpected events received: %q", events)
+		}
+	}
+}
+
+func TestPipe(t *testing.T) {
+	fifo := filepath.Join(t.TempDir(), "sink.fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatalf("could not create fifo: %v", err)
+	}
+
+	p := newPipe(testConfig(t, TypePipe, fifo))
+	defer p.Close()
+
+	if err := p.Deliver(testTx); err == nil {
+		t.Fatalf("expected the delivery to fail without the reader")
+	}
+
+	received := make(chan string, 1)
+	go func() {
+		fp, err := os.Open(fifo)
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer fp.Close()
+
+		r := bufio.NewReader(fp)
+		events, _ := r.ReadString('\n')
+		blank, _ := r.ReadString('\n')
+		received <- events + blank
+	}()
+
+	delivered := waitFor(func() bool { return p.Deliver(testTx) == nil })
+	if !delivered {
+		t.Fatalf("could not deliver to the pipe")
+	}
+
+	if frame := <-received; frame != string(testTx.Events)+"\n" {
+		t.Errorf("unexpected frame received: %q", frame)
+	}
+}
@@ -0,0 +1,72 @@
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+)
+
+// unix writes the events of the transaction followed by the empty line to the socket and waits for the peer to
+// acknowledge the transaction with a line back
+type unix struct {
+	cfg    Config
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newUnix(cfg Config) *unix {
+	return &unix{cfg: cfg}
+}
+
+// Deliver implements Sink, the connection is reestablished on the next delivery after a failure
+func (u *unix) Deliver(tx Transaction) error {
+	if u.conn == nil {
+		conn, err := net.DialTimeout("unix", u.cfg.Address, time.Duration(u.cfg.Timeout))
+		if err != nil {
+			return fmt.Errorf("could not connect: %v", err)
+		}
+		u.conn = conn
+		u.reader = bufio.NewReader(conn)
+	}
+
+	if err := u.deliver(tx); err != nil {
+		u.Close()
+		return err
+	}
+
+	return nil
+}
+
+func (u *unix) deliver(tx Transaction) error {
+	if err := u.conn.SetDeadline(time.Now().Add(time.Duration(u.cfg.Timeout))); err != nil {
+		return fmt.Errorf("could not set deadline: %v", err)
+	}
+
+	if _, err := u.conn.Write(frame(tx)); err != nil {
+		return fmt.Errorf("could not write: %v", err)
+	}
+
+	if _, err := u.reader.ReadString('\n'); err != nil {
+		return fmt.Errorf("could not read acknowledgement: %v", err)
+	}
+
+	return nil
+}
+
+// Close implements Sink
+func (u *unix) Close() error {
+	if u.conn == nil {
+		return nil
+	}
+
+	err := u.conn.Close()
+	u.conn = nil
+
+	return err
+}
+
+// String implements Stringer
+func (u *unix) String() string {
+	return u.cfg.String()
+}
@@ -0,0 +1,290 @@
+package slotmonitor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx"
+
+	"github.com/mkabilov/logical_backup/pkg/prometheus"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
+)
+
+const (
+	defaultInterval    = time.Minute
+	defaultWarnPercent = 80
+
+	// wal_status and safe_wal_size of pg_replication_slots appeared in PostgreSQL 13
+	walStatusVersion = 130000
+
+	walStatusLost = "lost"
+)
+
+// walStatuses are the possible values of pg_replication_slots.wal_status
+var walStatuses = []string{"reserved", "extended", "unreserved", walStatusLost}
+
+// Config describes the polling of the replication slot
+type Config struct {
+	Interval         time.Duration `yaml:"interval"`         // how often the slot is polled
+	RetentionLimitMB uint          `yaml:"retentionLimitMB"` // wal retained by the slot the warnings refer to, 0 to disable
+	WarnPercent      uint          `yaml:"warnPercent"`      // percentage of the limit to start warning at
+}
+
+// Validate checks the settings and sets the defaults
+func (c *Config) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must not be negative")
+	} else if c.Interval == 0 {
+		c.Interval = defaultInterval
+	}
+
+	if c.WarnPercent > 100 {
+		return fmt.Errorf("warnPercent must not be greater than 100")
+	} else if c.WarnPercent == 0 {
+		c.WarnPercent = defaultWarnPercent
+	}
+
+	return nil
+}
+
+// Status is the state of the replication slot as of the last poll
+type Status struct {
+	Active            bool        `json:"active"`
+	RestartLSN        dbutils.LSN `json:"restartLSN"`
+	ConfirmedFlushLSN dbutils.LSN `json:"confirmedFlushLSN"`
+	CurrentLSN        dbutils.LSN `json:"currentLSN"`    // pg_current_wal_lsn() of the server
+	LagBytes          uint64      `json:"lagBytes"`      // wal not confirmed by the backup yet
+	RetainedBytes     uint64      `json:"retainedBytes"` // wal kept on the server because of the slot
+	WALStatus         string      `json:"walStatus"`     // empty before PostgreSQL 13
+	SafeWALSize       *int64      `json:"safeWALSize"`   // nil before PostgreSQL 13 or if max_slot_wal_keep_size is not set
+	PolledAt          time.Time   `json:"polledAt"`
+}
+
+// Monitor polls the replication slot and the wal position of the server
+type Monitor struct {
+	ctx      context.Context
+	cfg      Config
+	dbCfg    pgx.ConnConfig
+	slotName string
+	prom     promexporter.PromInterface
+
+	conn    *pgx.Conn
+	version int
+
+	mu     sync.Mutex
+	status Status
+}
+
+// New instantiates the monitor
+func New(ctx context.Context, cfg Config, dbCfg pgx.ConnConfig, slotName string, prom promexporter.PromInterface) *Monitor {
+	return &Monitor{
+		ctx:      ctx,
+		cfg:      cfg,
+		dbCfg:    dbCfg,
+		slotName: slotName,
+		prom:     prom,
+	}
+}
+
+// Status returns the state of the slot as of the last successful poll, false if there was none yet
+func (m *Monitor) Status() (Status, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.status, !m.status.PolledAt.IsZero()
+}
+
+// Run polls the slot until the context is done
+func (m *Monitor) Run(wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer m.disconnect()
+
+		ticker := time.NewTicker(m.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			if err := m.poll(); err != nil {
+				slog.Error("could not poll replication slot", "slot", m.slotName, "error", err)
+				m.disconnect()
+			}
+
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (m *Monitor) connect() error {
+	if m.conn != nil {
+		return nil
+	}
+
+	conn, err := pgx.Connect(m.dbCfg)
+	if err != nil {
+		return fmt.Errorf("could not connect: %v", err)
+	}
+
+	if err := conn.QueryRowEx(m.ctx, "select current_setting('server_version_num')::int", nil).Scan(&m.version); err != nil {
+		if err := conn.Close(); err != nil {
+			slog.Warn("could not close db connection", "error", err)
+		}
+
+		return fmt.Errorf("could not get server version: %v", err)
+	}
+	m.conn = conn
+
+	return nil
+}
+
+func (m *Monitor) disconnect() {
+	if m.conn == nil {
+		return
+	}
+
+	if err := m.conn.Close(); err != nil {
+		slog.Warn("could not close db connection", "error", err)
+	}
+	m.conn = nil
+}
+
+func (m *Monitor) poll() error {
+	if err := m.connect(); err != nil {
+		return err
+	}
+
+	query := `select active, restart_lsn::text, confirmed_flush_lsn::text, pg_current_wal_lsn()::text,
+		null::text, null::bigint
+		from pg_replication_slots where slot_name = $1`
+	if m.version >= walStatusVersion {
+		query = `select active, restart_lsn::text, confirmed_flush_lsn::text, pg_current_wal_lsn()::text,
+			wal_status, safe_wal_size
+			from pg_replication_slots where slot_name = $1`
+	}
+
+	var (
+		active                           bool
+		restartLSN, flushLSN, currentLSN sql.NullString
+		walStatus                        sql.NullString
+		safeWALSize                      sql.NullInt64
+	)
+
+	err := m.conn.QueryRowEx(m.ctx, query, nil, m.slotName).
+		Scan(&active, &restartLSN, &flushLSN, &currentLSN, &walStatus, &safeWALSize)
+	if err == pgx.ErrNoRows {
+		slog.Warn("replication slot does not exist", "slot", m.slotName)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not query replication slot: %v", err)
+	}
+
+	status := Status{
+		Active:    active,
+		WALStatus: walStatus.String,
+		PolledAt:  time.Now(),
+	}
+
+	for _, l := range []struct {
+		str sql.NullString
+		lsn *dbutils.LSN
+	}{{restartLSN, &status.RestartLSN}, {flushLSN, &status.ConfirmedFlushLSN}, {currentLSN, &status.CurrentLSN}} {
+		if !l.str.Valid {
+			continue
+		}
+
+		if err := l.lsn.Parse(l.str.String); err != nil {
+			return fmt.Errorf("could not parse lsn: %v", err)
+		}
+	}
+
+	if safeWALSize.Valid {
+		status.SafeWALSize = &safeWALSize.Int64
+	}
+
+	status.LagBytes = bytesBehind(status.CurrentLSN, status.ConfirmedFlushLSN)
+	status.RetainedBytes = bytesBehind(status.CurrentLSN, status.RestartLSN)
+
+	m.mu.Lock()
+	m.status = status
+	m.mu.Unlock()
+
+	m.updateMetrics(status)
+	m.warn(status)
+
+	return nil
+}
+
+// bytesBehind returns the amount of wal between the lsns, 0 if the lsn is not known
+func bytesBehind(current, lsn dbutils.LSN) uint64 {
+	if !lsn.IsValid() || lsn > current {
+		return 0
+	}
+
+	return uint64(current - lsn)
+}
+
+// warn logs the warning if the slot is close to the retention limit or the server is about to remove the wal
+func (m *Monitor) warn(status Status) {
+	if m.cfg.RetentionLimitMB > 0 {
+		limit := uint64(m.cfg.RetentionLimitMB) << 20
+		if status.RetainedBytes >= limit*uint64(m.cfg.WarnPercent)/100 {
+			slog.Warn("replication slot is close to the wal retention limit", "slot", m.slotName,
+				"retainedMB", status.RetainedBytes>>20, "percent", status.RetainedBytes*100/limit,
+				"limitMB", m.cfg.RetentionLimitMB, logger.LSN, status.RestartLSN)
+		}
+	}
+
+	switch status.WALStatus {
+	case "unreserved":
+		slog.Warn("replication slot is about to lose the wal it needs", "slot", m.slotName,
+			logger.LSN, status.RestartLSN)
+	case walStatusLost:
+		slog.Error("replication slot lost the wal it needs, the backup can not continue", "slot", m.slotName)
+	}
+}
+
+func (m *Monitor) updateMetrics(status Status) {
+	set := func(name string, value float64, labelValues []string) {
+		if err := m.prom.Set(name, value, labelValues); err != nil {
+			slog.Warn("could not set metric", "metric", name, "error", err)
+		}
+	}
+
+	active := 0.0
+	if status.Active {
+		active = 1
+	}
+
+	set(promexporter.SlotActiveGauge, active, nil)
+	set(promexporter.SlotLagBytesGauge, float64(status.LagBytes), nil)
+	set(promexporter.SlotRetainedBytesGauge, float64(status.RetainedBytes), nil)
+	set(promexporter.ServerWALLSNGauge, float64(status.CurrentLSN), nil)
+
+	if m.version < walStatusVersion {
+		return
+	}
+
+	if status.SafeWALSize != nil {
+		set(promexporter.SlotSafeWALSizeGauge, float64(*status.SafeWALSize), nil)
+	} else {
+		set(promexporter.SlotSafeWALSizeGauge, -1, nil)
+	}
+
+	for _, s := range walStatuses {
+		value := 0.0
+		if s == status.WALStatus {
+			value = 1
+		}
+
+		set(promexporter.SlotWALStatusGauge, value, []string{s})
+	}
+}
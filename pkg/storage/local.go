@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	filePerms = 0644
+
+	// temporary files of Put are hidden from List, they are left behind if the process dies while writing
+	tempPrefix = "."
+)
+
+type local struct {
+	dir   string
+	fsync bool
+}
+
+// NewLocal instantiates storage in the local directory
+func NewLocal(dir string, fsync bool) *local {
+	return &local{
+		dir:   dir,
+		fsync: fsync,
+	}
+}
+
+func (l *local) filepath(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// Put writes the object into a hidden temporary file and renames it once the whole object is written
+func (l *local) Put(name string, r io.Reader, size int64) error {
+	filename := l.filepath(name)
+
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return fmt.Errorf("could not create directory: %v", err)
+	}
+
+	fp, err := ioutil.TempFile(filepath.Dir(filename), tempPrefix+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temp file: %v", err)
+	}
+	defer func() {
+		fp.Close()
+		if err != nil {
+			os.Remove(fp.Name())
+		}
+	}()
+
+	var n int64
+	if n, err = io.Copy(fp, r); err != nil {
+		return fmt.Errorf("could not write file: %v", err)
+	}
+
+	if size >= 0 && n != size {
+		err = fmt.Errorf("written %d bytes, expected %d", n, size)
+		return err
+	}
+
+	if l.fsync {
+		if err = fp.Sync(); err != nil {
+			return fmt.Errorf("could not sync file: %v", err)
+		}
+	}
+
+	if err = fp.Close(); err != nil {
+		return fmt.Errorf("could not close file: %v", err)
+	}
+
+	// temp files are created readable by the owner only
+	if err = os.Chmod(fp.Name(), filePerms); err != nil {
+		return fmt.Errorf("could not set file permissions: %v", err)
+	}
+
+	if err = os.Rename(fp.Name(), filename); err != nil {
+		return fmt.Errorf("could not rename temp file: %v", err)
+	}
+
+	if l.fsync {
+		if err = syncDir(filepath.Dir(filename)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Get opens the file
+func (l *local) Get(name string) (io.ReadCloser, error) {
+	fp, err := os.Open(l.filepath(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+
+	return fp, err
+}
+
+// List walks the directory, skipping the temporary files
+func (l *local) List(prefix string) ([]Object, error) {
+	objects := make([]Object, 0)
+	root := l.filepath(prefix)
+
+	err := filepath.Walk(root, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filename == root {
+				return nil
+			}
+
+			return err
+		}
+
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), tempPrefix) {
+			return nil
+		}
+
+		name, err := filepath.Rel(l.dir, filename)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, Object{Name: filepath.ToSlash(name), Size: info.Size()})
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not walk %q: %v", root, err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+
+	return objects, nil
+}
+
+// Delete removes the file
+func (l *local) Delete(name string) error {
+	if err := os.Remove(l.filepath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func syncDir(dir string) error {
+	dp, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not open directory %s to sync: %v", dir, err)
+	}
+	defer dp.Close()
+
+	if err := dp.Sync(); err != nil {
+		return fmt.Errorf("could not sync directory %s: %v", dir, err)
+	}
+
+	return nil
+}
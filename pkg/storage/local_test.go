@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalListSkipsTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	l := NewLocal(dir, false)
+
+	if err := l.Put("table/deltas/0000000000001100", strings.NewReader("delta"), 5); err != nil {
+		t.Fatalf("could not put: %v", err)
+	}
+
+	// the temporary file of the put interrupted by a crash
+	leftover := filepath.Join(dir, "table", "deltas", tempPrefix+"0000000000001200.tmp123")
+	if err := ioutil.WriteFile(leftover, []byte("partial"), 0600); err != nil {
+		t.Fatalf("could not write leftover: %v", err)
+	}
+
+	objects, err := l.List("table/deltas")
+	if err != nil {
+		t.Fatalf("could not list: %v", err)
+	}
+
+	if len(objects) != 1 || objects[0].Name != "table/deltas/0000000000001100" || objects[0].Size != 5 {
+		t.Errorf("expected only the stored object, got %v", objects)
+	}
+
+	if err := l.Put("table/deltas/0000000000001300", strings.NewReader("short"), 10); err == nil {
+		t.Errorf("expected the put of the wrong size to fail")
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "table", "deltas"))
+	if err != nil {
+		t.Fatalf("could not read dir: %v", err)
+	}
+	for _, fi := range files {
+		if fi.Name() != "0000000000001100" && filepath.Join(dir, "table", "deltas", fi.Name()) != leftover {
+			t.Errorf("unexpected file left by the failed put: %s", fi.Name())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "table", "deltas", "0000000000001300")); !os.IsNotExist(err) {
+		t.Errorf("expected the failed put not to create the object, got %v", err)
+	}
+}
@@ -0,0 +1,646 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion   = "us-east-1"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3DateFormat      = "20060102T150405Z"
+
+	// there is no timeout for the whole request as the transfer of a large object might take hours, the request
+	// fails instead if the server does not respond or the connection stalls for too long
+	s3DialTimeout           = 30 * time.Second
+	s3ResponseHeaderTimeout = time.Minute
+	s3IdleTimeout           = 5 * time.Minute
+	s3IdleConnTimeout       = 90 * time.Second
+
+	s3PartSize = 64 * 1024 * 1024 // objects larger than that are uploaded in parts
+	s3MaxParts = 10000
+
+	maxErrorBodySize = 4096
+)
+
+// S3Config describes S3-compatible object storage settings
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint"` // i.e. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	Prefix          string `yaml:"prefix"`          // prefix of all object names
+	AccessKeyID     string `yaml:"accessKeyId"`     // defaults to AWS_ACCESS_KEY_ID environment variable
+	SecretAccessKey string `yaml:"secretAccessKey"` // defaults to AWS_SECRET_ACCESS_KEY environment variable
+	SessionToken    string `yaml:"sessionToken"`    // defaults to AWS_SESSION_TOKEN environment variable
+	PathStyle       bool   `yaml:"pathStyle"`       // address the bucket as the path instead of the host name, i.e. for MinIO
+}
+
+type s3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	partSize int64
+}
+
+// idleTimeoutConn fails reads and writes stalled for longer than the timeout
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Validate checks the S3 settings
+func (c S3Config) Validate() error {
+	if c.Endpoint == "" {
+		return fmt.Errorf("s3 endpoint is not set")
+	}
+
+	if u, err := url.Parse(c.Endpoint); err != nil {
+		return fmt.Errorf("could not parse s3 endpoint: %v", err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("s3 endpoint must be http or https url")
+	}
+
+	if c.Bucket == "" {
+		return fmt.Errorf("s3 bucket is not set")
+	}
+
+	return nil
+}
+
+// String implements Stringer
+func (c S3Config) String() string {
+	return fmt.Sprintf("s3://%s/%s at %s", c.Bucket, strings.Trim(c.Prefix, "/"), c.Endpoint)
+}
+
+// NewS3 instantiates S3-compatible object storage
+func NewS3(cfg S3Config) (*s3, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Region == "" {
+		cfg.Region = s3DefaultRegion
+	}
+
+	if cfg.AccessKeyID == "" {
+		cfg.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+
+	if cfg.SecretAccessKey == "" {
+		cfg.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	if cfg.SessionToken == "" {
+		cfg.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 credentials are not set")
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+
+	return &s3{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   newS3Client(),
+		partSize: s3PartSize,
+	}, nil
+}
+
+func newS3Client() *http.Client {
+	dialer := &net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := dialer.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				return &idleTimeoutConn{Conn: conn, timeout: s3IdleTimeout}, nil
+			},
+			TLSHandshakeTimeout:   s3DialTimeout,
+			ResponseHeaderTimeout: s3ResponseHeaderTimeout,
+			IdleConnTimeout:       s3IdleConnTimeout,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (s *s3) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.cfg.Prefix, path.Clean("/"+name)), "/")
+}
+
+// Put uploads the object with a single request, the larger objects and the ones of unknown size are uploaded in parts
+func (s *s3) Put(name string, r io.Reader, size int64) error {
+	if size >= 0 && size <= s.partSize {
+		return s.putObject(name, r, size)
+	}
+
+	partSize := s.partSize
+	if size/s3MaxParts >= partSize {
+		partSize = size/s3MaxParts + 1
+	}
+
+	// S3 requires the content length of every request to be known in advance
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return s.putObject(name, bytes.NewReader(buf[:n]), int64(n))
+	} else if err != nil {
+		return fmt.Errorf("could not read data: %v", err)
+	}
+
+	return s.putMultipart(name, r, buf)
+}
+
+func (s *s3) putObject(name string, body io.Reader, size int64) error {
+	req, err := s.newRequest(http.MethodPut, s.key(name), nil, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return fmt.Errorf("could not put %q: %v", name, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// putMultipart uploads the object in parts, the first part is already read into the buffer
+func (s *s3) putMultipart(name string, r io.Reader, buf []byte) (err error) {
+	key := s.key(name)
+
+	uploadID, err := s.initiateMultipartUpload(key)
+	if err != nil {
+		return fmt.Errorf("could not initiate multipart upload of %q: %v", name, err)
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		if abortErr := s.abortMultipartUpload(key, uploadID); abortErr != nil {
+			err = fmt.Errorf("%v; could not abort multipart upload: %v", err, abortErr)
+		}
+	}()
+
+	parts := make([]s3Part, 0)
+	n, last := len(buf), false
+	for {
+		partNumber := len(parts) + 1
+
+		etag, err := s.uploadPart(key, uploadID, partNumber, buf[:n])
+		if err != nil {
+			return fmt.Errorf("could not upload part %d of %q: %v", partNumber, name, err)
+		}
+		parts = append(parts, s3Part{PartNumber: partNumber, ETag: etag})
+
+		if last {
+			break
+		}
+
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			last = true
+		} else if err != nil {
+			return fmt.Errorf("could not read data: %v", err)
+		}
+
+		if len(parts) == s3MaxParts {
+			return fmt.Errorf("could not upload %q: more than %d parts", name, s3MaxParts)
+		}
+	}
+
+	if err := s.completeMultipartUpload(key, uploadID, parts); err != nil {
+		return fmt.Errorf("could not complete multipart upload of %q: %v", name, err)
+	}
+
+	return nil
+}
+
+func (s *s3) initiateMultipartUpload(key string) (string, error) {
+	req, err := s.newRequest(http.MethodPost, key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result s3InitiateMultipartUploadResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("could not decode response: %v", err)
+	}
+	if result.UploadID == "" {
+		return "", fmt.Errorf("no upload id in the response")
+	}
+
+	return result.UploadID, nil
+}
+
+func (s *s3) uploadPart(key, uploadID string, partNumber int, data []byte) (string, error) {
+	query := url.Values{}
+	query.Set("partNumber", strconv.Itoa(partNumber))
+	query.Set("uploadId", uploadID)
+
+	req, err := s.newRequest(http.MethodPut, key, query, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("no etag in the response")
+	}
+
+	return etag, nil
+}
+
+func (s *s3) completeMultipartUpload(key, uploadID string, parts []s3Part) error {
+	data, err := xml.Marshal(s3CompleteMultipartUpload{Parts: parts})
+	if err != nil {
+		return fmt.Errorf("could not encode request: %v", err)
+	}
+
+	req, err := s.newRequest(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// the request might fail after the response status has been sent, the error is in the body then
+	var s3Err s3Error
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err != nil {
+		return fmt.Errorf("could not read response: %v", err)
+	}
+	if err := xml.Unmarshal(body, &s3Err); err == nil && s3Err.Code != "" {
+		return fmt.Errorf("%s: %s", s3Err.Code, s3Err.Message)
+	}
+
+	return nil
+}
+
+func (s *s3) abortMultipartUpload(key, uploadID string) error {
+	req, err := s.newRequest(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, http.StatusNoContent)
+	if err != nil && err != ErrNotExist {
+		return err
+	} else if err == nil {
+		resp.Body.Close()
+	}
+
+	return nil
+}
+
+// Get downloads the object
+func (s *s3) Get(name string) (io.ReadCloser, error) {
+	req, err := s.newRequest(http.MethodGet, s.key(name), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(req, http.StatusOK)
+	if err == ErrNotExist {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("could not get %q: %v", name, err)
+	}
+
+	return resp.Body, nil
+}
+
+// List lists the objects with ListObjectsV2 requests
+func (s *s3) List(prefix string) ([]Object, error) {
+	var continuationToken string
+
+	objects := make([]Object, 0)
+	keyPrefix := s.key(prefix)
+	if keyPrefix != "" {
+		keyPrefix += "/"
+	}
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", keyPrefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		req, err := s.newRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := s.do(req, http.StatusOK)
+		if err != nil {
+			return nil, fmt.Errorf("could not list %q: %v", prefix, err)
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not decode list response: %v", err)
+		}
+
+		for _, obj := range result.Contents {
+			name := obj.Key
+			if s.cfg.Prefix != "" {
+				name = strings.TrimPrefix(name, s.cfg.Prefix+"/")
+			}
+
+			objects = append(objects, Object{Name: name, Size: obj.Size})
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+
+	return objects, nil
+}
+
+// Delete deletes the object
+func (s *s3) Delete(name string) error {
+	req, err := s.newRequest(http.MethodDelete, s.key(name), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(req, http.StatusNoContent)
+	if err == ErrNotExist {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not delete %q: %v", name, err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *s3) newRequest(method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	if s.cfg.PathStyle {
+		u.Path = "/" + s.cfg.Bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+
+	// the path is escaped the same way it is escaped in the canonical request
+	u.RawPath = s3EscapePath(u.Path)
+	if query != nil {
+		u.RawQuery = s3CanonicalQuery(query)
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+
+	return req, nil
+}
+
+func (s *s3) do(req *http.Request, expectedStatus int) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == expectedStatus || (resp.StatusCode == http.StatusOK && expectedStatus == http.StatusNoContent) {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotExist
+	}
+
+	var s3Err s3Error
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	if err := xml.Unmarshal(data, &s3Err); err == nil && s3Err.Code != "" {
+		return nil, fmt.Errorf("%s: %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+	}
+
+	return nil, fmt.Errorf("%s", resp.Status)
+}
+
+// sign signs the request with AWS Signature Version 4, the payload is not signed
+func (s *s3) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format(s3DateFormat)
+	scope := strings.Join([]string{amzDate[:8], s.cfg.Region, "s3", "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+	if s.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	canonicalHeaders := &strings.Builder{}
+	for _, name := range headerNames {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretAccessKey), amzDate[:8])
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// s3EscapePath escapes each segment of the path as required by the signature
+func s3EscapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = s3Escape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery returns the query sorted by the key with keys and values escaped as required by the signature
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, 0)
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(key)+"="+s3Escape(value))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// s3Escape percent-encodes everything except for the unreserved characters
+func s3Escape(str string) string {
+	buf := &strings.Builder{}
+
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+
+	return buf.String()
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+
+	return sum[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
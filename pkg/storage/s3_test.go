@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is the minimal S3 stand-in storing the objects of a single bucket in memory
+type fakeS3 struct {
+	sync.Mutex
+
+	bucket   string
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	uploadID int
+	requests []string
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+	query := r.URL.Query()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RawQuery)
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && key == "" && query.Get("list-type") == "2":
+		f.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPost && query["uploads"] != nil:
+		f.uploadID++
+		uploadID := strconv.Itoa(f.uploadID)
+		f.uploads[uploadID] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", uploadID)
+	case r.Method == http.MethodPut && query.Get("uploadId") != "":
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[partNumber] = data
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, partNumber))
+	case r.Method == http.MethodPost && query.Get("uploadId") != "":
+		f.complete(w, key, query.Get("uploadId"), data)
+	case r.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		if int64(len(data)) != r.ContentLength {
+			f.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.objects[key] = data
+	case r.Method == http.MethodGet:
+		obj, ok := f.objects[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Write(obj)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	keys := make([]string, 0)
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size></Contents>", key, len(f.objects[key]))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, key, uploadID string, data []byte) {
+	parts, ok := f.uploads[uploadID]
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	var req s3CompleteMultipartUpload
+	if err := xml.Unmarshal(data, &req); err != nil {
+		f.error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	obj := &bytes.Buffer{}
+	for i, part := range req.Parts {
+		if part.PartNumber != i+1 || part.ETag != fmt.Sprintf(`"%d"`, part.PartNumber) {
+			f.error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		obj.Write(parts[part.PartNumber])
+	}
+
+	f.objects[key] = obj.Bytes()
+	delete(f.uploads, uploadID)
+	fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// onlyReader hides the type of the reader, so that the size of the data can't be determined
+type onlyReader struct {
+	io.Reader
+}
+
+func newTestS3(t *testing.T, handler http.Handler) *s3 {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	s, err := NewS3(S3Config{
+		Endpoint:        srv.URL,
+		Bucket:          "bucket",
+		Prefix:          "backup",
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		PathStyle:       true,
+	})
+	if err != nil {
+		t.Fatalf("could not create s3 storage: %v", err)
+	}
+	s.partSize = 10
+
+	return s
+}
+
+func TestS3(t *testing.T) {
+	fake := newFakeS3("bucket")
+	s := newTestS3(t, fake)
+
+	tests := []struct {
+		name      string
+		data      string
+		size      int64
+		multipart bool
+	}{
+		{"empty", "", 0, false},
+		{"small", "0123456789", 10, false},
+		{"small of unknown size", "01234", -1, false},
+		{"large", "0123456789abcdefghijklmnopqrstuvwxyz", 36, true},
+		{"large of unknown size", "0123456789abcdefghij", -1, true},
+	}
+
+	for _, tt := range tests {
+		fake.requests = nil
+
+		name := "dir/" + strings.Replace(tt.name, " ", "_", -1)
+		if err := s.Put(name, onlyReader{strings.NewReader(tt.data)}, tt.size); err != nil {
+			t.Errorf("%s: could not put: %v", tt.name, err)
+			continue
+		}
+
+		multipart := false
+		for _, req := range fake.requests {
+			multipart = multipart || strings.Contains(req, "uploadId")
+		}
+		if multipart != tt.multipart {
+			t.Errorf("%s: expected multipart upload to be %t, requests: %v", tt.name, tt.multipart, fake.requests)
+		}
+
+		if obj := string(fake.objects["backup/"+name]); obj != tt.data {
+			t.Errorf("%s: stored %q, expected %q", tt.name, obj, tt.data)
+		}
+
+		rc, err := s.Get(name)
+		if err != nil {
+			t.Errorf("%s: could not get: %v", tt.name, err)
+			continue
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Errorf("%s: could not read: %v", tt.name, err)
+		} else if string(data) != tt.data {
+			t.Errorf("%s: got %q, expected %q", tt.name, data, tt.data)
+		}
+	}
+
+	objects, err := s.List("dir")
+	if err != nil {
+		t.Fatalf("could not list: %v", err)
+	}
+	if len(objects) != len(tests) {
+		t.Errorf("expected %d objects, got %v", len(tests), objects)
+	}
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Name, "dir/") {
+			t.Errorf("unexpected object name %q", obj.Name)
+		}
+	}
+
+	if err := s.Delete("dir/small"); err != nil {
+		t.Fatalf("could not delete: %v", err)
+	}
+	if _, err := s.Get("dir/small"); err != ErrNotExist {
+		t.Errorf("expected deleted object not to exist, got %v", err)
+	}
+}
+
+func TestS3MultipartAbort(t *testing.T) {
+	fake := newFakeS3("bucket")
+	s := newTestS3(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("partNumber") == "2" {
+			fake.error(w, http.StatusInternalServerError, "InternalError")
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+
+	err := s.Put("obj", strings.NewReader("0123456789abcdefghij"), 20)
+	if err == nil || !strings.Contains(err.Error(), "InternalError") {
+		t.Fatalf("expected the part upload to fail, got %v", err)
+	}
+
+	if len(fake.uploads) != 0 {
+		t.Errorf("expected the upload to be aborted, got %d uploads", len(fake.uploads))
+	}
+	if _, ok := fake.objects["backup/obj"]; ok {
+		t.Errorf("expected no object to be stored")
+	}
+}
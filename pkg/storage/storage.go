@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// TypeLocal represents the archive in the local directory
+	TypeLocal = "local"
+	// TypeS3 represents the archive in the S3-compatible object storage
+	TypeS3 = "s3"
+)
+
+// ErrNotExist is returned by Get if the object does not exist
+var ErrNotExist = errors.New("object does not exist")
+
+// Object describes stored object
+type Object struct {
+	Name string // slash separated path relative to the root of the storage
+	Size int64
+}
+
+// Storage represents the archive storage, object names are slash separated paths relative to the root of the storage
+type Storage interface {
+	// Put stores the object of the given size, -1 means the size is unknown
+	Put(name string, r io.Reader, size int64) error
+	// Get returns the contents of the object, ErrNotExist if there is no such object
+	Get(name string) (io.ReadCloser, error)
+	// List returns all objects under the given directory-like prefix, recursively
+	List(prefix string) ([]Object, error)
+	// Delete deletes the object, deleting a non-existing object is not an error
+	Delete(name string) error
+}
+
+// Config describes archive storage settings
+type Config struct {
+	Type string   `yaml:"type"` // local (default) or s3
+	S3   S3Config `yaml:"s3"`
+}
+
+// IsLocal returns true if the archive is stored in the local directory
+func (c Config) IsLocal() bool {
+	return c.Type == "" || c.Type == TypeLocal
+}
+
+// Validate checks the storage settings
+func (c Config) Validate() error {
+	switch c.Type {
+	case "", TypeLocal:
+		return nil
+	case TypeS3:
+		return c.S3.Validate()
+	default:
+		return fmt.Errorf("unknown storage type: %q", c.Type)
+	}
+}
+
+// String implements Stringer
+func (c Config) String() string {
+	if c.IsLocal() {
+		return TypeLocal
+	}
+
+	return c.S3.String()
+}
+
+// New instantiates the storage, archiveDir is the root of the local storage
+func New(cfg Config, archiveDir string, fsync bool) (Storage, error) {
+	if cfg.IsLocal() {
+		if archiveDir == "" {
+			return nil, fmt.Errorf("archive directory is not set")
+		}
+
+		return NewLocal(archiveDir, fsync), nil
+	}
+
+	return newS3Storage(cfg.S3)
+}
+
+// NewFromLocation instantiates the storage given either the local directory or the s3://bucket/prefix url; the
+// endpoint, the region and the credentials of the S3 storage are taken from s3cfg.
+func NewFromLocation(location string, s3cfg S3Config) (Storage, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return NewLocal(location, false), nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	s3cfg.Bucket = parts[0]
+	if len(parts) > 1 {
+		s3cfg.Prefix = parts[1]
+	}
+
+	return newS3Storage(s3cfg)
+}
+
+// newS3Storage avoids returning the nil *s3 wrapped into the non-nil interface
+func newS3Storage(cfg S3Config) (Storage, error) {
+	s, err := NewS3(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
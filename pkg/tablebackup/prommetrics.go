@@ -1,22 +1,20 @@
 package tablebackup
 
 import (
-	"log"
-
 	"github.com/mkabilov/logical_backup/pkg/prometheus"
 )
 
 func (t *tableBackup) updateMetricsAfterBaseBackup() {
 	err := t.prom.Set(
 		promexporter.PerTableLastBackupEndTimestamp,
-		float64(t.lastBasebackupTime.Unix()), []string{t.OID().String(), t.String()})
+		float64(t.LastBasebackupTime().Unix()), []string{t.OID().String(), t.String()})
 	if err != nil {
-		log.Printf("could not set %s: %v", promexporter.PerTableLastBackupEndTimestamp, err)
+		t.log().Warn("could not set metric", "metric", promexporter.PerTableLastBackupEndTimestamp, "error", err)
 	}
 
 	err = t.prom.Reset(promexporter.PerTableMessageSinceLastBackupGauge, []string{t.OID().String(), t.String()})
 	if err != nil {
-		log.Printf("could not reset %s: %v", promexporter.PerTableMessageSinceLastBackupGauge, err)
+		t.log().Warn("could not reset metric", "metric", promexporter.PerTableMessageSinceLastBackupGauge, "error", err)
 	}
 }
 
@@ -3,8 +3,9 @@ package tablebackup
 import (
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
 	"path"
 	"strings"
@@ -14,16 +15,19 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"github.com/mkabilov/logical_backup/pkg/archiver"
+	"github.com/mkabilov/logical_backup/pkg/basebackup/generations"
+	"github.com/mkabilov/logical_backup/pkg/catalog"
 	"github.com/mkabilov/logical_backup/pkg/config"
 	"github.com/mkabilov/logical_backup/pkg/deltas"
 	"github.com/mkabilov/logical_backup/pkg/message"
 	"github.com/mkabilov/logical_backup/pkg/prometheus"
+	"github.com/mkabilov/logical_backup/pkg/storage"
 	"github.com/mkabilov/logical_backup/pkg/utils"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/logger"
 )
 
 const (
-	tableStateFilename   = "state.yaml"
 	dirPerms             = os.ModePerm
 	archiverCloseNapTime = 1 * time.Minute
 
@@ -54,6 +58,7 @@ type TableBackuper interface {
 	RelationMessage() message.Relation
 	String() string
 	FlushLSN() dbutils.LSN
+	HasPendingMessages() bool
 	TableDirectory() string
 	ProcessDMLMessage(message.Message) error
 	ProcessBegin(message.Begin) error
@@ -64,26 +69,35 @@ type TableBackuper interface {
 	LastProcessedMessageTime() time.Time
 	MessagesProcessed() uint
 	QueueBasebackup()
+	BasebackupPending() bool
+	Flush()
+	ArchiverStatus() (archiver.Status, bool)
 	LastBasebackupTime() time.Time
-	BasebackupDone(dump, info string, lsn dbutils.LSN) error
+	BasebackupDone(dumps []string, infoFilename string, info message.DumpInfo) error
 	LoadTableInfo() error
 }
 
 //tableBackup ...
 type tableBackup struct {
-	message.NamespacedName
+	statsMu sync.Mutex // guards the name and the stats, they are read by the http handlers and the basebackup queue
+	name    message.NamespacedName
 
 	oid             dbutils.OID
 	relationMessage message.Relation
+	pendingMu       sync.Mutex // guards pendingBackup, it is read by the http handlers
 	pendingBackup   bool
+	flushCh         chan struct{} // requests to save the buffered messages regardless of their number and age
 
 	wg  *sync.WaitGroup
 	ctx context.Context
 	cfg *config.Config
 
 	// Files
-	stagingDir string // table level staging dir
-	archiveDir string // table level archive dir
+	tableDir   string          // table dir relative to the staging dir and the root of the archive
+	stagingDir string          // table level staging dir
+	archiveDir string          // table level archive dir, deltas are written there if there is no staging dir
+	archive    storage.Storage // archive storage
+	catalog    catalog.Interface
 
 	// Stats
 	// TODO: should we get rid of those altogether in favor of Prometheus?
@@ -92,6 +106,7 @@ type tableBackup struct {
 	lastProcessedMessageTime time.Time
 
 	// Data for LSNs below and including this one for a given table are guaranteed to be flushed.
+	lsnMu           sync.Mutex  // guards flushLSN, it is read by the controller advancing the slot
 	flushLSN        dbutils.LSN // messages prior to that LSN position are safe to delete
 	latestCommitLSN dbutils.LSN // LSN of the last commit
 	latestFinalLSN  dbutils.LSN
@@ -113,29 +128,35 @@ func New(ctx context.Context,
 	oid dbutils.OID,
 	ctrl controllerInterface,
 	cfg *config.Config,
+	archive storage.Storage,
+	cat catalog.Interface,
 	prom promexporter.PromInterface,
 ) (*tableBackup, error) {
 	tableDir := utils.TableDir(oid)
 
 	tb := tableBackup{
-		NamespacedName:    name,
+		name:              name,
 		oid:               oid,
 		ctx:               ctx,
+		tableDir:          tableDir,
 		archiveDir:        path.Join(cfg.ArchiveDir, tableDir),
+		archive:           archive,
+		catalog:           cat,
 		prom:              prom,
 		cfg:               cfg,
 		ctrl:              ctrl,
 		messagesProcessed: 0,
+		flushCh:           make(chan struct{}, 1),
 
 		wg: &sync.WaitGroup{},
 	}
 
 	if cfg.StagingDir != "" {
 		tb.stagingDir = path.Join(cfg.StagingDir, tableDir)
-		tb.messageCollector = deltas.New(tb.stagingDir, cfg.Fsync)
-		tb.archiver = archiver.New(ctx, tb.stagingDir, tb.archiveDir, cfg.Fsync)
+		tb.messageCollector = deltas.New(tb.stagingDir, cfg.Fsync, cfg.DeltaCompression, cfg.Keyring)
+		tb.archiver = archiver.New(ctx, tb.stagingDir, archive, tableDir, &tb, prom)
 	} else {
-		tb.messageCollector = deltas.New(tb.archiveDir, cfg.Fsync)
+		tb.messageCollector = deltas.New(tb.archiveDir, cfg.Fsync, cfg.DeltaCompression, cfg.Keyring)
 	}
 
 	if err := tb.createDirs(); err != nil {
@@ -143,7 +164,7 @@ func New(ctx context.Context,
 	}
 
 	if tb.archiver != nil {
-		log.Printf("Starting archiver for %s table", tb.NamespacedName)
+		tb.log().Info("starting archiver")
 		tb.archiver.Run()
 	}
 
@@ -153,18 +174,32 @@ func New(ctx context.Context,
 	return &tb, nil
 }
 
+// log returns the logger with the fields of the table
+func (t *tableBackup) log() *slog.Logger {
+	return logger.Table(t.oid, t.Name())
+}
+
 //LatestCommitLSN returns latest commit lsn
 func (t *tableBackup) LatestCommitLSN() dbutils.LSN {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
 	return t.latestCommitLSN
 }
 
 // LastProcessedMessageTime returns time of the last processed message
 func (t *tableBackup) LastProcessedMessageTime() time.Time {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
 	return t.lastProcessedMessageTime
 }
 
 // MessagesProcessed returns number of processed messages since last basebackup
 func (t *tableBackup) MessagesProcessed() uint {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
 	return t.messagesProcessed
 }
 
@@ -180,34 +215,89 @@ func (t *tableBackup) OID() dbutils.OID {
 
 // Name returns namespaced name
 func (t *tableBackup) Name() message.NamespacedName {
-	return t.NamespacedName
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
+	return t.name
+}
+
+// String implements Stringer
+func (t *tableBackup) String() string {
+	return t.Name().String()
 }
 
 // SetName renames table
 func (t *tableBackup) SetName(name message.NamespacedName) {
-	if t.NamespacedName != name {
-		t.NamespacedName = name
-	}
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
+	t.name = name
 }
 
 // LastBasebackupTime returns last base backup time of the table
 func (t *tableBackup) LastBasebackupTime() time.Time {
+	t.statsMu.Lock()
+	defer t.statsMu.Unlock()
+
 	return t.lastBasebackupTime
 }
 
 // FlushLSN ...
 func (t *tableBackup) FlushLSN() dbutils.LSN {
+	t.lsnMu.Lock()
+	defer t.lsnMu.Unlock()
+
 	return t.flushLSN
 }
 
+func (t *tableBackup) setFlushLSN(lsn dbutils.LSN) {
+	t.lsnMu.Lock()
+	defer t.lsnMu.Unlock()
+
+	t.flushLSN = lsn
+}
+
+// HasPendingMessages returns true if there are messages not yet saved into the delta file
+func (t *tableBackup) HasPendingMessages() bool {
+	return t.messageCollector.MessageCnt() > 0
+}
+
 // QueueBasebackup queues table for basebackup
 func (t *tableBackup) QueueBasebackup() {
+	t.pendingMu.Lock()
 	if t.pendingBackup {
+		t.pendingMu.Unlock()
 		return
 	}
+	t.pendingBackup = true
+	t.pendingMu.Unlock()
 
 	t.ctrl.QueueTable(t)
-	t.pendingBackup = true
+}
+
+// ArchiverStatus returns the progress of the archiver, false if the files are written directly to the archive
+func (t *tableBackup) ArchiverStatus() (archiver.Status, bool) {
+	if t.archiver == nil {
+		return archiver.Status{}, false
+	}
+
+	return t.archiver.Status(), true
+}
+
+// BasebackupPending returns true if the table is queued for the basebackup
+func (t *tableBackup) BasebackupPending() bool {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+
+	return t.pendingBackup
+}
+
+// Flush requests to save the buffered messages into the delta file
+func (t *tableBackup) Flush() {
+	select {
+	case t.flushCh <- struct{}{}:
+	default: // already requested
+	}
 }
 
 func (t *tableBackup) stop() {
@@ -218,10 +308,10 @@ func (t *tableBackup) stop() {
 	if err == deltas.EmptyBuffer {
 		return
 	} else if err != nil {
-		log.Printf("could not save messages: %v", err)
+		t.log().Error("could not save messages", "error", err)
 		return
 	}
-	t.flushLSN = maxLSN
+	t.setFlushLSN(maxLSN)
 
 	t.queueDeltaFile(filename, minLSN)
 }
@@ -236,14 +326,14 @@ func (t *tableBackup) Wait() {
 }
 
 func (t *tableBackup) saveState() error {
-	tempStateFilepath := path.Join(t.TableDirectory(), tableStateFilename+".new")
+	tempStateFilepath := path.Join(t.TableDirectory(), utils.TableStateFile+".new")
 	if _, err := os.Stat(tempStateFilepath); !os.IsNotExist(err) {
 		if err != nil {
 			return fmt.Errorf("could not stat %q: %v", tempStateFilepath, err)
 		}
 
 		if err := os.Remove(tempStateFilepath); err != nil {
-			log.Printf("could not delete old temp state file: %v", err)
+			t.log().Warn("could not delete old temp state file", "error", err)
 		}
 	}
 
@@ -256,64 +346,92 @@ func (t *tableBackup) saveState() error {
 		fp.Close()
 		if err != nil {
 			if err := os.Remove(fp.Name()); err != nil {
-				log.Printf("could not remove a temporary state file %q: %v", fp.Name(), err)
+				t.log().Warn("could not remove a temporary state file", "file", fp.Name(), "error", err)
 			}
 		}
 	}()
 
+	t.statsMu.Lock()
 	s := state{
 		MessagesSinceBackupCount: t.messagesProcessed,
 		DeltasSinceBackupCount:   t.deltaFilesWrittenCnt,
 		LastProcessedMessage:     t.lastProcessedMessageTime,
 		LatestFinalLSN:           t.latestFinalLSN,
-		LatestFlushLSN:           t.flushLSN,
 	}
+	t.statsMu.Unlock()
+	s.LatestFlushLSN = t.FlushLSN()
 
-	if err = yaml.NewEncoder(fp).Encode(s); err != nil {
+	w, err := t.cfg.Keyring.NewWriter(fp)
+	if err != nil {
+		return fmt.Errorf("could not init encryption: %v", err)
+	}
+
+	if err = yaml.NewEncoder(w).Encode(s); err != nil {
 		return fmt.Errorf("could not encode backup state: %v", err)
 	}
 
-	finalFilepath := path.Join(t.TableDirectory(), tableStateFilename)
+	if err = w.Close(); err != nil {
+		return fmt.Errorf("could not encrypt backup state: %v", err)
+	}
+
+	finalFilepath := path.Join(t.TableDirectory(), utils.TableStateFile)
 	if err := os.Rename(tempStateFilepath, finalFilepath); err != nil {
 		return fmt.Errorf("could not rename temporary state file %q to %q: %v", fp.Name(), finalFilepath, err)
 	}
 
-	t.queueFile(tableStateFilename)
+	t.queueFile(utils.TableStateFile)
+	t.catalog.SetState(t.oid, catalog.State(s))
 
 	return nil
 }
 
 func (t *tableBackup) loadState() error {
-	var s state
-
-	stateFilepath := utils.FirstExistingFile(
-		path.Join(t.cfg.StagingDir, tableStateFilename),
-		path.Join(t.cfg.ArchiveDir, tableStateFilename),
+	var (
+		s  state
+		fp io.ReadCloser
 	)
 
-	if stateFilepath == "" {
-		log.Printf("could not find state file for %v table", t) // DEBUG
-		return nil
+	// the state file in the staging dir is newer than the archived one, if any
+	if t.stagingDir != "" {
+		stagingFp, err := os.OpenFile(path.Join(t.stagingDir, utils.TableStateFile), os.O_RDONLY, os.ModePerm)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not open state file: %v", err)
+		} else if err == nil {
+			fp = stagingFp
+		}
+	}
+
+	if fp == nil {
+		archivedFp, err := t.archive.Get(path.Join(t.tableDir, utils.TableStateFile))
+		//TODO: file might be corrupted/empty in this case we need to switch to the state file in the archive directory
+		if err == storage.ErrNotExist {
+			t.log().Debug("could not find state file")
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not open state file: %v", err)
+		}
+		fp = archivedFp
 	}
+	defer fp.Close()
 
-	log.Printf("state loaded for %s table", t)
+	t.log().Debug("state loaded")
 
-	fp, err := os.OpenFile(stateFilepath, os.O_RDONLY, os.ModePerm)
-	//TODO: file might be corrupted/empty in this case we need to switch to the state file in the archive directory
+	r, err := t.cfg.Keyring.NewOptionalReader(fp)
 	if err != nil {
-		return fmt.Errorf("could not open state file: %v", err)
+		return fmt.Errorf("could not init decryption: %v", err)
 	}
-	defer fp.Close()
 
-	if err := yaml.NewDecoder(fp).Decode(&s); err != nil {
+	if err := yaml.NewDecoder(r).Decode(&s); err != nil {
 		return fmt.Errorf("could not decode state yaml: %v", err)
 	}
 
+	t.statsMu.Lock()
 	t.messagesProcessed = s.MessagesSinceBackupCount
 	t.deltaFilesWrittenCnt = s.DeltasSinceBackupCount
 	t.lastProcessedMessageTime = s.LastProcessedMessage
 	t.latestFinalLSN = s.LatestFinalLSN
-	t.flushLSN = s.LatestFlushLSN
+	t.statsMu.Unlock()
+	t.setFlushLSN(s.LatestFlushLSN)
 
 	return nil
 }
@@ -322,12 +440,12 @@ func (t *tableBackup) maybeSaveMessages() error {
 	saveNeeded := false
 	msgCnt := t.messageCollector.MessageCnt()
 	if msgCnt >= t.cfg.MessagesPerDelta {
-		log.Printf("archiving due to MessagesPerDelta")
+		t.log().Debug("archiving due to MessagesPerDelta", "messages", msgCnt)
 		saveNeeded = true
 	}
 
 	if msgAge := time.Since(t.messageCollector.LastMessageTime()); msgAge > t.cfg.ArchiverTimeout && msgCnt > 0 {
-		log.Printf("archiving due to age of the last msg (%v)", msgAge)
+		t.log().Debug("archiving due to age of the last message", "age", msgAge)
 		saveNeeded = true
 	}
 
@@ -335,8 +453,14 @@ func (t *tableBackup) maybeSaveMessages() error {
 		return nil
 	}
 
+	return t.saveMessages()
+}
+
+func (t *tableBackup) saveMessages() error {
 	deltaFilename, minLSN, maxLSN, err := t.messageCollector.Save()
-	if err != nil {
+	if err == deltas.EmptyBuffer {
+		return nil
+	} else if err != nil {
 		return fmt.Errorf("could not save delta file: %v", err)
 	}
 
@@ -346,10 +470,11 @@ func (t *tableBackup) maybeSaveMessages() error {
 		return fmt.Errorf("could not save state: %v", err)
 	}
 
-	t.flushLSN = maxLSN
+	t.setFlushLSN(maxLSN)
 	t.ctrl.AdvanceLSN()
 
-	log.Printf("%s: messages are saved to the %q delta file (lsn: %v - %v)", t.String(), deltaFilename, minLSN, maxLSN)
+	t.log().Info("messages are saved to the delta file", "file", deltaFilename, "minLSN", minLSN,
+		logger.LSN, maxLSN)
 
 	return nil
 }
@@ -364,7 +489,12 @@ func (t *tableBackup) run() {
 			return
 		case <-time.Tick(archiverCloseNapTime):
 			if err := t.maybeSaveMessages(); err != nil {
-				log.Printf("could not save: %v", err)
+				t.log().Error("could not save", "error", err)
+			}
+		case <-t.flushCh:
+			t.log().Info("archiving due to the flush request")
+			if err := t.saveMessages(); err != nil {
+				t.log().Error("could not save", "error", err)
 			}
 		case <-time.Tick(t.cfg.ForceBasebackupAfterInactivityInterval):
 			lpt := t.LastProcessedMessageTime()
@@ -373,8 +503,8 @@ func (t *tableBackup) run() {
 			}
 
 			if time.Since(lpt) > t.cfg.ForceBasebackupAfterInactivityInterval {
-				log.Printf("queueing table %s for basebackup due to inactivity(%v)",
-					t.String(), t.cfg.ForceBasebackupAfterInactivityInterval)
+				t.log().Info("queueing table for basebackup due to inactivity",
+					"inactivity", t.cfg.ForceBasebackupAfterInactivityInterval)
 				t.QueueBasebackup()
 			}
 		}
@@ -383,15 +513,19 @@ func (t *tableBackup) run() {
 
 //ProcessBegin ...
 func (t *tableBackup) ProcessBegin(msg message.Begin) error {
+	t.statsMu.Lock()
 	t.latestFinalLSN = msg.FinalLSN
+	t.statsMu.Unlock()
 
 	return t.saveMessage(msg)
 }
 
 //ProcessCommit ...
 func (t *tableBackup) ProcessCommit(msg message.Commit) error {
+	t.statsMu.Lock()
 	t.latestFinalLSN = msg.LSN
 	t.latestCommitLSN = msg.TransactionLSN
+	t.statsMu.Unlock()
 
 	return t.saveMessage(msg)
 }
@@ -419,8 +553,10 @@ func (t *tableBackup) saveMessage(msg message.Message) error {
 		return fmt.Errorf("could not save delta file: %v", err)
 	}
 
+	t.statsMu.Lock()
 	t.messagesProcessed++
 	t.lastProcessedMessageTime = time.Now()
+	t.statsMu.Unlock()
 
 	return nil
 }
@@ -433,6 +569,9 @@ func (t *tableBackup) createDirs() error {
 				return fmt.Errorf("could not create staging delta dir: %v", err)
 			}
 		}
+
+		// the archiver creates the directories in the storage on its own
+		return nil
 	}
 
 	archiveDeltasPath := path.Join(t.archiveDir, deltas.DirName)
@@ -445,8 +584,8 @@ func (t *tableBackup) createDirs() error {
 	return nil
 }
 
-func (t *tableBackup) purgeObsoleteDeltaFiles(deltasDir string) error {
-	log.Printf("Purging segments in %s before the LSN %s", deltasDir, t.basebackupLSN)
+func (t *tableBackup) purgeObsoleteDeltaFiles(deltasDir string, minLSN dbutils.LSN) error {
+	t.log().Debug("purging segments", "dir", deltasDir, logger.LSN, minLSN)
 	fileList, err := ioutil.ReadDir(deltasDir)
 	if err != nil {
 		return fmt.Errorf("could not list directory: %v", err)
@@ -454,15 +593,43 @@ func (t *tableBackup) purgeObsoleteDeltaFiles(deltasDir string) error {
 
 	for _, v := range fileList {
 		filename := v.Name()
-		if lsn, err := utils.GetLSNFromDeltaFilename(filename); err == nil {
-			if lsn < t.basebackupLSN {
-				filename = path.Join(deltasDir, filename)
-				if err := os.Remove(filename); err != nil {
-					return fmt.Errorf("could not remove %q file: %v", filename, err)
-				}
+		lsn, err := utils.GetLSNFromDeltaFilename(filename)
+		if err != nil {
+			t.log().Warn("skipping unexpected file in the deltas directory", "file", filename, "error", err)
+			continue
+		}
+
+		if lsn < minLSN {
+			filename = path.Join(deltasDir, filename)
+			if err := os.Remove(filename); err != nil {
+				return fmt.Errorf("could not remove %q file: %v", filename, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *tableBackup) purgeArchivedDeltaFiles(minLSN dbutils.LSN) error {
+	deltasDir := path.Join(t.tableDir, deltas.DirName)
+	t.log().Debug("purging archived segments", "dir", deltasDir, logger.LSN, minLSN)
+
+	objects, err := t.archive.List(deltasDir)
+	if err != nil {
+		return fmt.Errorf("could not list archive: %v", err)
+	}
+
+	for _, obj := range objects {
+		lsn, err := utils.GetLSNFromDeltaFilename(path.Base(obj.Name))
+		if err != nil {
+			t.log().Warn("skipping unexpected file in the archived deltas", "file", obj.Name, "error", err)
+			continue
+		}
+
+		if lsn < minLSN {
+			if err := t.archive.Delete(obj.Name); err != nil {
+				return fmt.Errorf("could not remove %q: %v", obj.Name, err)
 			}
-		} else {
-			return fmt.Errorf("could not parse filename: %v", err)
 		}
 	}
 
@@ -478,44 +645,168 @@ func (t *tableBackup) queueFile(filename string) {
 // we need to know the min lsn position of the delta file because by the time we process file the
 // basebackup lsn might be different
 func (t *tableBackup) queueDeltaFile(filename string, minLSN dbutils.LSN) {
+	// the file must be read before the archiver moves it
+	if err := t.addDeltaToCatalog(filename); err != nil {
+		t.log().Error("could not add delta file to the catalog", "file", filename, "error", err)
+	}
+
 	if t.archiver != nil {
 		t.archiver.QueueDeltaFile(path.Join(deltas.DirName, filename), minLSN)
 	}
 
+	t.statsMu.Lock()
 	t.deltaFilesWrittenCnt++
-	if t.deltaFilesWrittenCnt >= t.cfg.BackupThreshold {
-		log.Printf("queueing table due to backup threshold")
+	thresholdReached := t.deltaFilesWrittenCnt >= t.cfg.BackupThreshold
+	t.statsMu.Unlock()
+
+	if thresholdReached {
+		t.log().Info("queueing table for basebackup due to backup threshold")
 		t.QueueBasebackup()
 	}
 }
 
-// BasebackupDone does post base backup operations
-func (t *tableBackup) BasebackupDone(basebackupFilename, infoFilename string, lsn dbutils.LSN) error {
-	if t.archiver != nil {
-		t.archiver.SetBasebackupLSN(lsn)
+func (t *tableBackup) addDeltaToCatalog(filename string) error {
+	fp, err := os.Open(path.Join(t.TableDirectory(), deltas.DirName, filename))
+	if err != nil {
+		return fmt.Errorf("could not open file: %v", err)
 	}
+	defer fp.Close()
 
-	t.flushLSN = lsn
-	t.basebackupLSN = lsn
-	t.queueFile(basebackupFilename)
-	t.queueFile(infoFilename)
+	fi, err := fp.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat file: %v", err)
+	}
 
-	for _, baseDir := range []string{t.stagingDir, t.archiveDir} {
-		if baseDir == "" {
+	h, err := deltas.ReadHeader(fp)
+	if err != nil {
+		return fmt.Errorf("could not read header: %v", err)
+	}
+
+	t.catalog.AddDelta(t.oid, catalog.NewDelta(filename, fi.Size(), h))
+
+	if err := t.prom.Observe(promexporter.DeltaFileSizeHistogram, float64(fi.Size()), nil); err != nil {
+		t.log().Warn("could not observe metric", "metric", promexporter.DeltaFileSizeHistogram, "error", err)
+	}
+
+	return nil
+}
+
+// expireGenerations deletes the basebackup generations not retained by the policy and returns the start lsn of the
+// oldest retained one, the deltas prior to it are not needed anymore
+func (t *tableBackup) expireGenerations(lsn dbutils.LSN) (dbutils.LSN, error) {
+	gens, err := generations.List(t.archive, t.tableDir)
+	if err != nil {
+		return dbutils.InvalidLSN, err
+	}
+
+	policy := generations.Policy{
+		Generations: t.cfg.RetainGenerations,
+		Period:      time.Duration(t.cfg.RetainFor),
+	}
+
+	minLSN := lsn
+	expired := policy.Expired(gens, time.Now())
+	for _, gen := range gens {
+		isExpired := false
+		for _, e := range expired {
+			if e.Dir == gen.Dir {
+				isExpired = true
+				break
+			}
+		}
+
+		if !isExpired {
+			if gen.StartLSN < minLSN {
+				minLSN = gen.StartLSN
+			}
 			continue
 		}
 
-		deltasDir := path.Join(baseDir, deltas.DirName)
-		if err := t.purgeObsoleteDeltaFiles(deltasDir); err != nil {
-			return fmt.Errorf("could not purge delta files from %q: %v", deltasDir, err)
+		t.log().Info("deleting expired basebackup generation", logger.LSN, gen.StartLSN)
+		if err := gen.Delete(t.archive); err != nil {
+			return dbutils.InvalidLSN, fmt.Errorf("could not delete generation %s: %v", gen.StartLSN, err)
+		}
+	}
+
+	return minLSN, nil
+}
+
+// BasebackupDone does post base backup operations
+func (t *tableBackup) BasebackupDone(basebackupFilenames []string, infoFilename string, info message.DumpInfo) error {
+	lsn := info.StartLSN
+	t.catalog.AddBasebackup(t.oid, catalog.NewBasebackup(path.Join(t.tableDir, path.Dir(infoFilename)), info))
+
+	t.setFlushLSN(lsn)
+	t.basebackupLSN = lsn
+	for _, filename := range basebackupFilenames {
+		t.queueFile(filename)
+	}
+	// the info file marks the generation complete, hence it goes last
+	t.queueFile(infoFilename)
+
+	// the archiver expires the older generations once it has stored the info file of the new one
+	if t.archiver == nil {
+		if err := t.generationStored(lsn); err != nil {
+			return err
 		}
 	}
+
 	t.updateMetricsAfterBaseBackup()
 
+	t.statsMu.Lock()
 	t.lastBasebackupTime = time.Now()
 	t.messagesProcessed = 0
-	t.pendingBackup = false
 	t.deltaFilesWrittenCnt = 0
+	t.statsMu.Unlock()
+
+	t.pendingMu.Lock()
+	t.pendingBackup = false
+	t.pendingMu.Unlock()
+
+	return nil
+}
+
+// Archived is called by the archiver once the file is stored in the archive
+func (t *tableBackup) Archived(filename string) {
+	var lsn dbutils.LSN
+
+	if path.Base(filename) != generations.InfoFilename {
+		return
+	}
+
+	if err := lsn.ParseHex(path.Base(path.Dir(filename))); err != nil {
+		t.log().Error("could not extract lsn from the generation directory", "file", filename, "error", err)
+		return
+	}
+
+	if err := t.generationStored(lsn); err != nil {
+		t.log().Error("could not expire old data", "error", err)
+	}
+}
+
+// generationStored deletes the generations and the deltas not needed anymore once the generation starting at the lsn
+// is complete in the archive
+func (t *tableBackup) generationStored(lsn dbutils.LSN) error {
+	minLSN, err := t.expireGenerations(lsn)
+	if err != nil {
+		return fmt.Errorf("could not expire basebackup generations: %v", err)
+	}
+
+	if t.archiver != nil {
+		t.archiver.SetBasebackupLSN(minLSN)
+	}
+
+	if t.stagingDir != "" {
+		deltasDir := path.Join(t.stagingDir, deltas.DirName)
+		if err := t.purgeObsoleteDeltaFiles(deltasDir, minLSN); err != nil {
+			return fmt.Errorf("could not purge delta files from %q: %v", deltasDir, err)
+		}
+	}
+
+	if err := t.purgeArchivedDeltaFiles(minLSN); err != nil {
+		return fmt.Errorf("could not purge archived delta files: %v", err)
+	}
+	t.catalog.Purge(t.oid, minLSN)
 
 	return nil
 }
@@ -547,6 +838,10 @@ func (t *tableBackup) loadStagingFiles() error {
 		t.archiver.QueueFile(file.Name())
 	}
 
+	if err := t.loadStagingGenerations(); err != nil {
+		return err
+	}
+
 	fileList, err = ioutil.ReadDir(path.Join(t.stagingDir, deltas.DirName))
 	if err != nil {
 		return fmt.Errorf("could not read directory: %v", err)
@@ -556,7 +851,7 @@ func (t *tableBackup) loadStagingFiles() error {
 		var minLSN dbutils.LSN
 
 		if file.IsDir() {
-			log.Printf("unexpected %v directory in the deltas dir", file.Name())
+			t.log().Warn("unexpected directory in the deltas dir", "dir", file.Name())
 			continue
 		}
 
@@ -575,6 +870,44 @@ func (t *tableBackup) loadStagingFiles() error {
 	return nil
 }
 
+// loadStagingGenerations queues the basebackup generations not yet moved to the archive, info files go last
+func (t *tableBackup) loadStagingGenerations() error {
+	genList, err := ioutil.ReadDir(path.Join(t.stagingDir, generations.DirName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read directory: %v", err)
+	}
+
+	for _, gen := range genList {
+		if !gen.IsDir() {
+			continue
+		}
+
+		genDir := path.Join(generations.DirName, gen.Name())
+		fileList, err := ioutil.ReadDir(path.Join(t.stagingDir, genDir))
+		if err != nil {
+			return fmt.Errorf("could not read directory: %v", err)
+		}
+
+		hasInfo := false
+		for _, file := range fileList {
+			if file.Name() == generations.InfoFilename {
+				hasInfo = true
+				continue
+			}
+
+			t.archiver.QueueFile(path.Join(genDir, file.Name()))
+		}
+
+		if hasInfo {
+			t.archiver.QueueFile(path.Join(genDir, generations.InfoFilename))
+		}
+	}
+
+	return nil
+}
+
 // LoadTableInfo loads info about the table from the filesystem
 func (t *tableBackup) LoadTableInfo() error {
 	if err := t.loadState(); err != nil {
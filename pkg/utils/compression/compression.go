@@ -0,0 +1,129 @@
+package compression
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+)
+
+// Method represents compression method
+type Method string
+
+const (
+	// None represents uncompressed data
+	None Method = "none"
+	// Gzip represents gzip compression
+	Gzip Method = "gzip"
+	// Zstd represents zstandard compression
+	Zstd Method = "zstd"
+	// LZ4 represents lz4 frame compression
+	LZ4 Method = "lz4"
+)
+
+// Config describes compression settings
+type Config struct {
+	Method Method `yaml:"method"`
+	Level  int    `yaml:"level"` // 0 means the default level of the method
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Enabled returns true if the data should be compressed
+func (c Config) Enabled() bool {
+	return c.Method != "" && c.Method != None
+}
+
+// Validate checks compression method and level
+func (c Config) Validate() error {
+	switch c.Method {
+	case "", None:
+		return nil
+	case Gzip:
+		if c.Level < 0 || c.Level > gzip.BestCompression {
+			return fmt.Errorf("gzip compression level must be between 1 and %d, or 0 for the default", gzip.BestCompression)
+		}
+	case Zstd:
+		if c.Level < 0 || c.Level > 22 {
+			return fmt.Errorf("zstd compression level must be between 1 and 22, or 0 for the default")
+		}
+	case LZ4:
+		if c.Level < 0 {
+			return fmt.Errorf("lz4 compression level must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown compression method: %q", c.Method)
+	}
+
+	return nil
+}
+
+// String implements Stringer
+func (c Config) String() string {
+	if !c.Enabled() {
+		return string(None)
+	}
+
+	if c.Level == 0 {
+		return string(c.Method)
+	}
+
+	return fmt.Sprintf("%s (level %d)", c.Method, c.Level)
+}
+
+// NewWriter returns writer compressing the data written to w; the writer must be closed to flush the data
+func (c Config) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Method {
+	case "", None:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		return gzip.NewWriterLevel(w, level)
+	case Zstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if c.Level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.Level)))
+		}
+
+		return zstd.NewWriter(w, opts...)
+	case LZ4:
+		zw := lz4.NewWriter(w)
+		zw.Header.CompressionLevel = c.Level
+
+		return zw, nil
+	default:
+		return nil, fmt.Errorf("unknown compression method: %q", c.Method)
+	}
+}
+
+// NewReader returns reader decompressing the data read from r
+func NewReader(method Method, r io.Reader) (io.ReadCloser, error) {
+	switch method {
+	case "", None:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		return zr.IOReadCloser(), nil
+	case LZ4:
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unknown compression method: %q", method)
+	}
+}
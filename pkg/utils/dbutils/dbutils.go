@@ -4,7 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 
 	"github.com/jackc/pgx"
 )
@@ -24,6 +24,8 @@ func QuoteLiteral(str string) string {
 		switch r1 {
 		case '\\':
 			res += `\\`
+		case '\'':
+			res += `''`
 		case '\t':
 			res += `\t`
 			needsEscapeChar = true
@@ -65,7 +67,7 @@ func CreateMissingPublication(conn *pgx.Conn, publicationName string) error {
 		return fmt.Errorf("could not create publication: %v", err)
 	}
 	rows.Close()
-	log.Printf("created missing publication: %q", query)
+	slog.Info("created missing publication", "publication", publicationName)
 
 	return nil
 }
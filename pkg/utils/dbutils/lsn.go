@@ -71,3 +71,13 @@ func (l *LSN) UnmarshalYAML(unmarshal func(interface{}) error) error {
 
 	return nil
 }
+
+// MarshalText implements encoding.TextMarshaler, so that lsn is formatted the postgres way in json
+func (l LSN) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (l *LSN) UnmarshalText(text []byte) error {
+	return l.Parse(string(text))
+}
@@ -0,0 +1,431 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Encrypted stream layout:
+//   magic(4) version(1) key id length(1) key id nonce prefix(7)
+// followed by the segments:
+//   last segment flag(1) ciphertext length(4) ciphertext
+// Each segment holds up to segmentSize bytes of the plaintext sealed with AES-256-GCM. The nonce of the segment is the
+// nonce prefix, the segment number and the last segment flag, so that reordered, dropped or truncated segments fail
+// the authentication. The stream header is authenticated as additional data of every segment.
+
+const (
+	version     uint8 = 1
+	keySize           = 32
+	prefixSize        = 7
+	segmentSize       = 64 * 1024
+	maxKeyIDLen       = 255
+)
+
+var magic = []byte("LBTE")
+
+// KeyConfig describes the source of the key: either the file or the environment variable holding hex encoded key
+type KeyConfig struct {
+	ID   string `yaml:"id"`
+	File string `yaml:"file"`
+	Env  string `yaml:"env"`
+}
+
+// Config describes encryption settings
+type Config struct {
+	Key     KeyConfig   `yaml:"key"`     // key to encrypt the files with
+	OldKeys []KeyConfig `yaml:"oldKeys"` // keys to decrypt the files encrypted before the key rotation
+}
+
+// Keyring holds the keys, the nil keyring neither encrypts nor decrypts
+type Keyring struct {
+	currentID string
+	keys      map[string]cipher.AEAD
+}
+
+// Enabled returns true if the files should be encrypted
+func (c Config) Enabled() bool {
+	return c.Key.ID != ""
+}
+
+// ParseKeyConfig parses key description in the form of id:/path/to/file or id:$ENV_VARIABLE
+func ParseKeyConfig(str string) (KeyConfig, error) {
+	parts := strings.SplitN(str, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return KeyConfig{}, fmt.Errorf("key must be specified as id:/path/to/file or id:$ENV_VARIABLE")
+	}
+
+	if strings.HasPrefix(parts[1], "$") {
+		return KeyConfig{ID: parts[0], Env: parts[1][1:]}, nil
+	}
+
+	return KeyConfig{ID: parts[0], File: parts[1]}, nil
+}
+
+// NewKeyring loads the keys, returns nil keyring if encryption is not configured
+func NewKeyring(cfg Config) (*Keyring, error) {
+	if !cfg.Enabled() && len(cfg.OldKeys) == 0 {
+		return nil, nil
+	}
+
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, keyCfg := range append([]KeyConfig{cfg.Key}, cfg.OldKeys...) {
+		if keyCfg.ID == "" {
+			continue
+		}
+
+		if err := k.addKey(keyCfg); err != nil {
+			return nil, fmt.Errorf("could not load key %q: %v", keyCfg.ID, err)
+		}
+	}
+	k.currentID = cfg.Key.ID
+
+	return k, nil
+}
+
+func (k *Keyring) addKey(cfg KeyConfig) error {
+	var hexKey string
+
+	if len(cfg.ID) > maxKeyIDLen {
+		return fmt.Errorf("key id is longer than %d bytes", maxKeyIDLen)
+	}
+
+	if _, ok := k.keys[cfg.ID]; ok {
+		return fmt.Errorf("duplicate key id")
+	}
+
+	switch {
+	case cfg.File != "" && cfg.Env != "":
+		return fmt.Errorf("either file or env must be specified, not both")
+	case cfg.File != "":
+		data, err := ioutil.ReadFile(cfg.File)
+		if err != nil {
+			return fmt.Errorf("could not read key file: %v", err)
+		}
+		hexKey = string(data)
+	case cfg.Env != "":
+		hexKey = os.Getenv(cfg.Env)
+		if hexKey == "" {
+			return fmt.Errorf("environment variable %s is not set", cfg.Env)
+		}
+	default:
+		return fmt.Errorf("no key file or environment variable specified")
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+	if err != nil {
+		return fmt.Errorf("could not decode hex key: %v", err)
+	}
+
+	if len(key) != keySize {
+		return fmt.Errorf("key must be %d bytes long, got %d", keySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.keys[cfg.ID] = aead
+
+	return nil
+}
+
+// Enabled returns true if the keyring has a key to encrypt with
+func (k *Keyring) Enabled() bool {
+	return k != nil && k.currentID != ""
+}
+
+// HasKey returns true if the keyring can decrypt the data encrypted with the key
+func (k *Keyring) HasKey(id string) bool {
+	if k == nil {
+		return false
+	}
+
+	_, ok := k.keys[id]
+	return ok
+}
+
+// CurrentKeyID returns the id of the key used for encryption
+func (k *Keyring) CurrentKeyID() string {
+	if k == nil {
+		return ""
+	}
+
+	return k.currentID
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	closed  bool
+}
+
+// NewWriter returns writer encrypting the data written to w with the current key; the writer must be closed to flush
+// the last segment. If the keyring is not enabled the data is written as is.
+func (k *Keyring) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if !k.Enabled() {
+		return nopWriteCloser{w}, nil
+	}
+
+	header := &bytes.Buffer{}
+	header.Write(magic)
+	header.WriteByte(version)
+	header.WriteByte(uint8(len(k.currentID)))
+	header.WriteString(k.currentID)
+
+	prefix := make([]byte, prefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %v", err)
+	}
+	header.Write(prefix)
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, k.keys[k.currentID].NonceSize())
+	copy(nonce, prefix)
+
+	return &writer{
+		w:      w,
+		aead:   k.keys[k.currentID],
+		header: header.Bytes(),
+		nonce:  nonce,
+		buf:    make([]byte, 0, segmentSize),
+	}, nil
+}
+
+func (e *writer) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, fmt.Errorf("write to closed writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):segmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+
+		// keep the full segment in the buffer until we know whether it is the last one
+		if len(e.buf) == segmentSize && len(p) > 0 {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Close seals the last segment, it doesn't close the underlying writer
+func (e *writer) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	return e.seal(true)
+}
+
+func (e *writer) seal(last bool) error {
+	var flag uint8
+
+	if last {
+		flag = 1
+	}
+
+	binary.BigEndian.PutUint32(e.nonce[prefixSize:], e.counter)
+	e.nonce[len(e.nonce)-1] = flag
+	ciphertext := e.aead.Seal(nil, e.nonce, e.buf, e.header)
+
+	segmentHeader := make([]byte, 5)
+	segmentHeader[0] = flag
+	binary.BigEndian.PutUint32(segmentHeader[1:], uint32(len(ciphertext)))
+
+	if _, err := e.w.Write(segmentHeader); err != nil {
+		return err
+	}
+
+	if _, err := e.w.Write(ciphertext); err != nil {
+		return err
+	}
+
+	e.counter++
+	e.buf = e.buf[:0]
+
+	return nil
+}
+
+type reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	nonce   []byte
+	counter uint32
+	buf     []byte
+	last    bool
+}
+
+// NewReader returns reader decrypting the data read from r
+func (k *Keyring) NewReader(r io.Reader) (io.Reader, error) {
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("could not read encryption header: %v", err)
+	}
+
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, fmt.Errorf("data is not encrypted")
+	}
+
+	if header[len(magic)] != version {
+		return nil, fmt.Errorf("unsupported encryption version: %d", header[len(magic)])
+	}
+
+	rest := make([]byte, int(header[len(magic)+1])+prefixSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("could not read encryption header: %v", err)
+	}
+	header = append(header, rest...)
+
+	keyID := string(rest[:len(rest)-prefixSize])
+	if k == nil {
+		return nil, fmt.Errorf("data is encrypted with the key %q, but no keys are given", keyID)
+	}
+
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("data is encrypted with unknown key %q", keyID)
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, rest[len(rest)-prefixSize:])
+
+	return &reader{
+		r:      r,
+		aead:   aead,
+		header: header,
+		nonce:  nonce,
+	}, nil
+}
+
+// NewOptionalReader returns reader decrypting the data read from r if it is encrypted, or the reader of the data as
+// is otherwise. Useful for the files written before the encryption was turned on.
+func (k *Keyring) NewOptionalReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	if prefix, err := br.Peek(len(magic)); err != nil && err != io.EOF {
+		return nil, err
+	} else if !bytes.Equal(prefix, magic) {
+		return br, nil
+	}
+
+	return k.NewReader(br)
+}
+
+func (d *reader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.last {
+			return 0, io.EOF
+		}
+
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+
+	return n, nil
+}
+
+func (d *reader) open() error {
+	segmentHeader := make([]byte, 5)
+	if _, err := io.ReadFull(d.r, segmentHeader); err == io.EOF {
+		return fmt.Errorf("encrypted data is truncated")
+	} else if err != nil {
+		return fmt.Errorf("could not read segment header: %v", err)
+	}
+
+	ln := binary.BigEndian.Uint32(segmentHeader[1:])
+	if ln > segmentSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("invalid segment length: %d", ln)
+	}
+
+	ciphertext := make([]byte, ln)
+	if _, err := io.ReadFull(d.r, ciphertext); err != nil {
+		return fmt.Errorf("could not read segment: %v", err)
+	}
+
+	binary.BigEndian.PutUint32(d.nonce[prefixSize:], d.counter)
+	d.nonce[len(d.nonce)-1] = segmentHeader[0]
+
+	plaintext, err := d.aead.Open(nil, d.nonce, ciphertext, d.header)
+	if err != nil {
+		return fmt.Errorf("could not decrypt segment %d: %v", d.counter, err)
+	}
+
+	d.counter++
+	d.buf = plaintext
+	d.last = segmentHeader[0] == 1
+
+	return nil
+}
+
+// KeyFlags collects keys given on the command line, implements flag.Value
+type KeyFlags []KeyConfig
+
+// String implements flag.Value
+func (f *KeyFlags) String() string {
+	ids := make([]string, 0)
+	for _, key := range *f {
+		ids = append(ids, key.ID)
+	}
+
+	return strings.Join(ids, ",")
+}
+
+// Set implements flag.Value
+func (f *KeyFlags) Set(value string) error {
+	key, err := ParseKeyConfig(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, key)
+
+	return nil
+}
+
+// Keyring returns keyring to decrypt the files with the keys given on the command line
+func (f KeyFlags) Keyring() (*Keyring, error) {
+	if len(f) == 0 {
+		return nil, nil
+	}
+
+	return NewKeyring(Config{OldKeys: f})
+}
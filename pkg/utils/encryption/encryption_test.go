@@ -0,0 +1,284 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const headerSize = 4 + 1 + 1 + prefixSize // magic, version, key id length, nonce prefix
+
+// testKey writes the random key into the file and returns its config
+func testKey(t *testing.T, id string) KeyConfig {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), id+".key")
+	if err := ioutil.WriteFile(file, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatalf("could not write key: %v", err)
+	}
+
+	return KeyConfig{ID: id, File: file}
+}
+
+func testKeyring(t *testing.T, key KeyConfig, oldKeys ...KeyConfig) *Keyring {
+	k, err := NewKeyring(Config{Key: key, OldKeys: oldKeys})
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+
+	return k
+}
+
+// encrypt writes the data in the chunks of the given size
+func encrypt(t *testing.T, k *Keyring, data []byte, chunk int) []byte {
+	buf := &bytes.Buffer{}
+
+	w, err := k.NewWriter(buf)
+	if err != nil {
+		t.Fatalf("could not create writer: %v", err)
+	}
+
+	for p := data; len(p) > 0; {
+		n := chunk
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if written, err := w.Write(p[:n]); err != nil || written != n {
+			t.Fatalf("could not write: %d, %v", written, err)
+		}
+		p = p[n:]
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("could not close writer: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+func decrypt(k *Keyring, data []byte) ([]byte, error) {
+	r, err := k.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(r)
+}
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("could not generate data: %v", err)
+	}
+
+	return data
+}
+
+// segmentOffsets returns the offsets of the segments in the encrypted data
+func segmentOffsets(t *testing.T, keyID string, data []byte) []int {
+	offsets := make([]int, 0)
+
+	for offset := headerSize + len(keyID); offset < len(data); {
+		offsets = append(offsets, offset)
+		if offset+5 > len(data) {
+			t.Fatalf("segment header at %d is truncated", offset)
+		}
+
+		ln := int(data[offset+1])<<24 | int(data[offset+2])<<16 | int(data[offset+3])<<8 | int(data[offset+4])
+		offset += 5 + ln
+	}
+
+	return offsets
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := testKeyring(t, testKey(t, "current"))
+
+	sizes := []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3 * segmentSize, 3*segmentSize + 17}
+	chunks := []int{1000, segmentSize, 2*segmentSize + 3}
+
+	for _, size := range sizes {
+		data := randomData(t, size)
+
+		for _, chunk := range chunks {
+			if size > segmentSize && chunk == 1000 {
+				continue // the small writes of the large inputs are covered by the smaller inputs
+			}
+
+			encrypted := encrypt(t, k, data, chunk)
+			if size >= 16 && bytes.Contains(encrypted, data) {
+				t.Errorf("size %d: plaintext found in the encrypted data", size)
+			}
+
+			segments := (size + segmentSize - 1) / segmentSize
+			if segments == 0 {
+				segments = 1
+			}
+			if n := len(segmentOffsets(t, "current", encrypted)); n != segments {
+				t.Errorf("size %d: expected %d segments, got %d", size, segments, n)
+			}
+
+			decrypted, err := decrypt(k, encrypted)
+			if err != nil {
+				t.Fatalf("size %d, chunk %d: could not decrypt: %v", size, chunk, err)
+			}
+
+			if !bytes.Equal(decrypted, data) {
+				t.Errorf("size %d, chunk %d: decrypted data differs", size, chunk)
+			}
+		}
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	k := testKeyring(t, testKey(t, "current"))
+
+	encrypted := encrypt(t, k, nil, 1)
+	if len(encrypted) == headerSize+len("current") {
+		t.Fatalf("expected the empty stream to have the last segment")
+	}
+
+	decrypted, err := decrypt(k, encrypted)
+	if err != nil {
+		t.Fatalf("could not decrypt: %v", err)
+	}
+	if len(decrypted) != 0 {
+		t.Errorf("expected no data, got %d bytes", len(decrypted))
+	}
+
+	// the header alone lacks the last segment
+	if _, err := decrypt(k, encrypted[:headerSize+len("current")]); err == nil {
+		t.Errorf("expected the stream without segments to fail")
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	key := testKey(t, "current")
+	encrypted := encrypt(t, testKeyring(t, key), randomData(t, segmentSize+1), segmentSize)
+
+	// same id, different key
+	if _, err := decrypt(testKeyring(t, testKey(t, "current")), encrypted); err == nil {
+		t.Errorf("expected the decryption with the wrong key to fail")
+	}
+
+	if _, err := decrypt(testKeyring(t, testKey(t, "other")), encrypted); err == nil ||
+		!strings.Contains(err.Error(), "unknown key") {
+		t.Errorf("expected the unknown key error, got %v", err)
+	}
+
+	if _, err := decrypt(nil, encrypted); err == nil || !strings.Contains(err.Error(), "no keys") {
+		t.Errorf("expected the missing keys error, got %v", err)
+	}
+
+	// the rotated key is kept to decrypt the older data
+	if _, err := decrypt(testKeyring(t, testKey(t, "next"), key), encrypted); err != nil {
+		t.Errorf("could not decrypt with the old key: %v", err)
+	}
+}
+
+func TestTamperedSegment(t *testing.T) {
+	k := testKeyring(t, testKey(t, "current"))
+	encrypted := encrypt(t, k, randomData(t, 3*segmentSize), segmentSize)
+	offsets := segmentOffsets(t, "current", encrypted)
+
+	tamper := func(name string, fn func(data []byte) []byte) {
+		data := fn(append([]byte(nil), encrypted...))
+		if _, err := decrypt(k, data); err == nil {
+			t.Errorf("%s: expected the decryption to fail", name)
+		}
+	}
+
+	tamper("flipped ciphertext byte", func(data []byte) []byte {
+		data[offsets[1]+100] ^= 1
+		return data
+	})
+	tamper("flipped header byte", func(data []byte) []byte {
+		data[headerSize+len("current")-1] ^= 1
+		return data
+	})
+	tamper("first segment marked last", func(data []byte) []byte {
+		data[offsets[0]] = 1
+		return data
+	})
+	tamper("swapped segments", func(data []byte) []byte {
+		swapped := append([]byte(nil), data[:offsets[0]]...)
+		swapped = append(swapped, data[offsets[1]:offsets[2]]...)
+		swapped = append(swapped, data[offsets[0]:offsets[1]]...)
+		return append(swapped, data[offsets[2]:]...)
+	})
+	tamper("dropped segment", func(data []byte) []byte {
+		return append(data[:offsets[1]], data[offsets[2]:]...)
+	})
+}
+
+func TestTruncatedStream(t *testing.T) {
+	k := testKeyring(t, testKey(t, "current"))
+	encrypted := encrypt(t, k, randomData(t, 2*segmentSize+10), segmentSize)
+	offsets := segmentOffsets(t, "current", encrypted)
+
+	cuts := map[string]int{
+		"within the header":          headerSize - 1,
+		"at the segment boundary":    offsets[2],
+		"within the segment header":  offsets[2] + 3,
+		"within the last segment":    len(encrypted) - 1,
+		"within the middle segments": offsets[1] + 10,
+	}
+
+	for name, cut := range cuts {
+		decrypted, err := decrypt(k, encrypted[:cut])
+		if err == nil {
+			t.Errorf("%s: expected the truncated stream to fail, got %d bytes", name, len(decrypted))
+		}
+	}
+
+	_, err := decrypt(k, encrypted[:offsets[2]])
+	if err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("expected the truncation error, got %v", err)
+	}
+}
+
+func TestDisabledKeyring(t *testing.T) {
+	var k *Keyring
+
+	data := []byte("plain")
+	if written := encrypt(t, k, data, 2); !bytes.Equal(written, data) {
+		t.Errorf("expected the data to be written as is, got %q", written)
+	}
+
+	enabled := testKeyring(t, testKey(t, "current"))
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"plain", data},
+		{"encrypted", encrypt(t, enabled, data, 2)},
+		{"empty", nil},
+	} {
+		r, err := enabled.NewOptionalReader(bytes.NewReader(tt.data))
+		if err != nil {
+			t.Fatalf("%s: could not create reader: %v", tt.name, err)
+		}
+
+		read, err := ioutil.ReadAll(r)
+		if err != nil && err != io.EOF {
+			t.Fatalf("%s: could not read: %v", tt.name, err)
+		}
+
+		expected := data
+		if tt.data == nil {
+			expected = nil
+		}
+		if !bytes.Equal(read, expected) {
+			t.Errorf("%s: expected %q, got %q", tt.name, expected, read)
+		}
+	}
+}
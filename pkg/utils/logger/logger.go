@@ -0,0 +1,82 @@
+package logger
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+)
+
+const (
+	// FormatText represents the key=value output
+	FormatText = "text"
+	// FormatJSON represents the output of one JSON object per line
+	FormatJSON = "json"
+
+	// names of the fields
+	TableName = "table"
+	TableOID  = "oid"
+	LSN       = "lsn"
+	WorkerID  = "worker"
+)
+
+// ParseLevel parses the level name: debug, info, warn or error, the empty name is info
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+
+	if name == "" {
+		return slog.LevelInfo, nil
+	}
+
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("unknown log level: %q", name)
+	}
+
+	return level, nil
+}
+
+// Validate checks the level and the format
+func Validate(level, format string) error {
+	if _, err := ParseLevel(level); err != nil {
+		return err
+	}
+
+	switch strings.ToLower(format) {
+	case "", FormatText, FormatJSON:
+	default:
+		return fmt.Errorf("unknown log format: %q", format)
+	}
+
+	return nil
+}
+
+// Setup makes the logger of the given level and format the default one, the messages logged with the standard log
+// package go through it at the info level
+func Setup(level, format string) error {
+	if err := Validate(level, format); err != nil {
+		return err
+	}
+
+	lvl, _ := ParseLevel(level)
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if strings.ToLower(format) == FormatJSON {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
+
+// Table returns the logger with the fields of the table
+func Table(oid dbutils.OID, name fmt.Stringer) *slog.Logger {
+	return slog.With(TableOID, oid, TableName, name.String())
+}
+
+// Worker returns the logger with the id of the worker
+func Worker(id int) *slog.Logger {
+	return slog.With(WorkerID, id)
+}
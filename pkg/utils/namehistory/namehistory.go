@@ -1,14 +1,15 @@
 package namehistory
 
 import (
+	"bytes"
 	"fmt"
-	"os"
 
 	"gopkg.in/yaml.v2"
 
 	"github.com/mkabilov/logical_backup/pkg/message"
-	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/storage"
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
 )
 
 // Interface represents interface for the name history
@@ -18,42 +19,53 @@ type Interface interface {
 	SetName(dbutils.OID, dbutils.LSN, message.NamespacedName)
 }
 
-type nameAtLSN struct {
+// NameAtLSN represents the name the table got at the lsn
+type NameAtLSN struct {
 	Name message.NamespacedName `yaml:"name"`
 	LSN  dbutils.LSN            `yaml:"lsn"`
 }
 
 type nameHistory struct {
 	isChanged bool
-	entries   map[dbutils.OID][]nameAtLSN
-	filepath  string
+	entries   map[dbutils.OID][]NameAtLSN
+	storage   storage.Storage
+	filename  string
+	keyring   *encryption.Keyring
 }
 
-// New instantiates name history
-func New(filepath string) *nameHistory {
+// New instantiates name history stored in the file of the archive storage, the file is encrypted if the keyring is
+// enabled
+func New(storage storage.Storage, filename string, keyring *encryption.Keyring) *nameHistory {
 	return &nameHistory{
-		entries:  make(map[dbutils.OID][]nameAtLSN),
-		filepath: filepath,
+		entries:  make(map[dbutils.OID][]NameAtLSN),
+		storage:  storage,
+		filename: filename,
+		keyring:  keyring,
 	}
 }
 
 // SetName sets name for the table with specified oid
 func (n *nameHistory) SetName(oid dbutils.OID, lsn dbutils.LSN, name message.NamespacedName) {
 	if tableHistory, ok := n.entries[oid]; !ok {
-		n.entries[oid] = []nameAtLSN{{Name: name, LSN: lsn}}
+		n.entries[oid] = []NameAtLSN{{Name: name, LSN: lsn}}
 		n.isChanged = true
 	} else {
 		if tableHistory[len(tableHistory)-1].Name != name {
-			n.entries[oid] = append(n.entries[oid], nameAtLSN{Name: name, LSN: lsn})
+			n.entries[oid] = append(n.entries[oid], NameAtLSN{Name: name, LSN: lsn})
 			n.isChanged = true
 		}
 	}
 }
 
+// Entries returns name history of all the tables
+func (n *nameHistory) Entries() map[dbutils.OID][]NameAtLSN {
+	return n.entries
+}
+
 //GetOID returns oid of the table at atLSN point
 func (n *nameHistory) GetOID(name message.NamespacedName, atLSN dbutils.LSN) (dbutils.OID, dbutils.LSN) {
 	var (
-		recentName nameAtLSN
+		recentName NameAtLSN
 		recentOID  dbutils.OID
 	)
 
@@ -79,18 +91,22 @@ func (n *nameHistory) Save() error {
 		return nil
 	}
 
-	fp, err := os.OpenFile(n.filepath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
+	buf := &bytes.Buffer{}
+	w, err := n.keyring.NewWriter(buf)
 	if err != nil {
-		return fmt.Errorf("could not open %q file: %v", n.filepath, err)
+		return fmt.Errorf("could not init encryption: %v", err)
 	}
-	defer fp.Close()
 
-	if err := yaml.NewEncoder(fp).Encode(n.entries); err != nil {
+	if err := yaml.NewEncoder(w).Encode(n.entries); err != nil {
 		return fmt.Errorf("could not save table name history: %v", err)
 	}
 
-	if err := utils.SyncFileAndDirectory(fp); err != nil {
-		return fmt.Errorf("could not sync oid to name map file: %v", err)
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("could not encrypt table name history: %v", err)
+	}
+
+	if err := n.storage.Put(n.filename, buf, int64(buf.Len())); err != nil {
+		return fmt.Errorf("could not store oid to name map file: %v", err)
 	}
 
 	n.isChanged = false
@@ -100,13 +116,18 @@ func (n *nameHistory) Save() error {
 
 // Load loads history from file
 func (n *nameHistory) Load() error {
-	fp, err := os.OpenFile(n.filepath, os.O_RDONLY, os.ModePerm)
+	fp, err := n.storage.Get(n.filename)
 	if err != nil {
-		return fmt.Errorf("could not open %q file: %v", n.filepath, err)
+		return fmt.Errorf("could not open %q file: %v", n.filename, err)
 	}
 	defer fp.Close()
 
-	if err := yaml.NewDecoder(fp).Decode(&n.entries); err != nil {
+	r, err := n.keyring.NewOptionalReader(fp)
+	if err != nil {
+		return fmt.Errorf("could not init decryption: %v", err)
+	}
+
+	if err := yaml.NewDecoder(r).Decode(&n.entries); err != nil {
 		return fmt.Errorf("could not decode file: %v", err)
 	}
 
@@ -159,6 +159,19 @@ func (q *Queue) Size() int {
 	return q.size()
 }
 
+// Items returns the elements of the Queue in the order they will be got.
+func (q *Queue) Items() []interface{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	items := make([]interface{}, 0, q.items.Len())
+	for e := q.items.Front(); e != nil; e = e.Next() {
+		items = append(items, e.Value)
+	}
+
+	return items
+}
+
 func (q *Queue) isempty() bool {
 	return q.size() == 0
 }
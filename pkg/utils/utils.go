@@ -13,6 +13,48 @@ import (
 	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
 )
 
+const (
+	// OidNameMapFile represents file name of the oid-to-name map file in the root of the archive
+	OidNameMapFile = "oid2name.yaml"
+
+	// TableStateFile represents file name of the state file in the table directory
+	TableStateFile = "state.yaml"
+)
+
+// Duration is the time.Duration which accepts the number of days with the "d" suffix, i.e. 14d
+type Duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %v", s, err)
+		}
+		*d = Duration(time.Duration(days) * 24 * time.Hour)
+
+		return nil
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+
+	return nil
+}
+
+// String implements Stringer
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
 func TableDir(oid dbutils.OID) string {
 	tblOidBytes := fmt.Sprintf("%08x", uint32(oid))
 
@@ -0,0 +1,323 @@
+package verify
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mkabilov/logical_backup/pkg/basebackup/generations"
+	"github.com/mkabilov/logical_backup/pkg/catalog"
+	"github.com/mkabilov/logical_backup/pkg/deltas"
+	"github.com/mkabilov/logical_backup/pkg/logicalbackup"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/deltafiles"
+	"github.com/mkabilov/logical_backup/pkg/utils/encryption"
+	"github.com/mkabilov/logical_backup/pkg/utils/namehistory"
+)
+
+// Problem describes the damage found in the archive
+type Problem struct {
+	OID     dbutils.OID
+	Name    message.NamespacedName
+	File    string // relative to the root of the archive, empty if the problem is not specific to a file
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("table %s (oid %d): %s", p.Name, p.OID, p.Message)
+	}
+
+	return fmt.Sprintf("table %s (oid %d): %s: %s", p.Name, p.OID, p.File, p.Message)
+}
+
+// Report is the outcome of the verification
+type Report struct {
+	Tables     int
+	DeltaFiles int
+	Messages   int
+	Problems   []Problem
+}
+
+type verifier struct {
+	archive storage.Storage
+	keyring *encryption.Keyring
+	report  *Report
+}
+
+// tableVerifier keeps track of the transactions throughout the delta files of the table
+type tableVerifier struct {
+	*verifier
+
+	oid      dbutils.OID
+	name     message.NamespacedName
+	dir      string
+	startLSN dbutils.LSN // start lsn of the oldest generation, the deltas must continue from it
+	started  bool        // a transaction start was seen, the messages before it continue a purged delta file
+	inTx     bool        // the transaction is not committed yet
+	txLSN    dbutils.LSN // final lsn of the latest transaction
+	maxLSN   dbutils.LSN // final lsn of the latest committed transaction
+}
+
+// Verify checks the archive: every table of the oid to name map has a complete basebackup, all of its delta files are
+// readable, continue from the start lsn of the oldest basebackup and the transactions in them follow each other without
+// gaps and overlaps. Tables are limited to the given oids if any.
+func Verify(archive storage.Storage, keyring *encryption.Keyring, oids ...dbutils.OID) (*Report, error) {
+	v := &verifier{
+		archive: archive,
+		keyring: keyring,
+		report:  &Report{Problems: make([]Problem, 0)},
+	}
+
+	names := namehistory.New(archive, logicalbackup.OidNameMapFile, keyring)
+	if err := names.Load(); err != nil {
+		return nil, fmt.Errorf("could not load table names: %v", err)
+	}
+
+	entries := names.Entries()
+	if len(oids) == 0 {
+		for oid := range entries {
+			oids = append(oids, oid)
+		}
+	}
+	sort.Slice(oids, func(i, j int) bool { return oids[i] < oids[j] })
+
+	for _, oid := range oids {
+		history, ok := entries[oid]
+		if !ok {
+			return nil, fmt.Errorf("table with oid %d is not in the archive", oid)
+		}
+
+		t := &tableVerifier{
+			verifier: v,
+			oid:      oid,
+			name:     history[len(history)-1].Name,
+			dir:      utils.TableDir(oid),
+		}
+		if err := t.verify(); err != nil {
+			return nil, fmt.Errorf("could not verify table %s: %v", t.name, err)
+		}
+		v.report.Tables++
+	}
+
+	return v.report, nil
+}
+
+func (t *tableVerifier) problem(file string, format string, a ...interface{}) {
+	t.report.Problems = append(t.report.Problems, Problem{
+		OID:     t.oid,
+		Name:    t.name,
+		File:    file,
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+func (t *tableVerifier) verify() error {
+	gens, err := generations.List(t.archive, t.dir)
+	if err != nil {
+		return err
+	}
+
+	if len(gens) == 0 {
+		t.problem("", "no basebackup found")
+	} else {
+		t.startLSN = gens[0].StartLSN
+	}
+
+	for _, gen := range gens {
+		if err := t.verifyGeneration(gen); err != nil {
+			return err
+		}
+	}
+
+	objects, err := t.archive.List(path.Join(t.dir, deltas.DirName))
+	if err != nil {
+		return fmt.Errorf("could not list delta files: %v", err)
+	}
+
+	deltaFiles := make(deltafiles.DeltaFiles, 0, len(objects))
+	for _, obj := range objects {
+		filename := path.Base(obj.Name)
+		if _, err := utils.GetLSNFromDeltaFilename(filename); err != nil {
+			t.problem(obj.Name, "unexpected file in the deltas directory")
+			continue
+		}
+
+		deltaFiles = append(deltaFiles, filename)
+	}
+	sort.Sort(deltaFiles)
+
+	for _, filename := range deltaFiles {
+		t.verifyDeltaFile(path.Join(t.dir, deltas.DirName, filename))
+	}
+
+	return t.verifyState(gens)
+}
+
+// verifyGeneration checks that the info file is readable and all the dump files it refers to exist
+func (t *tableVerifier) verifyGeneration(gen generations.Generation) error {
+	infoFilename := path.Join(gen.Dir, generations.InfoFilename)
+
+	info, err := gen.LoadInfo(t.archive)
+	if err != nil {
+		t.problem(infoFilename, "%v", err)
+		return nil
+	}
+
+	files, err := gen.Files(t.archive)
+	if err != nil {
+		return fmt.Errorf("could not list basebackup files: %v", err)
+	}
+
+	stored := make(map[string]struct{}, len(files))
+	for _, obj := range files {
+		stored[path.Base(obj.Name)] = struct{}{}
+	}
+
+	dumpFilenames := info.Chunks
+	if len(dumpFilenames) == 0 {
+		dumpFilenames = []string{generations.DumpFilename}
+	}
+
+	for _, filename := range dumpFilenames {
+		if _, ok := stored[filename]; !ok {
+			t.problem(path.Join(gen.Dir, filename), "basebackup file is missing")
+		}
+	}
+
+	if info.EncryptionKey != "" && !t.keyring.HasKey(info.EncryptionKey) {
+		t.problem(infoFilename, "basebackup is encrypted with the key %q which is not given", info.EncryptionKey)
+	}
+
+	return nil
+}
+
+// verifyDeltaFile checks that the file is readable and its transactions continue the ones of the previous file
+func (t *tableVerifier) verifyDeltaFile(filename string) {
+	t.report.DeltaFiles++
+
+	fp, err := t.archive.Get(filename)
+	if err != nil {
+		t.problem(filename, "could not open file: %v", err)
+		return
+	}
+	defer fp.Close()
+
+	d := deltas.New("", false, compression.Config{}, t.keyring)
+	if err := d.LoadFrom(filename, fp); err != nil {
+		t.problem(filename, "could not load file: %v", err)
+		t.started = false // can't tell if the transactions continue across the file
+		return
+	}
+
+	h := d.Header()
+	if fileLSN, _ := utils.GetLSNFromDeltaFilename(path.Base(filename)); h.MinLSN.IsValid() && fileLSN != h.MinLSN {
+		t.problem(filename, "file name does not match the min lsn %s of the header", h.MinLSN)
+	}
+
+	var cnt uint32
+	for {
+		msg, err := d.GetMessage()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.problem(filename, "could not read message %d: %v", cnt+1, err)
+			t.started = false
+			return
+		}
+		cnt++
+		t.report.Messages++
+
+		t.checkMessage(filename, msg)
+	}
+
+	if cnt != h.MessageCount {
+		t.problem(filename, "header claims %d messages, found %d", h.MessageCount, cnt)
+	}
+}
+
+func (t *tableVerifier) checkMessage(filename string, msg message.Message) {
+	switch v := msg.(type) {
+	case message.Begin:
+		if t.inTx {
+			t.problem(filename, "transaction %s is not committed before the transaction %s begins", t.txLSN, v.FinalLSN)
+		}
+
+		if t.maxLSN.IsValid() && v.FinalLSN <= t.maxLSN {
+			t.problem(filename, "transaction %s overlaps with the previous ones ending at %s", v.FinalLSN, t.maxLSN)
+		}
+
+		t.started = true
+		t.inTx = true
+		t.txLSN = v.FinalLSN
+	case message.Commit:
+		if !t.started {
+			// the transaction began in the delta file which is not in the archive, the restore can't do without it
+			// unless the transaction was committed before the basebackup
+			if !t.txLSN.IsValid() && t.startLSN.IsValid() && v.LSN > t.startLSN {
+				t.problem(filename, "deltas do not continue from the basebackup start lsn %s: "+
+					"the beginning of the transaction %s is missing", t.startLSN, v.LSN)
+			}
+			return
+		}
+
+		if !t.inTx {
+			t.problem(filename, "commit at %s without the transaction begin", v.LSN)
+			return
+		}
+
+		t.inTx = false
+		if t.txLSN > t.maxLSN {
+			t.maxLSN = t.txLSN
+		}
+	default:
+		if t.started && !t.inTx {
+			t.problem(filename, "%s message outside of a transaction", msg.MsgType())
+		}
+	}
+}
+
+// verifyState checks that the archived deltas reach the flush lsn recorded in the state file
+func (t *tableVerifier) verifyState(gens []generations.Generation) error {
+	var state catalog.State
+
+	filename := path.Join(t.dir, logicalbackup.TableStateFile)
+	fp, err := t.archive.Get(filename)
+	if err == storage.ErrNotExist {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open state file: %v", err)
+	}
+	defer fp.Close()
+
+	r, err := t.keyring.NewOptionalReader(fp)
+	if err != nil {
+		t.problem(filename, "could not init decryption: %v", err)
+		return nil
+	}
+
+	if err := yaml.NewDecoder(r).Decode(&state); err != nil {
+		t.problem(filename, "could not decode file: %v", err)
+		return nil
+	}
+
+	// the latest transaction might continue in the delta file not written yet
+	lastLSN := t.txLSN
+	if len(gens) > 0 && gens[len(gens)-1].StartLSN > lastLSN {
+		lastLSN = gens[len(gens)-1].StartLSN
+	}
+
+	if state.LatestFlushLSN > lastLSN {
+		t.problem("", "delta files are missing: the state is flushed up to %s, the archive has transactions up to %s",
+			state.LatestFlushLSN, lastLSN)
+	}
+
+	return nil
+}
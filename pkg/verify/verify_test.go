@@ -0,0 +1,181 @@
+package verify
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/mkabilov/logical_backup/pkg/basebackup/generations"
+	"github.com/mkabilov/logical_backup/pkg/decoder"
+	"github.com/mkabilov/logical_backup/pkg/deltas"
+	"github.com/mkabilov/logical_backup/pkg/logicalbackup"
+	"github.com/mkabilov/logical_backup/pkg/message"
+	"github.com/mkabilov/logical_backup/pkg/storage"
+	"github.com/mkabilov/logical_backup/pkg/utils"
+	"github.com/mkabilov/logical_backup/pkg/utils/compression"
+	"github.com/mkabilov/logical_backup/pkg/utils/dbutils"
+	"github.com/mkabilov/logical_backup/pkg/utils/namehistory"
+)
+
+const testOID dbutils.OID = 16384
+
+// pgoutput encodes the messages of the logical replication protocol
+type pgoutput struct {
+	bytes.Buffer
+}
+
+func (p *pgoutput) uint8(v uint8)   { p.WriteByte(v) }
+func (p *pgoutput) uint16(v uint16) { binary.Write(p, binary.BigEndian, v) }
+func (p *pgoutput) uint32(v uint32) { binary.Write(p, binary.BigEndian, v) }
+func (p *pgoutput) uint64(v uint64) { binary.Write(p, binary.BigEndian, v) }
+
+func (p *pgoutput) message(t *testing.T) message.Message {
+	msg, err := decoder.Parse(p.Bytes())
+	if err != nil {
+		t.Fatalf("could not parse message: %v", err)
+	}
+
+	return msg
+}
+
+func begin(t *testing.T, lsn dbutils.LSN) message.Message {
+	p := &pgoutput{}
+	p.uint8('B')
+	p.uint64(uint64(lsn))
+	p.uint64(0)
+	p.uint32(1)
+
+	return p.message(t)
+}
+
+func insert(t *testing.T) message.Message {
+	p := &pgoutput{}
+	p.uint8('I')
+	p.uint32(uint32(testOID))
+	p.uint8('N')
+	p.uint16(1)
+	p.uint8('t')
+	p.uint32(1)
+	p.WriteString("1")
+
+	return p.message(t)
+}
+
+func commit(t *testing.T, lsn dbutils.LSN) message.Message {
+	p := &pgoutput{}
+	p.uint8('C')
+	p.uint8(0)
+	p.uint64(uint64(lsn))
+	p.uint64(uint64(lsn) + 1)
+	p.uint64(0)
+
+	return p.message(t)
+}
+
+// testArchive writes the archive of the table with the basebackup starting at the lsn and the delta files
+// 1100 (transaction 1100 begins), 1100.1 (transaction 1100 commits) and 1200 (transaction 1200)
+func testArchive(t *testing.T, startLSN dbutils.LSN) (storage.Storage, string) {
+	dir := t.TempDir()
+	archive := storage.NewLocal(dir, false)
+	tableDir := utils.TableDir(testOID)
+	genDir := path.Join(tableDir, generations.Dir(startLSN))
+
+	name := message.NamespacedName{Namespace: "public", Name: "t"}
+	names := namehistory.New(archive, logicalbackup.OidNameMapFile, nil)
+	names.SetName(testOID, startLSN, name)
+	if err := names.Save(); err != nil {
+		t.Fatalf("could not save oid to name map: %v", err)
+	}
+
+	if err := archive.Put(path.Join(genDir, generations.DumpFilename), strings.NewReader(""), 0); err != nil {
+		t.Fatalf("could not store dump: %v", err)
+	}
+
+	info, err := yaml.Marshal(message.DumpInfo{
+		StartLSN:   startLSN,
+		CreateDate: time.Now(),
+		Relation: message.Relation{
+			OID:             testOID,
+			NamespacedName:  name,
+			ReplicaIdentity: message.ReplicaIdentityDefault,
+			Columns:         []message.Column{{Name: "id", IsKey: true}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("could not encode info: %v", err)
+	}
+	if err := archive.Put(path.Join(genDir, generations.InfoFilename), bytes.NewReader(info), int64(len(info))); err != nil {
+		t.Fatalf("could not store info: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, tableDir, deltas.DirName), 0750); err != nil {
+		t.Fatalf("could not create deltas dir: %v", err)
+	}
+
+	d := deltas.New(filepath.Join(dir, tableDir), false, compression.Config{}, nil)
+	for _, msgs := range [][]message.Message{
+		{begin(t, 0x1100), insert(t)},
+		{insert(t), commit(t, 0x1100)},
+		{begin(t, 0x1200), insert(t), commit(t, 0x1200)},
+	} {
+		for _, msg := range msgs {
+			d.AddMessage(msg)
+		}
+
+		if _, _, _, err := d.Save(); err != nil {
+			t.Fatalf("could not save deltas: %v", err)
+		}
+	}
+
+	return archive, path.Join(tableDir, deltas.DirName)
+}
+
+func TestVerifyDeltasContinueFromBasebackup(t *testing.T) {
+	tests := []struct {
+		name     string
+		startLSN dbutils.LSN
+		purged   string // delta file removed from the archive
+		gap      bool
+	}{
+		{"complete archive", 0x1000, "", false},
+		{"beginning of the transaction after the basebackup is missing", 0x1000, "0000000000001100", true},
+		{"beginning of the transaction before the basebackup is missing", 0x1150, "0000000000001100", false},
+	}
+
+	for _, tt := range tests {
+		archive, deltasDir := testArchive(t, tt.startLSN)
+		if tt.purged != "" {
+			if err := archive.Delete(path.Join(deltasDir, tt.purged)); err != nil {
+				t.Fatalf("%s: could not delete delta file: %v", tt.name, err)
+			}
+		}
+
+		report, err := Verify(archive, nil)
+		if err != nil {
+			t.Fatalf("%s: could not verify: %v", tt.name, err)
+		}
+
+		if report.Tables != 1 {
+			t.Errorf("%s: expected 1 table, got %d", tt.name, report.Tables)
+		}
+
+		gap := false
+		for _, p := range report.Problems {
+			if strings.Contains(p.Message, "deltas do not continue from the basebackup start lsn") {
+				gap = true
+			} else {
+				t.Errorf("%s: unexpected problem: %s", tt.name, p)
+			}
+		}
+		if gap != tt.gap {
+			t.Errorf("%s: expected the gap to be reported: %t, problems: %v", tt.name, tt.gap, report.Problems)
+		}
+	}
+}